@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= CANCEL POLICY
+
+/**
+Cancel reason, taxonomy of cancel and reject reasons per side
+Id
+Code
+Side		1 = customer, 2 = provider, 3 = system (same as canceled_by)
+Kind		1 = cancel, 2 = reject (provider before confirming)
+Fault		0 = nobody, 1 = customer, 2 = provider
+Title
+Active
+*/
+type CancelReason struct {
+	Id     int64  `db:"id" json:"id"`
+	Code   string `db:"code" json:"code"`
+	Side   int8   `db:"side" json:"side"`
+	Kind   int8   `db:"kind" json:"kind"`
+	Fault  int8   `db:"fault" json:"fault"`
+	Title  string `db:"title" json:"title"`
+	Active int64  `db:"active" json:"active"`
+}
+
+/**
+Cancel policy per kategori jasa
+Id
+JasaId
+FreeWindow	seconds after order date customer may cancel for free
+CustomerFee	customer cancel after provider is on the way (status 2)
+ProviderFee	provider cancel after confirming
+NoShowFee	charged to customer when provider reports customer no-show
+NoShowWait	seconds provider must wait after arrival before reporting no-show
+*/
+type CancelPolicy struct {
+	Id          int64 `db:"id" json:"id"`
+	JasaId      int64 `db:"jasa_id" json:"jasa_id"`
+	FreeWindow  int64 `db:"free_window" json:"free_window"`
+	CustomerFee int64 `db:"customer_fee" json:"customer_fee"`
+	ProviderFee int64 `db:"provider_fee" json:"provider_fee"`
+	NoShowFee   int64 `db:"no_show_fee" json:"no_show_fee"`
+	NoShowWait  int64 `db:"no_show_wait" json:"no_show_wait"`
+}
+
+type PostCancelOrder struct {
+	OrderId  int64  `json:"order_id"`
+	ReasonId int64  `json:"reason_id"`
+	Message  string `json:"message"`
+}
+
+type CancelOrderInfo struct {
+	Id         int64 `db:"id"`
+	UserId     int64 `db:"user_id"`
+	ProviderId int64 `db:"provider_id"`
+	JasaId     int64 `db:"jasa_id"`
+	OrderDate  int64 `db:"order_date"`
+}
+
+type CanceledOrder struct {
+	CancelId     int64  `json:"cancel_id"`
+	OrderId      int64  `json:"order_id"`
+	Status       int64  `json:"status"`
+	CanceledBy   int8   `json:"canceled_by"`
+	ReasonId     int64  `json:"reason_id"`
+	Reason       string `json:"reason"`
+	Fee          int64  `json:"fee"`
+	FeeChargedTo int8   `json:"fee_charged_to"`
+}
+
+type ProviderReliability struct {
+	CompletedCount int64   `db:"completed_count" json:"completed_count"`
+	RejectedCount  int64   `db:"rejected_count" json:"rejected_count"`
+	CanceledCount  int64   `db:"canceled_count" json:"canceled_count"`
+	FaultCount     int64   `db:"fault_count" json:"fault_count"`
+	CancelFee      int64   `db:"cancel_fee" json:"cancel_fee"`
+	Reliability    float64 `db:"-" json:"reliability"`
+}
+
+const (
+	orderStatusComplete = 6
+	orderStatusRejected = 7
+	orderStatusCanceled = 8
+)
+
+const (
+	cancelKindCancel = 1
+	cancelKindReject = 2
+)
+
+const (
+	faultNobody   = 0
+	faultCustomer = 1
+	faultProvider = 2
+)
+
+var defaultCancelReasons = []CancelReason{
+	{Code: "customer_change_plan", Side: canceledByUser, Kind: cancelKindCancel, Fault: faultNobody, Title: "Berubah rencana"},
+	{Code: "customer_wrong_order", Side: canceledByUser, Kind: cancelKindCancel, Fault: faultNobody, Title: "Salah memesan layanan"},
+	{Code: "customer_provider_late", Side: canceledByUser, Kind: cancelKindCancel, Fault: faultProvider, Title: "Penyedia jasa terlambat"},
+	{Code: "customer_provider_no_show", Side: canceledByUser, Kind: cancelKindCancel, Fault: faultProvider, Title: "Penyedia jasa tidak datang"},
+	{Code: "customer_other", Side: canceledByUser, Kind: cancelKindCancel, Fault: faultNobody, Title: "Alasan lain"},
+	{Code: "provider_busy", Side: canceledByProvider, Kind: cancelKindReject, Fault: faultNobody, Title: "Sedang melayani pelanggan lain"},
+	{Code: "provider_too_far", Side: canceledByProvider, Kind: cancelKindReject, Fault: faultNobody, Title: "Lokasi terlalu jauh"},
+	{Code: "provider_reject_other", Side: canceledByProvider, Kind: cancelKindReject, Fault: faultNobody, Title: "Alasan lain"},
+	{Code: "provider_customer_no_show", Side: canceledByProvider, Kind: cancelKindCancel, Fault: faultCustomer, Title: "Pelanggan tidak ada di lokasi"},
+	{Code: "provider_emergency", Side: canceledByProvider, Kind: cancelKindCancel, Fault: faultProvider, Title: "Keadaan darurat"},
+	{Code: "provider_cancel_other", Side: canceledByProvider, Kind: cancelKindCancel, Fault: faultProvider, Title: "Alasan lain"},
+	{Code: "system_confirm_timeout", Side: canceledBySystem, Kind: cancelKindCancel, Fault: faultNobody, Title: "Tidak dikonfirmasi penyedia jasa"},
+	{Code: "system_dispatch_timeout", Side: canceledBySystem, Kind: cancelKindCancel, Fault: faultNobody, Title: "Tidak ada penyedia jasa tersedia"},
+}
+
+// seedCancelReasons insert default reasons which do not exist yet
+func seedCancelReasons() {
+	for _, reason := range defaultCancelReasons {
+		_, err := db.Exec(`INSERT INTO cancelreason(code, side, kind, fault, title, active)
+			VALUES($1, $2, $3, $4, $5, 1) ON CONFLICT (code) DO NOTHING`, reason.Code, reason.Side,
+			reason.Kind, reason.Fault, reason.Title)
+		checkErr(err, "Seed cancel reason failed")
+	}
+}
+
+func getCancelReasonId(code string) int64 {
+	id, err := dbmap.SelectInt(`SELECT id FROM cancelreason WHERE code=$1`, code)
+	if err != nil {
+		log.Println("Select cancel reason failed", code, err)
+	}
+	return id
+}
+
+// GetCancelReasons active reasons, filtered by side and kind when given
+func GetCancelReasons(c *gin.Context) {
+	side, _ := strconv.ParseInt(c.Query("side"), 10, 64)
+	kind, _ := strconv.ParseInt(c.Query("kind"), 10, 64)
+
+	var reasons []CancelReason
+	_, err := dbmap.Select(&reasons, `SELECT * FROM cancelreason
+		WHERE active=1 AND ($1=0 OR side=$1) AND ($2=0 OR kind=$2)
+		ORDER BY side ASC, kind ASC, id ASC`, side, kind)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": reasons})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// PostCancelReason create reason, or update it when id is given
+func PostCancelReason(c *gin.Context) {
+	var reason CancelReason
+	c.Bind(&reason)
+
+	if reason.Code == "" || reason.Title == "" || reason.Side < canceledByUser ||
+		reason.Side > canceledBySystem || (reason.Kind != cancelKindCancel && reason.Kind != cancelKindReject) {
+		c.JSON(400, gin.H{"error": "Alasan pembatalan tidak valid"})
+		return
+	}
+
+	if reason.Id > 0 {
+		if _, err := db.Exec(`UPDATE cancelreason SET code=$1, side=$2, kind=$3, fault=$4, title=$5,
+			active=$6 WHERE id=$7`, reason.Code, reason.Side, reason.Kind, reason.Fault, reason.Title,
+			reason.Active, reason.Id); err == nil {
+			c.JSON(200, reason)
+		} else {
+			c.JSON(400, gin.H{"error": "update failed"})
+		}
+		return
+	}
+
+	if err := db.QueryRow(`INSERT INTO cancelreason(code, side, kind, fault, title, active)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id`, reason.Code, reason.Side, reason.Kind,
+		reason.Fault, reason.Title, reason.Active).Scan(&reason.Id); err == nil {
+		c.JSON(200, reason)
+	} else {
+		c.JSON(400, gin.H{"error": "insert failed"})
+	}
+}
+
+func defaultCancelPolicy() CancelPolicy {
+	return CancelPolicy{
+		FreeWindow:  getEnvInt64("CANCEL_FREE_WINDOW", 300),
+		CustomerFee: getEnvInt64("CANCEL_CUSTOMER_FEE", 10000),
+		ProviderFee: getEnvInt64("CANCEL_PROVIDER_FEE", 10000),
+		NoShowFee:   getEnvInt64("CANCEL_NO_SHOW_FEE", 20000),
+		NoShowWait:  getEnvInt64("CANCEL_NO_SHOW_WAIT", 900),
+	}
+}
+
+func getCancelPolicy(jasaId int64) CancelPolicy {
+	policy := defaultCancelPolicy()
+	dbmap.SelectOne(&policy, `SELECT * FROM cancelpolicy WHERE jasa_id=$1`, jasaId)
+
+	return policy
+}
+
+// PostCancelPolicy create or update cancel policy of a kategori jasa
+func PostCancelPolicy(c *gin.Context) {
+	var policy CancelPolicy
+	c.Bind(&policy)
+
+	if policy.JasaId <= 0 || policy.FreeWindow < 0 || policy.CustomerFee < 0 ||
+		policy.ProviderFee < 0 || policy.NoShowFee < 0 || policy.NoShowWait < 0 {
+		c.JSON(400, gin.H{"error": "Kebijakan pembatalan tidak valid"})
+		return
+	}
+
+	if err := db.QueryRow(`INSERT INTO cancelpolicy(jasa_id, free_window, customer_fee, provider_fee,
+			no_show_fee, no_show_wait)
+		VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (jasa_id) DO UPDATE SET free_window=$2, customer_fee=$3, provider_fee=$4,
+			no_show_fee=$5, no_show_wait=$6
+		RETURNING id`, policy.JasaId, policy.FreeWindow, policy.CustomerFee, policy.ProviderFee,
+		policy.NoShowFee, policy.NoShowWait).Scan(&policy.Id); err == nil {
+		c.JSON(200, policy)
+	} else {
+		c.JSON(400, gin.H{"error": "insert failed"})
+	}
+}
+
+// GetCancelPolicies list configured cancel policies and the default one
+func GetCancelPolicies(c *gin.Context) {
+	var policies []CancelPolicy
+	_, err := dbmap.Select(&policies, `SELECT * FROM cancelpolicy ORDER BY jasa_id ASC`)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": policies, "default": defaultCancelPolicy()})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// getJourneyDate first time order reached status, 0 when never
+func getJourneyDate(orderId int64, status int64) int64 {
+	date, _ := dbmap.SelectInt(`SELECT COALESCE(MIN(date), 0) FROM ordervendorjourney
+		WHERE order_id=$1 AND status=$2`, orderId, status)
+
+	return date
+}
+
+// resolveCancelReason reason of the side, the generic one of the kind when not given
+func resolveCancelReason(reasonId int64, side int8, kind int8) (CancelReason, error) {
+	var reason CancelReason
+
+	if reasonId == 0 {
+		err := dbmap.SelectOne(&reason, `SELECT * FROM cancelreason
+			WHERE side=$1 AND kind=$2 AND active=1 AND code LIKE '%other' ORDER BY id ASC LIMIT 1`,
+			side, kind)
+		return reason, err
+	}
+
+	if err := dbmap.SelectOne(&reason, `SELECT * FROM cancelreason WHERE id=$1 AND active=1`,
+		reasonId); err != nil {
+		return reason, errors.New("Alasan pembatalan tidak ditemukan")
+	}
+
+	if reason.Side != side || reason.Kind != kind {
+		return reason, errors.New("Alasan pembatalan tidak sesuai")
+	}
+
+	return reason, nil
+}
+
+// cancelFee fee of a cancel and the side paying it, elapsed seconds since order date,
+// waited seconds since provider arrived
+func cancelFee(policy CancelPolicy, reason CancelReason, side int8, kind int8, status int64,
+	elapsed int64, waited int64) (int64, int8, error) {
+	switch side {
+	case canceledByUser:
+		if reason.Fault != faultProvider && status >= 2 && elapsed > policy.FreeWindow {
+			return policy.CustomerFee, canceledByUser, nil
+		}
+	case canceledByProvider:
+		if reason.Fault == faultCustomer {
+			if status != 3 || waited < policy.NoShowWait {
+				return 0, 0, errors.New("Pelanggan belum dapat dilaporkan tidak ada di lokasi")
+			}
+			return policy.NoShowFee, canceledByUser, nil
+		} else if kind == cancelKindCancel {
+			return policy.ProviderFee, canceledByProvider, nil
+		}
+	}
+
+	return 0, 0, nil
+}
+
+// cancelOrder apply cancel policy and close the order, provider canceling
+// an unconfirmed order is a reject, system only cancels an unconfirmed order
+func cancelOrder(order CancelOrderInfo, side int8, reasonId int64, message string) (CanceledOrder, error) {
+	canceled := CanceledOrder{OrderId: order.Id, CanceledBy: side}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return canceled, err
+	}
+	defer tx.Rollback()
+
+	// the same lock as a provider journey, a cancel and a completion never both commit
+	var lockedId int64
+	if err := tx.QueryRow(`SELECT id FROM ordervendor WHERE id=$1 FOR UPDATE`,
+		order.Id).Scan(&lockedId); err != nil {
+		return canceled, err
+	}
+
+	var status int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(status), 0) FROM ordervendorjourney
+		WHERE order_id=$1`, order.Id).Scan(&status); err != nil {
+		return canceled, err
+	}
+
+	if status >= orderStatusComplete {
+		return canceled, errors.New("Pesanan sudah selesai atau dibatalkan")
+	}
+
+	if side == canceledBySystem && status > 0 {
+		return canceled, errors.New("Pesanan sudah dikonfirmasi")
+	}
+
+	kind := int8(cancelKindCancel)
+	canceled.Status = orderStatusCanceled
+	if side == canceledByProvider && status == 0 {
+		kind = cancelKindReject
+		canceled.Status = orderStatusRejected
+	}
+
+	reason, err := resolveCancelReason(reasonId, side, kind)
+	if err != nil {
+		return canceled, err
+	}
+
+	canceled.ReasonId = reason.Id
+	canceled.Reason = reason.Title
+	if message == "" {
+		message = reason.Title
+	}
+
+	policy := getCancelPolicy(order.JasaId)
+	now := time.Now().Unix()
+
+	// provider only waits for a no-show after arriving
+	var waited int64
+	if status == 3 {
+		waited = now - getJourneyDate(order.Id, 3)
+	}
+
+	canceled.Fee, canceled.FeeChargedTo, err = cancelFee(policy, reason, side, kind, status,
+		now-order.OrderDate, waited)
+	if err != nil {
+		return canceled, err
+	}
+
+	var journeyId int64
+	if err := tx.QueryRow(`INSERT INTO ordervendorjourney(order_id, status, date)
+		VALUES($1, $2, $3) RETURNING id`, order.Id, canceled.Status, now).Scan(&journeyId); err != nil {
+		return canceled, err
+	}
+
+	if err := tx.QueryRow(`INSERT INTO ordercancel(journey_id, order_id, canceled_by, message,
+		reason_id, fee, fee_charged_to, created_date)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`, journeyId, order.Id, side, message,
+		reason.Id, canceled.Fee, canceled.FeeChargedTo, now).Scan(&canceled.CancelId); err != nil {
+		return canceled, err
+	}
+
+	if _, err := tx.Exec(`UPDATE ordervendor SET cancel_fee=$1 WHERE id=$2`, canceled.Fee,
+		order.Id); err != nil {
+		return canceled, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return canceled, err
+	}
+
+	settleCanceledPayment(canceled)
+	releaseOrderVoucher(order.Id)
+	releaseOrderPoints(order.Id)
+
+	publishOrderJourney(order.Id, canceled.Status)
+	publishOrderCancel(order.Id, side, message)
+
+	// system cancel is notified by the caller with its own message
+	switch side {
+	case canceledByUser:
+		sendNotificationToProvider(order.Id, canceled.Status)
+	case canceledByProvider:
+		sendNotificationToCustomer(order.Id, canceled.Status)
+	}
+
+	return canceled, nil
+}
+
+func getCancelOrderInfo(orderId int64) (CancelOrderInfo, error) {
+	var order CancelOrderInfo
+	err := dbmap.SelectOne(&order, `SELECT ov.id, ov.user_id, ov.provider_id,
+			COALESCE(pd.jasa_id, 0) as jasa_id, ov.order_date
+		FROM ordervendor ov
+			LEFT JOIN providerdata pd ON pd.id = ov.provider_id
+		WHERE ov.id=$1`, orderId)
+
+	return order, err
+}
+
+// handleCancelOrder cancel by the party owning the token, side is never taken from request
+func handleCancelOrder(c *gin.Context, postCancel PostCancelOrder) {
+	order, err := getCancelOrderInfo(postCancel.OrderId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid order"})
+		return
+	}
+
+	var side int8
+	if userId := getUserIdFromToken(c); userId != -1 && userId == order.UserId {
+		side = canceledByUser
+	} else if providerId := getProviderIdFromToken(c); providerId != -1 && providerId == order.ProviderId {
+		side = canceledByProvider
+	} else {
+		c.JSON(400, gin.H{"error": "Invalid order"})
+		return
+	}
+
+	canceled, err := cancelOrder(order, side, postCancel.ReasonId, postCancel.Message)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Pesanan telah dibatalkan", "success": "Order is cancel", "data": canceled})
+}
+
+// getProviderReliability completion against rejects, cancels and provider fault cancels
+func getProviderReliability(providerId int64) ProviderReliability {
+	var reliability ProviderReliability
+	err := dbmap.SelectOne(&reliability, `SELECT
+			COALESCE(SUM(CASE WHEN ouj.status = $2 THEN 1 ELSE 0 END), 0) as completed_count,
+			COALESCE(SUM(CASE WHEN ouj.status = $3 THEN 1 ELSE 0 END), 0) as rejected_count,
+			COALESCE(SUM(CASE WHEN ouj.status = $4 AND oc.canceled_by = $5 THEN 1 ELSE 0 END), 0) as canceled_count,
+			COALESCE(SUM(CASE WHEN ouj.status = $4 AND oc.canceled_by <> $5 AND cr.fault = $6 THEN 1 ELSE 0 END), 0) as fault_count,
+			COALESCE(SUM(CASE WHEN oc.fee_charged_to = $5 THEN oc.fee ELSE 0 END), 0) as cancel_fee
+		FROM ordervendor ov
+			JOIN (SELECT order_id, MAX(status) as status FROM ordervendorjourney GROUP BY order_id)
+				as ouj ON ouj.order_id = ov.id
+			LEFT JOIN ordercancel oc ON oc.order_id = ov.id
+			LEFT JOIN cancelreason cr ON cr.id = oc.reason_id
+		WHERE ov.provider_id=$1`, providerId, orderStatusComplete, orderStatusRejected,
+		orderStatusCanceled, canceledByProvider, faultProvider)
+
+	if err != nil {
+		log.Println("Select provider reliability failed", err)
+	}
+
+	total := reliability.CompletedCount + reliability.RejectedCount +
+		reliability.CanceledCount + reliability.FaultCount
+
+	reliability.Reliability = 1
+	if total > 0 {
+		reliability.Reliability = float64(reliability.CompletedCount) / float64(total)
+	}
+
+	return reliability
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCancelFee(t *testing.T) {
+	policy := CancelPolicy{FreeWindow: 300, CustomerFee: 10000, ProviderFee: 15000, NoShowFee: 20000,
+		NoShowWait: 600}
+
+	customerReason := CancelReason{Fault: faultNobody}
+	providerFault := CancelReason{Fault: faultProvider}
+	noShow := CancelReason{Fault: faultCustomer}
+
+	tests := []struct {
+		name      string
+		reason    CancelReason
+		side      int8
+		kind      int8
+		status    int64
+		elapsed   int64
+		waited    int64
+		fee       int64
+		chargedTo int8
+		fails     bool
+	}{
+		{"customer before on the way", customerReason, canceledByUser, cancelKindCancel, 1, 900, 0, 0, 0, false},
+		{"customer within free window", customerReason, canceledByUser, cancelKindCancel, 2, 300, 0, 0, 0, false},
+		{"customer after free window", customerReason, canceledByUser, cancelKindCancel, 2, 301, 0, 10000, canceledByUser, false},
+		{"customer blames provider", providerFault, canceledByUser, cancelKindCancel, 3, 900, 0, 0, 0, false},
+		{"provider reject", customerReason, canceledByProvider, cancelKindReject, 0, 60, 0, 0, 0, false},
+		{"provider cancel", providerFault, canceledByProvider, cancelKindCancel, 1, 60, 0, 15000, canceledByProvider, false},
+		{"no-show before arrival", noShow, canceledByProvider, cancelKindCancel, 2, 900, 0, 0, 0, true},
+		{"no-show too early", noShow, canceledByProvider, cancelKindCancel, 3, 900, 599, 0, 0, true},
+		{"no-show", noShow, canceledByProvider, cancelKindCancel, 3, 900, 600, 20000, canceledByUser, false},
+		{"system", customerReason, canceledBySystem, cancelKindCancel, 0, 900, 0, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		fee, chargedTo, err := cancelFee(policy, test.reason, test.side, test.kind, test.status,
+			test.elapsed, test.waited)
+
+		if (err != nil) != test.fails {
+			t.Errorf("%s: error %v, want failure %v", test.name, err, test.fails)
+		}
+		if fee != test.fee || chargedTo != test.chargedTo {
+			t.Errorf("%s: fee %d charged to %d, want %d charged to %d", test.name, fee, chargedTo,
+				test.fee, test.chargedTo)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Command fakegateway is a local payment gateway speaking the API of restPaymentGateway.
+//
+// Charges stay pending until they are paid through /pay/{id}, which sends the
+// signed webhook back to pengine like a real gateway would.
+//
+//	go run cmd/fakegateway/main.go -addr :9090 \
+//		-webhook http://localhost:8080/api/v1/payment/webhook -secret local
+//
+// Run pengine with PAYMENT_GATEWAY_URL=http://localhost:9090 and PAYMENT_WEBHOOK_SECRET=local.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type charge struct {
+	Id          string `json:"id"`
+	Reference   string `json:"reference"`
+	Method      string `json:"method"`
+	Amount      int64  `json:"amount"`
+	Status      string `json:"status"`
+	VaNumber    string `json:"va_number"`
+	CheckoutUrl string `json:"checkout_url"`
+	ExpiryDate  int64  `json:"expiry_date"`
+	Refunded    int64  `json:"refunded"`
+}
+
+type refund struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+	Amount int64  `json:"amount"`
+}
+
+type webhook struct {
+	EventId  string `json:"event_id"`
+	ChargeId string `json:"charge_id"`
+	Status   string `json:"status"`
+	Amount   int64  `json:"amount"`
+}
+
+type gateway struct {
+	sync.Mutex
+	publicUrl  string
+	webhookUrl string
+	secret     string
+	charges    map[string]*charge
+	refunds    map[string]refund
+	sequence   int64
+}
+
+func main() {
+	addr := flag.String("addr", ":9090", "listen address")
+	publicUrl := flag.String("public", "http://localhost:9090", "url customers open checkout pages on")
+	webhookUrl := flag.String("webhook", "http://localhost:8080/api/v1/payment/webhook", "pengine webhook url")
+	secret := flag.String("secret", "local", "webhook signing secret, same as PAYMENT_WEBHOOK_SECRET")
+	flag.Parse()
+
+	g := &gateway{
+		publicUrl:  *publicUrl,
+		webhookUrl: *webhookUrl,
+		secret:     *secret,
+		charges:    make(map[string]*charge),
+		refunds:    make(map[string]refund),
+	}
+
+	http.HandleFunc("/charges", g.createCharge)
+	http.HandleFunc("/charges/", g.chargeAction)
+	http.HandleFunc("/pay/", g.pay)
+
+	log.Println("Fake payment gateway listening on", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// createCharge POST /charges
+func (g *gateway) createCharge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSON(w, 405, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var c charge
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.Amount < 0 {
+		writeJSON(w, 400, map[string]string{"error": "invalid charge"})
+		return
+	}
+
+	g.Lock()
+	g.sequence++
+	c.Id = fmt.Sprintf("ch_%d_%d", time.Now().Unix(), g.sequence)
+	c.Status = "pending"
+	c.ExpiryDate = time.Now().Add(24 * time.Hour).Unix()
+
+	switch c.Method {
+	case "virtual_account":
+		c.VaNumber = fmt.Sprintf("8808%012d", g.sequence)
+	case "ewallet":
+		c.CheckoutUrl = g.publicUrl + "/pay/" + c.Id
+	default:
+		g.Unlock()
+		writeJSON(w, 400, map[string]string{"error": "unsupported method"})
+		return
+	}
+
+	g.charges[c.Id] = &c
+	result := c
+	g.Unlock()
+
+	log.Println("Charge created", result.Id, result.Reference, result.Method, result.Amount)
+	writeJSON(w, 200, result)
+}
+
+// chargeAction POST /charges/{id}/capture, /charges/{id}/void and /charges/{id}/refund
+func (g *gateway) chargeAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/charges/"), "/")
+	if r.Method != "POST" || len(parts) != 2 {
+		writeJSON(w, 404, map[string]string{"error": "not found"})
+		return
+	}
+
+	var body struct {
+		Amount int64 `json:"amount"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch parts[1] {
+	case "capture":
+		g.capture(w, parts[0], body.Amount)
+	case "void":
+		g.void(w, parts[0])
+	case "refund":
+		g.refund(w, parts[0], r.Header.Get("Idempotency-Key"), body.Amount)
+	default:
+		writeJSON(w, 404, map[string]string{"error": "not found"})
+	}
+}
+
+func (g *gateway) capture(w http.ResponseWriter, id string, amount int64) {
+	g.Lock()
+	c, ok := g.charges[id]
+	if !ok || c.Status != "authorized" || amount > c.Amount {
+		g.Unlock()
+		writeJSON(w, 400, map[string]string{"error": "charge can not be captured"})
+		return
+	}
+
+	c.Status = "captured"
+	c.Amount = amount
+	result := *c
+	g.Unlock()
+
+	go g.sendWebhook(result)
+	writeJSON(w, 200, result)
+}
+
+// void release authorized charge without taking any money
+func (g *gateway) void(w http.ResponseWriter, id string) {
+	g.Lock()
+	c, ok := g.charges[id]
+	if !ok || c.Status != "authorized" {
+		g.Unlock()
+		writeJSON(w, 400, map[string]string{"error": "charge can not be voided"})
+		return
+	}
+
+	c.Status = "voided"
+	result := *c
+	g.Unlock()
+
+	go g.sendWebhook(result)
+	writeJSON(w, 200, result)
+}
+
+// refund repeated idempotency key returns the first refund without refunding again
+func (g *gateway) refund(w http.ResponseWriter, id string, key string, amount int64) {
+	if key == "" {
+		writeJSON(w, 400, map[string]string{"error": "Idempotency-Key is required"})
+		return
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	if result, ok := g.refunds[key]; ok {
+		writeJSON(w, 200, result)
+		return
+	}
+
+	c, ok := g.charges[id]
+	if !ok || (c.Status != "authorized" && c.Status != "captured" && c.Status != "refunded") ||
+		amount <= 0 || c.Refunded+amount > c.Amount {
+		writeJSON(w, 400, map[string]string{"error": "charge can not be refunded"})
+		return
+	}
+
+	g.sequence++
+	result := refund{Id: fmt.Sprintf("rf_%d_%d", time.Now().Unix(), g.sequence), Status: "succeeded",
+		Amount: amount}
+
+	c.Refunded += amount
+	if c.Refunded == c.Amount {
+		c.Status = "refunded"
+	}
+	g.refunds[key] = result
+
+	log.Println("Refund", c.Id, key, amount)
+	writeJSON(w, 200, result)
+}
+
+// pay GET /pay/{id}?result=fail simulate the customer paying the charge
+func (g *gateway) pay(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/pay/")
+
+	g.Lock()
+	c, ok := g.charges[id]
+	if !ok || c.Status != "pending" {
+		g.Unlock()
+		writeJSON(w, 400, map[string]string{"error": "charge is not pending"})
+		return
+	}
+
+	switch {
+	case r.URL.Query().Get("result") == "fail":
+		c.Status = "failed"
+	case c.Method == "ewallet":
+		// e-wallet is held until pengine captures it on completion
+		c.Status = "authorized"
+	default:
+		c.Status = "captured"
+	}
+	result := *c
+	g.Unlock()
+
+	g.sendWebhook(result)
+	writeJSON(w, 200, result)
+}
+
+func (g *gateway) sendWebhook(c charge) {
+	g.Lock()
+	g.sequence++
+	event := webhook{
+		EventId:  fmt.Sprintf("evt_%d_%d", time.Now().Unix(), g.sequence),
+		ChargeId: c.Id,
+		Status:   c.Status,
+		Amount:   c.Amount,
+	}
+	g.Unlock()
+
+	body, _ := json.Marshal(event)
+
+	mac := hmac.New(sha256.New, []byte(g.secret))
+	mac.Write(body)
+
+	request, err := http.NewRequest("POST", g.webhookUrl, bytes.NewReader(body))
+	if err != nil {
+		log.Println("Webhook failed", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Println("Webhook failed", event.ChargeId, event.Status, err)
+		return
+	}
+	response.Body.Close()
+
+	log.Println("Webhook sent", event.ChargeId, event.Status, response.StatusCode)
+}
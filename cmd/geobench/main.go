@@ -0,0 +1,311 @@
+// Command geobench measures provider search by distance with and without the GiST index.
+//
+// Synthetic providers are scattered around Jakarta in a scratch schema, the same
+// GiST index as providerlocation_earth_idx is created, then random searches run
+// the full scan of each search and its indexed form side by side: the radius
+// search with the earth_box prefilter, the unbounded keyword search and the nearest
+// provider search both ordered by KNN distance.
+// Every search must return identical providers and distances.
+//
+//	DATABASE_URL=postgres://... go run cmd/geobench/main.go -sizes 10000,100000 -queries 200
+//
+// The database needs the cube and earthdistance extensions, the scratch schema is
+// dropped afterwards unless -keep is given.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+const (
+	jakartaLat  = -6.2088
+	jakartaLong = 106.8456
+
+	// providers spread about 28 km north to south and 33 km west to east
+	spreadLat  = 0.25
+	spreadLong = 0.3
+)
+
+// jasa of synthetic providers, nearest provider search is limited to one of them
+const jasaCount = 10
+
+const baselineQuery = `SELECT provider_id,
+		earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) AS distance
+	FROM geobench.providerlocation pl
+	WHERE earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) <= $3
+	ORDER BY distance ASC, provider_id ASC`
+
+const indexedQuery = `SELECT provider_id,
+		earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) AS distance
+	FROM geobench.providerlocation pl
+	WHERE earth_box(ll_to_earth($1, $2), $3) @> ll_to_earth(pl.latitude, pl.longitude)
+		AND earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) <= $3
+	ORDER BY distance ASC, provider_id ASC`
+
+// keyword search of GetProvidersByKeyword, unbounded, provider_id only breaks ties
+// so both forms can be compared row by row
+const keywordBaselineQuery = `SELECT provider_id,
+		earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) AS distance
+	FROM geobench.providerlocation pl
+	WHERE LOWER(pl.nama) LIKE LOWER('%' || $3 || '%')
+	ORDER BY distance ASC, provider_id ASC`
+
+const keywordIndexedQuery = `SELECT provider_id,
+		earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) AS distance
+	FROM geobench.providerlocation pl
+	WHERE LOWER(pl.nama) LIKE LOWER('%' || $3 || '%')
+	ORDER BY ll_to_earth(pl.latitude, pl.longitude) <-> ll_to_earth($1, $2), provider_id ASC`
+
+const nearestBaselineQuery = `SELECT provider_id,
+		earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) AS distance
+	FROM geobench.providerlocation pl
+	WHERE pl.jasa_id = $3
+	ORDER BY distance ASC, provider_id ASC
+	LIMIT 1`
+
+const nearestIndexedQuery = `SELECT provider_id,
+		earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) AS distance
+	FROM geobench.providerlocation pl
+	WHERE pl.jasa_id = $3
+	ORDER BY ll_to_earth(pl.latitude, pl.longitude) <-> ll_to_earth($1, $2), provider_id ASC
+	LIMIT 1`
+
+// comparison full scan query of a search and its indexed form, both take the same args
+type comparison struct {
+	name     string
+	baseline string
+	indexed  string
+	args     func(random *rand.Rand, lat float64, long float64) []interface{}
+}
+
+type result struct {
+	ProviderId int64
+	Distance   float64
+}
+
+type timing struct {
+	durations []float64
+}
+
+func (t *timing) add(d time.Duration) {
+	t.durations = append(t.durations, float64(d)/float64(time.Millisecond))
+}
+
+func (t *timing) percentile(p float64) float64 {
+	if len(t.durations) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64{}, t.durations...)
+	sort.Float64s(sorted)
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func (t *timing) mean() float64 {
+	if len(t.durations) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, d := range t.durations {
+		sum += d
+	}
+	return sum / float64(len(t.durations))
+}
+
+func main() {
+	dbUrl := flag.String("db", os.Getenv("DATABASE_URL"), "postgres url, default DATABASE_URL")
+	sizes := flag.String("sizes", "10000,100000", "comma separated provider counts")
+	queries := flag.Int("queries", 200, "searches per size")
+	radius := flag.Float64("radius", 2000, "search radius in meters, 2000 is the default of provider search")
+	seed := flag.Int64("seed", 1, "seed of providers and search points")
+	keep := flag.Bool("keep", false, "keep schema geobench after the run")
+	flag.Parse()
+
+	db, err := sql.Open("postgres", *dbUrl)
+	if err != nil {
+		log.Fatal("Open db failed ", err)
+	}
+	defer db.Close()
+
+	// setseed only applies to the connection it runs on
+	db.SetMaxOpenConns(1)
+
+	if err := prepareSchema(db); err != nil {
+		log.Fatal("Prepare schema failed ", err)
+	}
+
+	// a failed run leaves the schema behind, the next run drops it first
+	dropSchema := func() {
+		if !*keep {
+			db.Exec(`DROP SCHEMA geobench CASCADE`)
+		}
+	}
+
+	comparisons := []comparison{
+		{"radius", baselineQuery, indexedQuery,
+			func(random *rand.Rand, lat float64, long float64) []interface{} {
+				return []interface{}{lat, long, *radius}
+			}},
+		{"keyword", keywordBaselineQuery, keywordIndexedQuery,
+			func(random *rand.Rand, lat float64, long float64) []interface{} {
+				return []interface{}{lat, long, strconv.Itoa(random.Intn(10))}
+			}},
+		{"nearest", nearestBaselineQuery, nearestIndexedQuery,
+			func(random *rand.Rand, lat float64, long float64) []interface{} {
+				return []interface{}{lat, long, random.Intn(jasaCount) + 1}
+			}},
+	}
+
+	fmt.Printf("%8s %10s %8s %10s %10s %10s %10s %10s %10s %10s\n", "search", "providers", "queries",
+		"avg found", "base p50", "base p95", "base avg", "idx p50", "idx p95", "idx avg")
+
+	mismatches := 0
+	for _, size := range strings.Split(*sizes, ",") {
+		count, err := strconv.Atoi(strings.TrimSpace(size))
+		if err != nil || count <= 0 {
+			log.Fatal("Invalid size ", size)
+		}
+
+		if err := fillProviders(db, count, *seed); err != nil {
+			log.Fatal("Fill providers failed ", err)
+		}
+
+		for _, compare := range comparisons {
+			var baseline, indexed timing
+			var found int
+
+			random := rand.New(rand.NewSource(*seed))
+			for i := 0; i < *queries; i++ {
+				lat := jakartaLat + (random.Float64()-0.5)*spreadLat
+				long := jakartaLong + (random.Float64()-0.5)*spreadLong
+				args := compare.args(random, lat, long)
+
+				baseResults, baseDuration, err := search(db, compare.baseline, args...)
+				if err != nil {
+					log.Fatal("Baseline "+compare.name+" search failed ", err)
+				}
+
+				idxResults, idxDuration, err := search(db, compare.indexed, args...)
+				if err != nil {
+					log.Fatal("Indexed "+compare.name+" search failed ", err)
+				}
+
+				baseline.add(baseDuration)
+				indexed.add(idxDuration)
+				found += len(baseResults)
+
+				if !sameResults(baseResults, idxResults) {
+					mismatches++
+					log.Printf("Results of %s differ at %f,%f: baseline %d, indexed %d providers",
+						compare.name, lat, long, len(baseResults), len(idxResults))
+				}
+			}
+
+			fmt.Printf("%8s %10d %8d %10.1f %8.2fms %8.2fms %8.2fms %8.2fms %8.2fms %8.2fms\n",
+				compare.name, count, *queries, float64(found)/float64(*queries),
+				baseline.percentile(0.5), baseline.percentile(0.95), baseline.mean(),
+				indexed.percentile(0.5), indexed.percentile(0.95), indexed.mean())
+		}
+	}
+
+	dropSchema()
+
+	if mismatches > 0 {
+		log.Printf("%d searches returned different results", mismatches)
+		os.Exit(1)
+	}
+
+	fmt.Println("All searches returned identical results")
+}
+
+func prepareSchema(db *sql.DB) error {
+	statements := []string{
+		`DROP SCHEMA IF EXISTS geobench CASCADE`,
+		`CREATE SCHEMA geobench`,
+		`CREATE TABLE geobench.providerlocation (
+			id bigserial PRIMARY KEY,
+			provider_id bigint NOT NULL,
+			jasa_id bigint NOT NULL,
+			nama text NOT NULL,
+			latitude double precision NOT NULL,
+			longitude double precision NOT NULL)`,
+		`CREATE INDEX geobench_earth_idx
+			ON geobench.providerlocation USING gist (ll_to_earth(latitude, longitude))`,
+	}
+
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillProviders replace providers with count synthetic ones, same seed gives the same providers
+func fillProviders(db *sql.DB, count int, seed int64) error {
+	if _, err := db.Exec(`TRUNCATE geobench.providerlocation`); err != nil {
+		return err
+	}
+
+	// setseed takes a value between -1 and 1
+	if _, err := db.Exec(`SELECT setseed($1)`, float64(seed%1000)/1000); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`INSERT INTO geobench.providerlocation(provider_id, jasa_id, nama,
+			latitude, longitude)
+		SELECT i, i % $6 + 1, 'Penyedia ' || i, $1 + (random() - 0.5) * $3, $2 + (random() - 0.5) * $4
+		FROM generate_series(1, $5) i`, jakartaLat, jakartaLong, spreadLat, spreadLong,
+		count, jasaCount); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`ANALYZE geobench.providerlocation`)
+	return err
+}
+
+func search(db *sql.DB, query string, args ...interface{}) ([]result, time.Duration, error) {
+	start := time.Now()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var results []result
+	for rows.Next() {
+		var item result
+		if err := rows.Scan(&item.ProviderId, &item.Distance); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, item)
+	}
+
+	return results, time.Since(start), rows.Err()
+}
+
+func sameResults(a []result, b []result) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
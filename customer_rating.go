@@ -0,0 +1,285 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= CUSTOMER RATING
+
+/**
+Customer rating, provider rate the customer of a complete or canceled order, never shown to the customer
+Id
+OrderId		one rating per order
+ProviderId
+UserId
+Rating		1 - 5
+Tags		comma separated, see customerRatingTags
+Note
+CreatedDate
+*/
+type CustomerRating struct {
+	Id          int64  `db:"id" json:"id"`
+	OrderId     int64  `db:"order_id" json:"order_id"`
+	ProviderId  int64  `db:"provider_id" json:"provider_id"`
+	UserId      int64  `db:"user_id" json:"user_id"`
+	Rating      int64  `db:"rating" json:"rating"`
+	Tags        string `db:"tags" json:"tags"`
+	Note        string `db:"note" json:"note"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Customer block, blocked customer cannot create orders
+Id
+UserId
+Active		1 = blocked, 0 = unblocked by admin
+BlockedBy	3 = system rule, 4 = admin
+Reason
+CreatedDate
+UpdatedDate
+*/
+type CustomerBlock struct {
+	Id          int64  `db:"id" json:"id"`
+	UserId      int64  `db:"user_id" json:"user_id"`
+	Active      int8   `db:"active" json:"active"`
+	BlockedBy   int8   `db:"blocked_by" json:"blocked_by"`
+	Reason      string `db:"reason" json:"reason"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+	UpdatedDate int64  `db:"updated_date" json:"updated_date"`
+}
+
+type PostCustomerRating struct {
+	OrderId int64    `json:"order_id"`
+	Rating  int64    `json:"rating"`
+	Tags    []string `json:"tags"`
+	Note    string   `json:"note"`
+}
+
+type PostCustomerBlock struct {
+	UserId int64  `json:"user_id"`
+	Reason string `json:"reason"`
+}
+
+// CustomerRatingSummary row of view customerratingsummary
+type CustomerRatingSummary struct {
+	UserId       int64   `db:"user_id" json:"user_id"`
+	Rating       float64 `db:"rating" json:"rating"`
+	Count        int64   `db:"count" json:"count"`
+	NoShow       int64   `db:"no_show" json:"no_show"`
+	Rude         int64   `db:"rude" json:"rude"`
+	WrongAddress int64   `db:"wrong_address" json:"wrong_address"`
+}
+
+const (
+	customerTagNoShow       = "no_show"
+	customerTagRude         = "rude"
+	customerTagWrongAddress = "wrong_address"
+)
+
+var customerRatingTags = []string{customerTagNoShow, customerTagRude, customerTagWrongAddress}
+
+const (
+	customerBlockedBySystem = 3
+	customerBlockedByAdmin  = 4
+)
+
+// blocklist rules, no shows and low ratings are counted once per provider so one provider
+// cannot block a customer
+var customerBlockNoShow = getEnvInt64("CUSTOMER_BLOCK_NO_SHOW", 3)
+var customerBlockRating = getEnvInt64("CUSTOMER_BLOCK_RATING", 2)
+var customerBlockMinCount = getEnvInt64("CUSTOMER_BLOCK_MIN_COUNT", 5)
+
+func isCustomerRatingTag(tag string) bool {
+	for _, item := range customerRatingTags {
+		if item == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// getCustomerRatingSummary aggregate of ratings given to a customer by providers
+func getCustomerRatingSummary(userId int64) CustomerRatingSummary {
+	summary := CustomerRatingSummary{UserId: userId}
+	dbmap.SelectOne(&summary, `SELECT * FROM customerratingsummary WHERE user_id=$1`, userId)
+	return summary
+}
+
+func isCustomerBlocked(userId int64) bool {
+	count, _ := dbmap.SelectInt(`SELECT COUNT(*) FROM customerblock WHERE user_id=$1 AND active=1`,
+		userId)
+	return count > 0
+}
+
+func blockCustomer(userId int64, blockedBy int8, reason string) error {
+	now := time.Now().Unix()
+	_, err := db.Exec(`INSERT INTO customerblock(user_id, active, blocked_by, reason, created_date,
+		updated_date) VALUES($1, 1, $2, $3, $4, $4)
+		ON CONFLICT (user_id) DO UPDATE SET active=1, blocked_by=$2, reason=$3, updated_date=$4`,
+		userId, blockedBy, reason, now)
+	return err
+}
+
+// applyCustomerBlockRules block customer once ratings of providers cross the blocklist rules
+func applyCustomerBlockRules(userId int64) {
+	if isCustomerBlocked(userId) {
+		return
+	}
+
+	noShowProviders, _ := dbmap.SelectInt(`SELECT COUNT(DISTINCT provider_id) FROM customerrating
+		WHERE user_id=$1 AND $2 = ANY(string_to_array(tags, ','))`, userId, customerTagNoShow)
+
+	// latest rating of each provider, older ratings of the same provider do not add weight
+	var latest CustomerRatingSummary
+	dbmap.SelectOne(&latest, `SELECT COALESCE(AVG(rating), 0)::float AS rating, COUNT(*) AS count
+		FROM (SELECT DISTINCT ON (provider_id) rating FROM customerrating
+			WHERE user_id=$1 ORDER BY provider_id, created_date DESC, id DESC) r`, userId)
+
+	switch {
+	case noShowProviders >= customerBlockNoShow:
+		blockCustomer(userId, customerBlockedBySystem, "no_show")
+	case latest.Count >= customerBlockMinCount && latest.Rating < float64(customerBlockRating):
+		blockCustomer(userId, customerBlockedBySystem, "low_rating")
+	}
+}
+
+// PostProviderCustomerRating provider rate the customer once the order is complete or canceled
+func PostProviderCustomerRating(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var postRating PostCustomerRating
+	c.Bind(&postRating)
+
+	if !isRatingValue(postRating.Rating) {
+		c.JSON(400, gin.H{"error": "Rating harus antara 1 sampai 5"})
+		return
+	}
+
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range postRating.Tags {
+		if !isCustomerRatingTag(tag) {
+			c.JSON(400, gin.H{"error": "Tag tidak valid"})
+			return
+		}
+
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	var order OrderVendor
+	if err := dbmap.SelectOne(&order, `SELECT * FROM ordervendor WHERE id=$1 AND provider_id=$2`,
+		postRating.OrderId, providerId); err != nil {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	if status, err := getOrderStatus(order.Id); err != nil ||
+		(status != orderStatusComplete && status != orderStatusCanceled) {
+		c.JSON(400, gin.H{"error": "Hanya pesanan yang selesai atau dibatalkan dapat diberi rating"})
+		return
+	}
+
+	rating := CustomerRating{
+		OrderId:     order.Id,
+		ProviderId:  providerId,
+		UserId:      order.UserId,
+		Rating:      postRating.Rating,
+		Tags:        strings.Join(tags, ","),
+		Note:        postRating.Note,
+		CreatedDate: time.Now().Unix(),
+	}
+
+	err := db.QueryRow(`INSERT INTO customerrating(order_id, provider_id, user_id, rating, tags, note,
+		created_date) VALUES($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING RETURNING id`,
+		rating.OrderId, rating.ProviderId, rating.UserId, rating.Rating, rating.Tags, rating.Note,
+		rating.CreatedDate).Scan(&rating.Id)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Only can give rating once"})
+		return
+	}
+
+	applyCustomerBlockRules(order.UserId)
+
+	c.JSON(200, gin.H{"status": "Success give rating", "data": rating})
+}
+
+// GetAdminCustomerRating ratings, summary and block of a customer
+func GetAdminCustomerRating(c *gin.Context) {
+	userId, _ := strconv.ParseInt(c.Params.ByName("user_id"), 10, 64)
+
+	var ratings []CustomerRating
+	_, err := dbmap.Select(&ratings, `SELECT * FROM customerrating WHERE user_id=$1 ORDER BY id DESC`,
+		userId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	var block CustomerBlock
+	dbmap.SelectOne(&block, `SELECT * FROM customerblock WHERE user_id=$1`, userId)
+
+	c.JSON(200, gin.H{"data": ratings, "summary": getCustomerRatingSummary(userId), "block": block})
+}
+
+// GetAdminBlockedCustomers customers currently blocked
+func GetAdminBlockedCustomers(c *gin.Context) {
+	var blocks []CustomerBlock
+	_, err := dbmap.Select(&blocks, `SELECT * FROM customerblock WHERE active=1 ORDER BY updated_date DESC`)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": blocks})
+}
+
+// PostAdminBlockCustomer admin block a customer
+func PostAdminBlockCustomer(c *gin.Context) {
+	var postBlock PostCustomerBlock
+	c.Bind(&postBlock)
+
+	if strings.TrimSpace(postBlock.Reason) == "" {
+		c.JSON(400, gin.H{"error": "Alasan harus diisi"})
+		return
+	}
+
+	if count, _ := dbmap.SelectInt(`SELECT COUNT(*) FROM useraccount WHERE id=$1`,
+		postBlock.UserId); count == 0 {
+		c.JSON(400, gin.H{"error": "User tidak terdaftar"})
+		return
+	}
+
+	if err := blockCustomer(postBlock.UserId, customerBlockedByAdmin, postBlock.Reason); err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
+
+// PostAdminUnblockCustomer admin lift the block, the next rating crossing the rules blocks again
+func PostAdminUnblockCustomer(c *gin.Context) {
+	var postBlock PostCustomerBlock
+	c.Bind(&postBlock)
+
+	result, err := db.Exec(`UPDATE customerblock SET active=0, updated_date=$1
+		WHERE user_id=$2 AND active=1`, time.Now().Unix(), postBlock.UserId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(400, gin.H{"error": "User tidak diblokir"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
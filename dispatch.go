@@ -0,0 +1,521 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= DISPATCH
+
+/**
+Dispatch request, order which is offered to nearby providers
+Id
+OrderId
+JasaId
+Latitude
+Longitude
+Wave		current offer wave
+Radius		current search radius in meter
+Status		0 = searching, 1 = accepted, 2 = timed out, 3 = canceled
+CreatedDate
+UpdatedDate	last wave sent
+*/
+type DispatchRequest struct {
+	Id          int64   `db:"id" json:"id"`
+	OrderId     int64   `db:"order_id" json:"order_id"`
+	JasaId      int64   `db:"jasa_id" json:"jasa_id"`
+	Latitude    float64 `db:"latitude" json:"latitude"`
+	Longitude   float64 `db:"longitude" json:"longitude"`
+	Wave        int64   `db:"wave" json:"wave"`
+	Radius      int64   `db:"radius" json:"radius"`
+	Status      int64   `db:"status" json:"status"`
+	CreatedDate int64   `db:"created_date" json:"created_date"`
+	UpdatedDate int64   `db:"updated_date" json:"updated_date"`
+}
+
+/**
+Dispatch offer sent to a provider
+Id
+DispatchId
+OrderId
+ProviderId
+Wave
+Distance
+Response	0 = offered, 1 = accepted, 2 = declined, 3 = closed
+OfferedDate
+RespondedDate
+*/
+type DispatchOffer struct {
+	Id            int64   `db:"id" json:"id"`
+	DispatchId    int64   `db:"dispatch_id" json:"dispatch_id"`
+	OrderId       int64   `db:"order_id" json:"order_id"`
+	ProviderId    int64   `db:"provider_id" json:"provider_id"`
+	Wave          int64   `db:"wave" json:"wave"`
+	Distance      float64 `db:"distance" json:"distance"`
+	Response      int64   `db:"response" json:"response"`
+	OfferedDate   int64   `db:"offered_date" json:"offered_date"`
+	RespondedDate int64   `db:"responded_date" json:"responded_date"`
+}
+
+type DispatchOfferItem struct {
+	OrderId         int64   `db:"order_id" json:"order_id"`
+	JasaId          int64   `db:"jasa_id" json:"jasa_id"`
+	JasaName        string  `db:"jasa_name" json:"jasa_name"`
+	CustomerName    string  `db:"customer_name" json:"customer_name"`
+	Destination     string  `db:"destination" json:"destination"`
+	DestinationDesc string  `db:"destination_desc" json:"destination_desc"`
+	Latitude        float64 `db:"latitude" json:"latitude"`
+	Longitude       float64 `db:"longitude" json:"longitude"`
+	Distance        float64 `db:"distance" json:"distance"`
+	Price           int64   `db:"price" json:"price"`
+	OfferedDate     int64   `db:"offered_date" json:"offered_date"`
+}
+
+type DispatchResponse struct {
+	OrderId int64 `json:"order_id"`
+}
+
+const (
+	dispatchSearching = 0
+	dispatchAccepted  = 1
+	dispatchTimedOut  = 2
+	dispatchCanceled  = 3
+)
+
+const (
+	offerPending  = 0
+	offerAccepted = 1
+	offerDeclined = 2
+	offerClosed   = 3
+)
+
+// PostDispatchOrder create order for a jasa category, offered to nearby providers
+func PostDispatchOrder(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	var postTransaction PostTransaction
+	c.Bind(&postTransaction)
+
+	var kategoriJasa KategoriJasa
+	errJasa := dbmap.SelectOne(&kategoriJasa, `SELECT id, jenis FROM kategorijasa WHERE id=$1`,
+		postTransaction.JasaId)
+
+	if errJasa != nil {
+		c.JSON(400, gin.H{"error": "Jenis jasa tidak terdaftar"})
+		return
+	}
+
+	if isCustomerBlocked(userId) {
+		c.JSON(400, gin.H{"error": "Akun tidak dapat membuat pesanan, hubungi customer service"})
+		return
+	}
+
+	if !isPaymentMethod(postTransaction.PaymentMethod) {
+		c.JSON(400, gin.H{"error": "Metode pembayaran tidak valid"})
+		return
+	}
+
+	// provider is not known yet, vouchers limited to providers do not apply
+	var voucherUsage VoucherUsage
+	if postTransaction.VoucherCode != "" {
+		var errVoucher error
+		voucherUsage, errVoucher = reserveVoucher(postTransaction.VoucherCode, VoucherOrder{
+			UserId: userId,
+			JasaId: kategoriJasa.Id,
+			Total:  getTransactionTotal(postTransaction.Data),
+		})
+
+		if errVoucher != nil {
+			c.JSON(400, gin.H{"error": errVoucher.Error()})
+			return
+		}
+	}
+
+	if err := checkLoyaltyPoints(userId, postTransaction.Points,
+		getTransactionTotal(postTransaction.Data)-voucherUsage.Discount); err != nil {
+		if voucherUsage.Id != 0 {
+			releaseVoucherUsage(voucherUsage.Id)
+		}
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().Unix()
+
+	var orderId int64
+	err := db.QueryRow(`INSERT INTO ordervendor(provider_id,
+		user_id,
+		destination,
+		destination_lat,
+		destination_long,
+		destination_desc,
+		notes,
+		payment_method,
+		order_date,
+		discount,
+		voucher_id)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		0,
+		userId,
+		postTransaction.Destination,
+		postTransaction.DestinationLat,
+		postTransaction.DestinationLong,
+		postTransaction.DestinationDesc,
+		postTransaction.Notes,
+		postTransaction.PaymentMethod,
+		now,
+		voucherUsage.Discount,
+		voucherUsage.VoucherId).Scan(&orderId)
+
+	if err != nil {
+		if voucherUsage.Id != 0 {
+			releaseVoucherUsage(voucherUsage.Id)
+		}
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	if voucherUsage.Id != 0 {
+		attachVoucherUsage(voucherUsage, orderId)
+	}
+
+	var pointsUsed, pointsDiscount int64
+	if postTransaction.Points > 0 {
+		pointsUsed, pointsDiscount, err = redeemLoyaltyPoints(userId, orderId, postTransaction.Points)
+		if err != nil {
+			log.Println("Redeem points failed", orderId, err)
+			discardCheckoutOrder(orderId)
+			c.JSON(400, gin.H{"error": errLoyaltyNoPoints.Error()})
+			return
+		}
+	}
+
+	db.Exec(`INSERT INTO ordervendorjourney(order_id, status, date) VALUES($1, $2, $3)`,
+		orderId, 0, now)
+
+	insertOrderVendorDetails(orderId, postTransaction.Data)
+
+	payment, err := createOrderPayment(orderId, int64(postTransaction.PaymentMethod))
+	if err != nil {
+		log.Println("Create order payment failed", orderId, err)
+		discardCheckoutOrder(orderId)
+		c.JSON(400, gin.H{"error": "Pembayaran gagal dibuat"})
+		return
+	}
+
+	dispatch := DispatchRequest{
+		OrderId:     orderId,
+		JasaId:      kategoriJasa.Id,
+		Latitude:    postTransaction.DestinationLat,
+		Longitude:   postTransaction.DestinationLong,
+		Radius:      getEnvInt64("DISPATCH_INITIAL_RADIUS", 2000),
+		Status:      dispatchSearching,
+		CreatedDate: now,
+	}
+
+	errDispatch := db.QueryRow(`INSERT INTO dispatchrequest(order_id, jasa_id, latitude, longitude,
+		wave, radius, status, created_date, updated_date)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		dispatch.OrderId, dispatch.JasaId, dispatch.Latitude, dispatch.Longitude,
+		0, dispatch.Radius, dispatch.Status, now, now).Scan(&dispatch.Id)
+
+	if errDispatch != nil {
+		log.Println("Create dispatch failed", orderId, errDispatch)
+		discardCheckoutOrder(orderId)
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	publishOrderJourney(orderId, 0)
+
+	sendDispatchWave(dispatch)
+
+	c.JSON(200, gin.H{"status": "Mencari penyedia jasa", "order_id": orderId, "payment": payment,
+		"discount": voucherUsage.Discount + pointsDiscount, "points_used": pointsUsed})
+}
+
+// GetDispatchStatus dispatch progress of customer order
+func GetDispatchStatus(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+	orderId := c.Params.ByName("order_id")
+
+	var dispatch DispatchRequest
+	err := dbmap.SelectOne(&dispatch, `SELECT dr.* FROM dispatchrequest dr
+		JOIN ordervendor ov ON ov.id = dr.order_id
+		WHERE dr.order_id=$1 AND ov.user_id=$2`, orderId, userId)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	countOffer, _ := dbmap.SelectInt(`SELECT COUNT(*) FROM dispatchoffer WHERE dispatch_id=$1`,
+		dispatch.Id)
+
+	providerId, _ := dbmap.SelectInt(`SELECT provider_id FROM ordervendor WHERE id=$1`, orderId)
+
+	c.JSON(200, gin.H{
+		"order_id":    dispatch.OrderId,
+		"status":      dispatch.Status,
+		"wave":        dispatch.Wave,
+		"radius":      dispatch.Radius,
+		"count_offer": countOffer,
+		"provider_id": providerId,
+	})
+}
+
+// GetProviderDispatchOffers pending offers for provider
+func GetProviderDispatchOffers(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var offers []DispatchOfferItem
+	_, err := dbmap.Select(&offers,
+		`SELECT ov.id as order_id, kj.id as jasa_id, kj.jenis as jasa_name,
+			COALESCE(up.full_name, '') as customer_name,
+			ov.destination, ov.destination_desc,
+			ov.destination_lat as latitude, ov.destination_long as longitude,
+			dof.distance, COALESCE(otp.total_price, 0) as price, dof.offered_date
+		FROM dispatchoffer dof
+			JOIN dispatchrequest dr ON dr.id = dof.dispatch_id
+			JOIN ordervendor ov ON ov.id = dof.order_id
+			JOIN kategorijasa kj ON kj.id = dr.jasa_id
+			LEFT JOIN userprofile up ON up.user_id = ov.user_id
+			LEFT JOIN (SELECT order_id, SUM(service_price * qty) as total_price
+				FROM ordervendorcurrentdetail GROUP BY order_id) as otp ON otp.order_id = ov.id
+		WHERE dof.provider_id=$1 AND dof.response=$2 AND dr.status=$3
+		ORDER BY dof.offered_date DESC`, providerId, offerPending, dispatchSearching)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": offers})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// PostAcceptDispatch claim a dispatched order, only the first provider wins
+func PostAcceptDispatch(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var dispatchResponse DispatchResponse
+	c.Bind(&dispatchResponse)
+
+	var offer DispatchOffer
+	errOffer := dbmap.SelectOne(&offer, `SELECT dof.* FROM dispatchoffer dof
+		JOIN dispatchrequest dr ON dr.id = dof.dispatch_id
+		WHERE dof.order_id=$1 AND dof.provider_id=$2 AND dof.response=$3 AND dr.status=$4`,
+		dispatchResponse.OrderId, providerId, offerPending, dispatchSearching)
+
+	if errOffer != nil {
+		c.JSON(400, gin.H{"error": "Penawaran tidak ditemukan atau sudah ditutup"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed accept order"})
+		return
+	}
+
+	var claimedId int64
+	errClaim := tx.QueryRow(`UPDATE ordervendor SET provider_id=$1
+		WHERE id=$2 AND provider_id=0
+			AND NOT EXISTS (SELECT 1 FROM ordervendorjourney WHERE order_id=$2 AND status >= $3)
+		RETURNING id`, providerId, offer.OrderId, orderStatusComplete).Scan(&claimedId)
+
+	if errClaim != nil {
+		tx.Rollback()
+		c.JSON(409, gin.H{"error": "Pesanan sudah diambil penyedia jasa lain"})
+		return
+	}
+
+	now := time.Now().Unix()
+
+	// dispatch may be timed out by worker in the meantime
+	result, errAccept := tx.Exec(`UPDATE dispatchrequest SET status=$1, updated_date=$2
+		WHERE id=$3 AND status=$4`, dispatchAccepted, now, offer.DispatchId, dispatchSearching)
+
+	if errAccept != nil {
+		tx.Rollback()
+		c.JSON(400, gin.H{"error": "Failed accept order"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		tx.Rollback()
+		c.JSON(409, gin.H{"error": "Penawaran sudah ditutup"})
+		return
+	}
+
+	tx.Exec(`UPDATE dispatchoffer SET response=$1, responded_date=$2 WHERE id=$3`,
+		offerAccepted, now, offer.Id)
+	tx.Exec(`UPDATE dispatchoffer SET response=$1, responded_date=$2
+		WHERE dispatch_id=$3 AND response=$4`, offerClosed, now, offer.DispatchId, offerPending)
+	tx.Exec(`INSERT INTO ordervendorjourney(order_id, status, date) VALUES($1, $2, $3)`,
+		offer.OrderId, 1, now)
+
+	if tx.Commit() != nil {
+		c.JSON(400, gin.H{"error": "Failed accept order"})
+		return
+	}
+
+	publishOrderJourney(offer.OrderId, 1)
+
+	sendNotificationToCustomer(offer.OrderId, 1)
+
+	c.JSON(200, gin.H{"status": "Pesanan diterima", "order_id": offer.OrderId})
+}
+
+// PostDeclineDispatch provider decline an offer
+func PostDeclineDispatch(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var dispatchResponse DispatchResponse
+	c.Bind(&dispatchResponse)
+
+	result, err := db.Exec(`UPDATE dispatchoffer SET response=$1, responded_date=$2
+		WHERE order_id=$3 AND provider_id=$4 AND response=$5`,
+		offerDeclined, time.Now().Unix(), dispatchResponse.OrderId, providerId, offerPending)
+
+	if err == nil {
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			c.JSON(200, gin.H{"status": "Penawaran ditolak"})
+			return
+		}
+	}
+
+	c.JSON(400, gin.H{"error": "Penawaran tidak ditemukan atau sudah ditutup"})
+}
+
+// runDispatchWorker expand dispatch waves until accepted or timed out
+func runDispatchWorker() {
+	interval := time.Duration(getEnvInt64("DISPATCH_WORKER_INTERVAL", 5)) * time.Second
+
+	for range time.Tick(interval) {
+		runLocked(workerLockDispatch, processDispatchRequests)
+	}
+}
+
+func processDispatchRequests() {
+	var dispatches []DispatchRequest
+	_, err := dbmap.Select(&dispatches, `SELECT * FROM dispatchrequest WHERE status=$1`,
+		dispatchSearching)
+
+	if err != nil {
+		log.Println("Select dispatch failed", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	timeout := getEnvInt64("DISPATCH_TIMEOUT", 300)
+	waveInterval := getEnvInt64("DISPATCH_WAVE_INTERVAL", 30)
+
+	for _, dispatch := range dispatches {
+		status, _ := dbmap.SelectInt(`SELECT MAX(status) FROM ordervendorjourney WHERE order_id=$1`,
+			dispatch.OrderId)
+
+		if status != 0 {
+			// customer canceled while searching
+			closeDispatch(dispatch, dispatchCanceled)
+		} else if now-dispatch.CreatedDate >= timeout {
+			timeoutDispatch(dispatch)
+		} else if now-dispatch.UpdatedDate >= waveInterval {
+			dispatch.Radius = dispatch.Radius * 2
+			if maxRadius := getEnvInt64("DISPATCH_MAX_RADIUS", 10000); dispatch.Radius > maxRadius {
+				dispatch.Radius = maxRadius
+			}
+			sendDispatchWave(dispatch)
+		}
+	}
+}
+
+// sendDispatchWave offer order to next nearest providers not offered yet
+func sendDispatchWave(dispatch DispatchRequest) {
+	dispatch.Wave++
+	waveSize := getEnvInt64("DISPATCH_WAVE_SIZE", 3) * dispatch.Wave
+
+	var providers []SuggestedProvider
+	_, err := dbmap.Select(&providers,
+		`SELECT pd.id, pd.nama,
+			earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) AS distance
+		FROM providerlocation pl
+			JOIN providerdata pd ON pd.id = pl.provider_id
+			JOIN provideraccount pa ON pa.provider_id = pd.id
+		WHERE pd.jasa_id=$3 AND pa.status = 1 AND pa.approved = 1
+			AND earth_box(ll_to_earth($1, $2), $4) @> ll_to_earth(pl.latitude, pl.longitude)
+			AND earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) <= $4
+			AND (COALESCE(pa.max_distance, 0) = 0
+				OR earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) <= pa.max_distance)
+			AND pd.id NOT IN (SELECT provider_id FROM dispatchoffer WHERE dispatch_id=$5)
+		ORDER BY distance ASC
+		LIMIT $6`, dispatch.Latitude, dispatch.Longitude, dispatch.JasaId, dispatch.Radius,
+		dispatch.Id, waveSize)
+
+	if err != nil {
+		log.Println("Select dispatch provider failed", err)
+	}
+
+	now := time.Now().Unix()
+
+	db.Exec(`UPDATE dispatchrequest SET wave=$1, radius=$2, updated_date=$3 WHERE id=$4`,
+		dispatch.Wave, dispatch.Radius, now, dispatch.Id)
+
+	for _, provider := range providers {
+		db.Exec(`INSERT INTO dispatchoffer(dispatch_id, order_id, provider_id, wave, distance,
+			response, offered_date, responded_date)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8)`, dispatch.Id, dispatch.OrderId, provider.Id,
+			dispatch.Wave, provider.Distance, offerPending, now, 0)
+
+		pushToProviderId(provider.Id, map[string]string{
+			"message":  "Ada pesanan baru di sekitar Anda.",
+			"order_id": strconv.FormatInt(dispatch.OrderId, 10),
+			"dispatch": "1",
+		})
+	}
+}
+
+// closeDispatch stop searching, false when dispatch was already accepted or closed
+func closeDispatch(dispatch DispatchRequest, status int64) bool {
+	now := time.Now().Unix()
+
+	result, err := db.Exec(`UPDATE dispatchrequest SET status=$1, updated_date=$2
+		WHERE id=$3 AND status=$4`, status, now, dispatch.Id, dispatchSearching)
+
+	if err != nil {
+		return false
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return false
+	}
+
+	db.Exec(`UPDATE dispatchoffer SET response=$1, responded_date=$2
+		WHERE dispatch_id=$3 AND response=$4`, offerClosed, now, dispatch.Id, offerPending)
+
+	return true
+}
+
+func timeoutDispatch(dispatch DispatchRequest) {
+	if !closeDispatch(dispatch, dispatchTimedOut) {
+		return
+	}
+
+	order, err := getCancelOrderInfo(dispatch.OrderId)
+	if err != nil {
+		return
+	}
+
+	message := "Maaf, tidak ada penyedia jasa yang tersedia saat ini."
+
+	if _, err := cancelOrder(order, canceledBySystem, getCancelReasonId("system_dispatch_timeout"),
+		message); err != nil {
+		return
+	}
+
+	pushToCustomer(dispatch.OrderId, map[string]string{
+		"message":  message,
+		"order_id": strconv.FormatInt(dispatch.OrderId, 10),
+	})
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= DISPUTE
+
+/**
+Order dispute, complaint of customer about a complete order
+Id
+OrderId
+UserId
+ProviderId
+Category
+Description
+Status		0 = open, 1 = awaiting provider, 2 = under review, 3 = resolved
+ProviderResponse
+Outcome		0 = none, 1 = refund, 2 = partial refund, 3 = warning, 4 = dismissed
+RefundAmount
+Resolution	admin note of the outcome
+CreatedDate
+UpdatedDate
+ResolvedDate
+*/
+type OrderDispute struct {
+	Id               int64  `db:"id" json:"id"`
+	OrderId          int64  `db:"order_id" json:"order_id"`
+	UserId           int64  `db:"user_id" json:"user_id"`
+	ProviderId       int64  `db:"provider_id" json:"provider_id"`
+	Category         string `db:"category" json:"category"`
+	Description      string `db:"description" json:"description"`
+	Status           int64  `db:"status" json:"status"`
+	ProviderResponse string `db:"provider_response" json:"provider_response"`
+	Outcome          int64  `db:"outcome" json:"outcome"`
+	RefundAmount     int64  `db:"refund_amount" json:"refund_amount"`
+	Resolution       string `db:"resolution" json:"resolution"`
+	CreatedDate      int64  `db:"created_date" json:"created_date"`
+	UpdatedDate      int64  `db:"updated_date" json:"updated_date"`
+	ResolvedDate     int64  `db:"resolved_date" json:"resolved_date"`
+}
+
+/**
+Dispute photo, evidence attached by customer or provider
+Id
+DisputeId
+Actor		1 = customer, 2 = provider
+ImageUrl
+CreatedDate
+*/
+type DisputePhoto struct {
+	Id          int64  `db:"id" json:"id"`
+	DisputeId   int64  `db:"dispute_id" json:"dispute_id"`
+	Actor       int8   `db:"actor" json:"actor"`
+	ImageUrl    string `db:"image_url" json:"image_url"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Dispute log, audit trail of every dispute action
+Id
+DisputeId
+Actor		1 = customer, 2 = provider, 4 = admin
+ActorId
+Action
+FromStatus
+ToStatus
+Note
+CreatedDate
+*/
+type DisputeLog struct {
+	Id          int64  `db:"id" json:"id"`
+	DisputeId   int64  `db:"dispute_id" json:"dispute_id"`
+	Actor       int8   `db:"actor" json:"actor"`
+	ActorId     int64  `db:"actor_id" json:"actor_id"`
+	Action      string `db:"action" json:"action"`
+	FromStatus  int64  `db:"from_status" json:"from_status"`
+	ToStatus    int64  `db:"to_status" json:"to_status"`
+	Note        string `db:"note" json:"note"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+type DisputeCategory struct {
+	Code  string `json:"code"`
+	Title string `json:"title"`
+}
+
+type PostDispute struct {
+	OrderId     int64    `json:"order_id"`
+	Category    string   `json:"category"`
+	Description string   `json:"description"`
+	Photos      []string `json:"photos"`
+}
+
+type PostDisputeResponse struct {
+	DisputeId int64    `json:"dispute_id"`
+	Response  string   `json:"response"`
+	Photos    []string `json:"photos"`
+}
+
+type PostDisputeReview struct {
+	DisputeId int64  `json:"dispute_id"`
+	Action    string `json:"action"`
+	Note      string `json:"note"`
+}
+
+type PostDisputeResolve struct {
+	DisputeId    int64  `json:"dispute_id"`
+	Outcome      int64  `json:"outcome"`
+	RefundAmount int64  `json:"refund_amount"`
+	Note         string `json:"note"`
+}
+
+type OrderDisputeDetail struct {
+	OrderDispute
+	Photos []DisputePhoto `json:"photos"`
+	Logs   []DisputeLog   `json:"logs,omitempty"`
+}
+
+const (
+	disputeOpen             = 0
+	disputeAwaitingProvider = 1
+	disputeUnderReview      = 2
+	disputeResolved         = 3
+)
+
+const (
+	disputeOutcomeNone          = 0
+	disputeOutcomeRefund        = 1
+	disputeOutcomePartialRefund = 2
+	disputeOutcomeWarning       = 3
+	disputeOutcomeDismissed     = 4
+)
+
+const (
+	disputeActorCustomer = 1
+	disputeActorProvider = 2
+	disputeActorAdmin    = 4
+)
+
+var disputeCategories = []DisputeCategory{
+	{Code: "quality", Title: "Hasil pekerjaan tidak sesuai"},
+	{Code: "incomplete", Title: "Pekerjaan tidak selesai"},
+	{Code: "price", Title: "Harga tidak sesuai"},
+	{Code: "damage", Title: "Kerusakan barang"},
+	{Code: "behavior", Title: "Perilaku penyedia jasa"},
+	{Code: "other", Title: "Lainnya"},
+}
+
+func isDisputeCategory(code string) bool {
+	for _, category := range disputeCategories {
+		if category.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDisputeCategories categories customer can choose when opening dispute
+func GetDisputeCategories(c *gin.Context) {
+	c.JSON(200, gin.H{"data": disputeCategories, "window": getEnvInt64("DISPUTE_WINDOW", 3*24*60*60)})
+}
+
+func logDisputeAction(disputeId int64, actor int8, actorId int64, action string, fromStatus int64,
+	toStatus int64, note string) {
+	db.Exec(`INSERT INTO disputelog(dispute_id, actor, actor_id, action, from_status, to_status,
+		note, created_date)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)`, disputeId, actor, actorId, action, fromStatus,
+		toStatus, note, time.Now().Unix())
+}
+
+func insertDisputePhotos(disputeId int64, actor int8, photos []string) {
+	for _, photo := range photos {
+		if photo == "" {
+			continue
+		}
+
+		db.Exec(`INSERT INTO disputephoto(dispute_id, actor, image_url, created_date)
+			VALUES($1, $2, $3, $4)`, disputeId, actor, photo, time.Now().Unix())
+	}
+}
+
+// changeDisputeStatus move dispute only when it is still in one of the given statuses
+func changeDisputeStatus(dispute OrderDispute, toStatus int64, fromStatuses ...int64) bool {
+	for _, fromStatus := range fromStatuses {
+		result, err := db.Exec(`UPDATE orderdispute SET status=$1, updated_date=$2
+			WHERE id=$3 AND status=$4`, toStatus, time.Now().Unix(), dispute.Id, fromStatus)
+
+		if err != nil {
+			return false
+		}
+
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PostOpenDispute customer open dispute within DISPUTE_WINDOW after order complete
+func PostOpenDispute(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	var postDispute PostDispute
+	c.Bind(&postDispute)
+
+	var order OrderVendor
+	err := dbmap.SelectOne(&order, `SELECT id, provider_id, user_id FROM ordervendor
+		WHERE id=$1 AND user_id=$2`, postDispute.OrderId, userId)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	if !isDisputeCategory(postDispute.Category) || postDispute.Description == "" {
+		c.JSON(400, gin.H{"error": "Kategori dan deskripsi keluhan harus diisi"})
+		return
+	}
+
+	status, _ := getOrderStatus(order.Id)
+	completeDate := getJourneyDate(order.Id, orderStatusComplete)
+	now := time.Now().Unix()
+
+	if status != orderStatusComplete || completeDate == 0 ||
+		now-completeDate > getEnvInt64("DISPUTE_WINDOW", 3*24*60*60) {
+		c.JSON(400, gin.H{"error": "Keluhan hanya dapat diajukan untuk pesanan selesai dalam batas waktu"})
+		return
+	}
+
+	dispute := OrderDispute{
+		OrderId:     order.Id,
+		UserId:      userId,
+		ProviderId:  order.ProviderId,
+		Category:    postDispute.Category,
+		Description: postDispute.Description,
+		Status:      disputeOpen,
+		CreatedDate: now,
+		UpdatedDate: now,
+	}
+
+	if err := db.QueryRow(`INSERT INTO orderdispute(order_id, user_id, provider_id, category,
+		description, status, provider_response, outcome, refund_amount, resolution, created_date,
+		updated_date, resolved_date)
+		VALUES($1, $2, $3, $4, $5, $6, '', 0, 0, '', $7, $8, 0)
+		ON CONFLICT (order_id) WHERE status <> 3 DO NOTHING RETURNING id`, dispute.OrderId,
+		dispute.UserId, dispute.ProviderId, dispute.Category, dispute.Description, dispute.Status,
+		dispute.CreatedDate, dispute.UpdatedDate).Scan(&dispute.Id); err == sql.ErrNoRows {
+		// unresolved dispute of the order exists, orderdispute_open_idx
+		c.JSON(400, gin.H{"error": "Pesanan ini sudah memiliki keluhan yang sedang diproses"})
+		return
+	} else if err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	insertDisputePhotos(dispute.Id, disputeActorCustomer, postDispute.Photos)
+	logDisputeAction(dispute.Id, disputeActorCustomer, userId, "open", disputeOpen, disputeOpen,
+		dispute.Description)
+
+	pushToProvider(order.Id, map[string]string{
+		"message":    "Pelanggan mengajukan keluhan atas pesanan Anda.",
+		"type":       "dispute",
+		"order_id":   strconv.FormatInt(order.Id, 10),
+		"dispute_id": strconv.FormatInt(dispute.Id, 10),
+	})
+
+	c.JSON(200, gin.H{"data": dispute})
+}
+
+// PostProviderDisputeResponse provider answer dispute, then it is reviewed by admin
+func PostProviderDisputeResponse(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var postResponse PostDisputeResponse
+	c.Bind(&postResponse)
+
+	var dispute OrderDispute
+	err := dbmap.SelectOne(&dispute, `SELECT * FROM orderdispute WHERE id=$1 AND provider_id=$2`,
+		postResponse.DisputeId, providerId)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Keluhan tidak ditemukan"})
+		return
+	}
+
+	if postResponse.Response == "" {
+		c.JSON(400, gin.H{"error": "Tanggapan harus diisi"})
+		return
+	}
+
+	if !changeDisputeStatus(dispute, disputeUnderReview, disputeOpen, disputeAwaitingProvider) {
+		c.JSON(409, gin.H{"error": "Keluhan tidak menunggu tanggapan"})
+		return
+	}
+
+	db.Exec(`UPDATE orderdispute SET provider_response=$1 WHERE id=$2`, postResponse.Response,
+		dispute.Id)
+
+	insertDisputePhotos(dispute.Id, disputeActorProvider, postResponse.Photos)
+	logDisputeAction(dispute.Id, disputeActorProvider, providerId, "respond", dispute.Status,
+		disputeUnderReview, postResponse.Response)
+
+	c.JSON(200, gin.H{"status": "Tanggapan telah dikirim"})
+}
+
+// PostAdminDisputeReview admin ask provider response, or take dispute under review
+func PostAdminDisputeReview(c *gin.Context) {
+	var postReview PostDisputeReview
+	c.Bind(&postReview)
+
+	var dispute OrderDispute
+	if err := dbmap.SelectOne(&dispute, `SELECT * FROM orderdispute WHERE id=$1`,
+		postReview.DisputeId); err != nil {
+		c.JSON(400, gin.H{"error": "Keluhan tidak ditemukan"})
+		return
+	}
+
+	var toStatus int64
+	var changed bool
+
+	switch postReview.Action {
+	case "request_response":
+		toStatus = disputeAwaitingProvider
+		changed = changeDisputeStatus(dispute, toStatus, disputeOpen, disputeUnderReview)
+	case "review":
+		toStatus = disputeUnderReview
+		changed = changeDisputeStatus(dispute, toStatus, disputeOpen, disputeAwaitingProvider)
+	default:
+		c.JSON(400, gin.H{"error": "action harus request_response atau review"})
+		return
+	}
+
+	if !changed {
+		c.JSON(409, gin.H{"error": "Status keluhan tidak dapat diubah"})
+		return
+	}
+
+	logDisputeAction(dispute.Id, disputeActorAdmin, 0, postReview.Action, dispute.Status, toStatus,
+		postReview.Note)
+
+	if toStatus == disputeAwaitingProvider {
+		pushToProvider(dispute.OrderId, map[string]string{
+			"message":    "Mohon berikan tanggapan atas keluhan pelanggan.",
+			"type":       "dispute",
+			"order_id":   strconv.FormatInt(dispute.OrderId, 10),
+			"dispute_id": strconv.FormatInt(dispute.Id, 10),
+		})
+	}
+
+	c.JSON(200, gin.H{"status": "Success", "dispute_status": toStatus})
+}
+
+// validateDisputeOutcome refund amount of the outcome, limited by order total
+func validateDisputeOutcome(dispute OrderDispute, outcome int64, refundAmount int64) (int64, error) {
+	total, err := getOrderAmountDue(dispute.OrderId)
+	if err != nil {
+		return 0, err
+	}
+
+	switch outcome {
+	case disputeOutcomeRefund:
+		return total, nil
+	case disputeOutcomePartialRefund:
+		if refundAmount <= 0 || refundAmount >= total {
+			return 0, errors.New("refund_amount harus lebih dari 0 dan kurang dari total pesanan")
+		}
+		return refundAmount, nil
+	case disputeOutcomeWarning, disputeOutcomeDismissed:
+		return 0, nil
+	}
+
+	return 0, errors.New("outcome tidak valid")
+}
+
+// PostAdminDisputeResolve admin close dispute with an outcome
+func PostAdminDisputeResolve(c *gin.Context) {
+	var postResolve PostDisputeResolve
+	c.Bind(&postResolve)
+
+	var dispute OrderDispute
+	if err := dbmap.SelectOne(&dispute, `SELECT * FROM orderdispute WHERE id=$1`,
+		postResolve.DisputeId); err != nil {
+		c.JSON(400, gin.H{"error": "Keluhan tidak ditemukan"})
+		return
+	}
+
+	refundAmount, err := validateDisputeOutcome(dispute, postResolve.Outcome, postResolve.RefundAmount)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+	defer tx.Rollback()
+
+	// the lock keeps a concurrent resolve waiting until this outcome and its refund are settled
+	var status int64
+	if err := tx.QueryRow(`SELECT status FROM orderdispute WHERE id=$1 FOR UPDATE`,
+		dispute.Id).Scan(&status); err != nil || status == disputeResolved {
+		c.JSON(409, gin.H{"error": "Keluhan sudah diselesaikan"})
+		return
+	}
+
+	// refund is recorded first, the dispute stays open when it fails,
+	// the same idempotency key returns this refund again on a retry
+	var refund Refund
+	if refundAmount > 0 {
+		refund, err = requestRefund(dispute.OrderId, "dispute:"+strconv.FormatInt(dispute.Id, 10),
+			refundAmount, 0, dispute.Id)
+		if err != nil {
+			log.Println("Request dispute refund failed", dispute.Id, err)
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		// amount already refunded by cancellation lowers what is left to refund
+		refundAmount = refund.Amount
+	}
+
+	now := time.Now().Unix()
+	if _, err := tx.Exec(`UPDATE orderdispute SET status=$1, outcome=$2, refund_amount=$3,
+		resolution=$4, updated_date=$5, resolved_date=$5
+		WHERE id=$6`, disputeResolved, postResolve.Outcome, refundAmount, postResolve.Note, now,
+		dispute.Id); err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	logDisputeAction(dispute.Id, disputeActorAdmin, 0, "resolve", status, disputeResolved,
+		postResolve.Note)
+
+	if refund.Id != 0 {
+		go processRefund(refund.Id)
+	}
+
+	data := map[string]string{
+		"message":    "Keluhan atas pesanan Anda telah diselesaikan.",
+		"type":       "dispute",
+		"order_id":   strconv.FormatInt(dispute.OrderId, 10),
+		"dispute_id": strconv.FormatInt(dispute.Id, 10),
+	}
+	pushToCustomer(dispute.OrderId, data)
+	pushToProvider(dispute.OrderId, data)
+
+	c.JSON(200, gin.H{"status": "Success", "outcome": postResolve.Outcome, "refund_amount": refundAmount,
+		"refund": refund})
+}
+
+func getDisputeDetail(dispute OrderDispute, withLogs bool) OrderDisputeDetail {
+	detail := OrderDisputeDetail{OrderDispute: dispute, Photos: []DisputePhoto{}}
+
+	dbmap.Select(&detail.Photos, `SELECT * FROM disputephoto WHERE dispute_id=$1 ORDER BY id ASC`,
+		dispute.Id)
+
+	if withLogs {
+		dbmap.Select(&detail.Logs, `SELECT * FROM disputelog WHERE dispute_id=$1 ORDER BY id ASC`,
+			dispute.Id)
+	}
+
+	return detail
+}
+
+// getOrderOpenDisputes unresolved disputes shown in order detail of both parties
+func getOrderOpenDisputes(orderId int64) []OrderDisputeDetail {
+	var disputes []OrderDispute
+	dbmap.Select(&disputes, `SELECT * FROM orderdispute WHERE order_id=$1 AND status<>$2
+		ORDER BY id DESC`, orderId, disputeResolved)
+
+	details := []OrderDisputeDetail{}
+	for _, dispute := range disputes {
+		details = append(details, getDisputeDetail(dispute, false))
+	}
+
+	return details
+}
+
+// GetAdminDisputes list disputes, status=-1 for all
+func GetAdminDisputes(c *gin.Context) {
+	status, err := strconv.ParseInt(c.Query("status"), 10, 64)
+	if err != nil {
+		status = -1
+	}
+
+	var disputes []OrderDispute
+	_, err = dbmap.Select(&disputes, `SELECT * FROM orderdispute
+		WHERE ($1 < 0 OR status=$1) ORDER BY created_date DESC`, status)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": disputes})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// GetAdminDisputeDetail dispute with photos and audit trail
+func GetAdminDisputeDetail(c *gin.Context) {
+	var dispute OrderDispute
+	if err := dbmap.SelectOne(&dispute, `SELECT * FROM orderdispute WHERE id=$1`,
+		c.Params.ByName("dispute_id")); err != nil {
+		c.JSON(400, gin.H{"error": "Keluhan tidak ditemukan"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": getDisputeDetail(dispute, true)})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// ========================= ETA
+
+/**
+Order ETA, latest estimate while provider on the way
+Id
+OrderId
+Distance	meter to destination
+Duration	seconds to destination
+Speed		meter per second used for estimation
+UpdatedDate
+NearNotified	1 = customer already notified provider is near
+*/
+type OrderEta struct {
+	Id           int64   `db:"id" json:"-"`
+	OrderId      int64   `db:"order_id" json:"order_id"`
+	Distance     float64 `db:"distance" json:"distance"`
+	Duration     int64   `db:"duration" json:"duration"`
+	Speed        float64 `db:"speed" json:"speed"`
+	UpdatedDate  int64   `db:"updated_date" json:"updated_date"`
+	NearNotified int64   `db:"near_notified" json:"-"`
+}
+
+type EtaEstimate struct {
+	Distance float64
+	Duration int64
+}
+
+// EtaEstimator estimate travel from provider location to destination,
+// speed is recent movement speed of provider in meter per second
+type EtaEstimator interface {
+	Estimate(from ProviderLatLng, to ProviderLatLng, speed float64) EtaEstimate
+}
+
+// straightLineEstimator great circle distance multiplied by road factor
+type straightLineEstimator struct {
+	RoadFactor   float64
+	DefaultSpeed float64
+	MinSpeed     float64
+}
+
+func (e straightLineEstimator) Estimate(from ProviderLatLng, to ProviderLatLng, speed float64) EtaEstimate {
+	distance := distanceInMeter(from.Latitude, from.Longitude, to.Latitude, to.Longitude) * e.RoadFactor
+
+	if speed < e.MinSpeed {
+		speed = e.DefaultSpeed
+	}
+
+	return EtaEstimate{
+		Distance: distance,
+		Duration: int64(distance / speed),
+	}
+}
+
+var etaEstimator EtaEstimator = straightLineEstimator{
+	RoadFactor:   1.3,
+	DefaultSpeed: 8.3,
+	MinSpeed:     1.5,
+}
+
+// refreshOrderEta re-estimate ETA from latest tracking point, only while on the way
+func refreshOrderEta(orderId int64) {
+	status, err := getOrderStatus(orderId)
+	if err != nil || status != 2 {
+		return
+	}
+
+	lastPoint, errPoint := getLastTrackingPoint(orderId)
+	if errPoint != nil {
+		return
+	}
+
+	var destination ProviderLatLng
+	errDestination := dbmap.SelectOne(&destination, `SELECT destination_lat as latitude,
+		destination_long as longitude FROM ordervendor WHERE id=$1`, orderId)
+
+	if errDestination != nil {
+		return
+	}
+
+	// recent movement speed of last 5 minutes
+	speed, _ := dbmap.SelectFloat(`SELECT COALESCE(AVG(speed), 0) FROM ordervendortrackingpoint
+		WHERE order_id=$1 AND recorded_date >= $2`, orderId, lastPoint.RecordedDate-300)
+
+	estimate := etaEstimator.Estimate(ProviderLatLng{
+		Latitude:  lastPoint.Latitude,
+		Longitude: lastPoint.Longitude,
+	}, destination, speed)
+
+	now := time.Now().Unix()
+
+	// concurrent pings of the same order update one row
+	var nearNotified int64
+	errEta := db.QueryRow(`INSERT INTO ordereta(order_id, distance, duration, speed, updated_date, near_notified)
+		VALUES($1, $2, $3, $4, $5, 0)
+		ON CONFLICT (order_id) DO UPDATE SET distance=$2, duration=$3, speed=$4, updated_date=$5
+		RETURNING near_notified`, orderId, estimate.Distance, estimate.Duration,
+		speed, now).Scan(&nearNotified)
+
+	if errEta != nil {
+		log.Println("Save order eta failed", orderId, errEta)
+		return
+	}
+
+	if nearNotified == 0 && estimate.Duration <= getEnvInt64("ETA_NEAR_SECONDS", 180) {
+		result, errNotified := db.Exec(`UPDATE ordereta SET near_notified=1
+			WHERE order_id=$1 AND near_notified=0`, orderId)
+
+		if errNotified != nil {
+			log.Println(errNotified)
+			return
+		}
+
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			minutes := estimate.Duration/60 + 1
+
+			pushToCustomer(orderId, map[string]string{
+				"message":  "Penyedia jasa akan tiba dalam " + strconv.FormatInt(minutes, 10) + " menit.",
+				"order_id": strconv.FormatInt(orderId, 10),
+			})
+		}
+	}
+}
+
+// getOrderEta current estimate of order on the way, nil otherwise
+func getOrderEta(orderId int64) *OrderEta {
+	status, err := getOrderStatus(orderId)
+	if err != nil || status != 2 {
+		return nil
+	}
+
+	var orderEta OrderEta
+	if dbmap.SelectOne(&orderEta, `SELECT * FROM ordereta WHERE order_id=$1`, orderId) != nil {
+		return nil
+	}
+
+	return &orderEta
+}
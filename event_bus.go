@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ========================= EVENT BUS
+
+/**
+Bus event, published through pg_notify so every instance receives it
+Id
+Topic
+OrderId
+ProviderId
+Data		json payload
+CreatedDate
+WebhookDate	when webhook was delivered by one of the instances
+WebhookAttempts
+WebhookNextDate	earliest next attempt, also the lease of the instance posting it
+*/
+type BusEvent struct {
+	Id          int64  `db:"id" json:"id"`
+	Topic       string `db:"topic" json:"topic"`
+	OrderId     int64  `db:"order_id" json:"order_id"`
+	ProviderId  int64  `db:"provider_id" json:"provider_id"`
+	Data        string `db:"data" json:"data"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+	WebhookDate int64  `db:"webhook_date" json:"-"`
+
+	WebhookAttempts int64 `db:"webhook_attempts" json:"-"`
+	WebhookNextDate int64 `db:"webhook_next_date" json:"-"`
+}
+
+const (
+	topicOrderCreated    = "order_created"
+	topicOrderStatus     = "order_status"
+	topicTrackingUpdated = "tracking_updated"
+	topicOrderMessage    = "order_message"
+	topicPaymentStatus   = "payment_status"
+	topicProviderOnline  = "provider_online"
+	topicProviderOffline = "provider_offline"
+	topicAll             = "*"
+)
+
+const eventBusChannel = "pengine_events"
+
+// EventBus deliver bus events to subscribers of this instance, once per event
+type EventBus struct {
+	sync.Mutex
+	handlers  map[string][]func(BusEvent)
+	delivered map[int64]int64
+}
+
+var eventBus = &EventBus{
+	handlers:  make(map[string][]func(BusEvent)),
+	delivered: make(map[int64]int64),
+}
+
+// Subscribe handler to topic, topicAll receive every topic
+func (b *EventBus) Subscribe(topic string, handler func(BusEvent)) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.handlers[topic] = append(b.handlers[topic], handler)
+}
+
+func (b *EventBus) Deliver(event BusEvent) {
+	b.Lock()
+	if _, exists := b.delivered[event.Id]; exists {
+		b.Unlock()
+		return
+	}
+	b.delivered[event.Id] = event.CreatedDate
+
+	handlers := append([]func(BusEvent){}, b.handlers[event.Topic]...)
+	handlers = append(handlers, b.handlers[topicAll]...)
+	b.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// Prune forget delivered events created before, they are never backfilled again
+func (b *EventBus) Prune(before int64) {
+	b.Lock()
+	defer b.Unlock()
+
+	for id, createdDate := range b.delivered {
+		if createdDate < before {
+			delete(b.delivered, id)
+		}
+	}
+}
+
+// publishEvent store event and notify every instance in the same statement
+func publishEvent(topic string, orderId int64, providerId int64, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Println("Marshal bus event failed", err)
+		return
+	}
+
+	var id int64
+	err = db.QueryRow(`WITH event AS (
+			INSERT INTO busevent(topic, order_id, provider_id, data, created_date, webhook_date)
+			VALUES($1, $2, $3, $4, $5, 0) RETURNING id)
+		SELECT id FROM event, pg_notify($6, event.id::text)`, topic, orderId, providerId,
+		string(payload), time.Now().Unix(), eventBusChannel).Scan(&id)
+
+	if err != nil {
+		log.Println("Publish bus event failed", err)
+	}
+}
+
+func deliverEventById(id int64) {
+	var event BusEvent
+	if err := dbmap.SelectOne(&event, `SELECT * FROM busevent WHERE id=$1`, id); err != nil {
+		log.Println("Select bus event failed", id, err)
+		return
+	}
+
+	eventBus.Deliver(event)
+}
+
+// backfillEvents deliver events created since, skipping already delivered
+func backfillEvents(since int64) {
+	var events []BusEvent
+	_, err := dbmap.Select(&events, `SELECT * FROM busevent WHERE created_date >= $1 ORDER BY id ASC`,
+		since)
+
+	if err != nil {
+		log.Println("Backfill bus event failed", err)
+		return
+	}
+
+	for _, event := range events {
+		eventBus.Deliver(event)
+	}
+}
+
+// runEventBusListener consume pg_notify of all instances
+func runEventBusListener() {
+	var disconnectedDate int64
+
+	listener := pq.NewListener(os.Getenv("DATABASE_URL"), 10*time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if event == pq.ListenerEventDisconnected {
+				atomic.CompareAndSwapInt64(&disconnectedDate, 0, time.Now().Unix())
+			}
+			if err != nil {
+				log.Println("Event bus listener", err)
+			}
+		})
+
+	checkErr(listener.Listen(eventBusChannel), "Listen event bus failed")
+
+	cleanup := time.NewTicker(10 * time.Minute)
+
+	for {
+		select {
+		case notification := <-listener.Notify:
+			if notification == nil {
+				// reconnected, notifications while disconnected are lost
+				since := atomic.SwapInt64(&disconnectedDate, 0)
+				if since == 0 {
+					since = time.Now().Unix()
+				}
+				backfillEvents(since - getEnvInt64("EVENT_BACKFILL_MARGIN", 5))
+				continue
+			}
+
+			id, err := strconv.ParseInt(notification.Extra, 10, 64)
+			if err == nil {
+				deliverEventById(id)
+			}
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		case <-cleanup.C:
+			now := time.Now().Unix()
+			eventBus.Prune(now - 3600)
+			db.Exec(`DELETE FROM busevent WHERE created_date < $1`,
+				now-getEnvInt64("EVENT_RETENTION_DAYS", 7)*24*60*60)
+		}
+	}
+}
+
+var webhookMaxAttempts = getEnvInt64("WEBHOOK_MAX_ATTEMPTS", 10)
+
+// webhookWake wake up the webhook worker when an event is published, never blocks
+var webhookWake = make(chan struct{}, 1)
+
+func wakeWebhookWorker(event BusEvent) {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// webhookBackoff delay before attempt, doubling from 30 seconds up to one hour
+func webhookBackoff(attempts int64) int64 {
+	delay := int64(30)
+	for i := int64(1); i < attempts && delay < 3600; i++ {
+		delay *= 2
+	}
+	if delay > 3600 {
+		delay = 3600
+	}
+	return delay
+}
+
+// claimWebhookEvents lease due events to this instance, other instances skip them until the
+// lease ends, lease is longer than the post timeout
+func claimWebhookEvents(now int64) ([]BusEvent, error) {
+	var events []BusEvent
+	_, err := dbmap.Select(&events, `UPDATE busevent SET webhook_attempts=webhook_attempts+1,
+			webhook_next_date=$1
+		WHERE id IN (SELECT id FROM busevent
+			WHERE webhook_date=0 AND webhook_next_date <= $2 AND webhook_attempts < $3
+			ORDER BY id ASC LIMIT 20 FOR UPDATE SKIP LOCKED)
+		RETURNING *`, now+60, now, webhookMaxAttempts)
+
+	return events, err
+}
+
+// deliverWebhook post event to EVENT_WEBHOOK_URL, only a 2xx response marks it delivered
+func deliverWebhook(webhookUrl string, event BusEvent) {
+	body, _ := json.Marshal(event)
+	client := http.Client{Timeout: 10 * time.Second}
+
+	response, err := client.Post(webhookUrl, "application/json", bytes.NewReader(body))
+	if err == nil {
+		response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode >= 300 {
+			err = errors.New(response.Status)
+		}
+	}
+
+	now := time.Now().Unix()
+	if err != nil {
+		log.Println("Deliver webhook failed", event.Id, event.WebhookAttempts, err)
+		db.Exec(`UPDATE busevent SET webhook_next_date=$1 WHERE id=$2`,
+			now+webhookBackoff(event.WebhookAttempts), event.Id)
+		return
+	}
+
+	db.Exec(`UPDATE busevent SET webhook_date=$1 WHERE id=$2`, now, event.Id)
+}
+
+// runWebhookWorker deliver bus events to the webhook outside of the event bus listener,
+// a slow webhook never delays local subscribers
+func runWebhookWorker() {
+	webhookUrl := os.Getenv("EVENT_WEBHOOK_URL")
+	if webhookUrl == "" {
+		return
+	}
+
+	ticker := time.NewTicker(15 * time.Second)
+	for {
+		select {
+		case <-webhookWake:
+		case <-ticker.C:
+		}
+
+		for {
+			events, err := claimWebhookEvents(time.Now().Unix())
+			if err != nil {
+				log.Println("Claim webhook events failed", err)
+				break
+			}
+
+			for _, event := range events {
+				deliverWebhook(webhookUrl, event)
+			}
+
+			if len(events) == 0 {
+				break
+			}
+		}
+	}
+}
+
+// broadcastOrderEvent wake up order streams connected to this instance
+func broadcastOrderEvent(event BusEvent) {
+	var orderEvent OrderEvent
+	if err := json.Unmarshal([]byte(event.Data), &orderEvent); err == nil {
+		orderEventHub.Broadcast(orderEvent)
+	}
+}
+
+// registerEventSubscribers local subscribers of the event bus
+func registerEventSubscribers() {
+	eventBus.Subscribe(topicOrderCreated, broadcastOrderEvent)
+	eventBus.Subscribe(topicOrderStatus, broadcastOrderEvent)
+	eventBus.Subscribe(topicTrackingUpdated, broadcastOrderEvent)
+	eventBus.Subscribe(topicOrderMessage, broadcastOrderEvent)
+	eventBus.Subscribe(topicPaymentStatus, broadcastOrderEvent)
+	eventBus.Subscribe(topicOrderStatus, refreshProviderStatsEvent)
+	eventBus.Subscribe(topicProviderOnline, refreshProviderStatsEvent)
+	eventBus.Subscribe(topicProviderOffline, refreshProviderStatsEvent)
+	eventBus.Subscribe(topicAll, wakeWebhookWorker)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int64
+		delay    int64
+	}{
+		{0, 30},
+		{1, 30},
+		{2, 60},
+		{3, 120},
+		{7, 1920},
+		{8, 3600},
+		{20, 3600},
+	}
+
+	for _, test := range tests {
+		if delay := webhookBackoff(test.attempts); delay != test.delay {
+			t.Errorf("webhookBackoff(%d) = %d, want %d", test.attempts, delay, test.delay)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= LEDGER
+
+/**
+Ledger transaction, group of balanced entries, append only
+Id
+Kind		order, payment, payout, payout_paid, refund, cancel_fee, referral
+OrderId
+Reference	unique, the same business event is never posted twice
+Description
+CreatedDate
+*/
+type LedgerTransaction struct {
+	Id          int64  `db:"id" json:"id"`
+	Kind        string `db:"kind" json:"kind"`
+	OrderId     int64  `db:"order_id" json:"order_id"`
+	Reference   string `db:"reference" json:"reference"`
+	Description string `db:"description" json:"description"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Ledger entry, one side of a ledger transaction
+Id
+TransactionId
+Account
+ProviderId	owner of provider_balance and provider_cash entries
+UserId		owner of customer_wallet entries
+Debit
+Credit
+CreatedDate
+*/
+type LedgerEntry struct {
+	Id            int64  `db:"id" json:"id"`
+	TransactionId int64  `db:"transaction_id" json:"transaction_id"`
+	Account       string `db:"account" json:"account"`
+	ProviderId    int64  `db:"provider_id" json:"provider_id"`
+	UserId        int64  `db:"user_id" json:"user_id"`
+	Debit         int64  `db:"debit" json:"debit"`
+	Credit        int64  `db:"credit" json:"credit"`
+	CreatedDate   int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Commission rule per kategori jasa
+Id
+JasaId
+Rate		basis points of order total, 1000 = 10%
+*/
+type CommissionRule struct {
+	Id     int64 `db:"id" json:"id"`
+	JasaId int64 `db:"jasa_id" json:"jasa_id"`
+	Rate   int64 `db:"rate" json:"rate"`
+}
+
+type LedgerLine struct {
+	Account    string
+	ProviderId int64
+	UserId     int64
+	Debit      int64
+	Credit     int64
+}
+
+type StatementLine struct {
+	Id          int64  `db:"id" json:"id"`
+	Kind        string `db:"kind" json:"kind"`
+	OrderId     int64  `db:"order_id" json:"order_id"`
+	Description string `db:"description" json:"description"`
+	Debit       int64  `db:"debit" json:"debit"`
+	Credit      int64  `db:"credit" json:"credit"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+type LedgerOrder struct {
+	Id            int64 `db:"id"`
+	ProviderId    int64 `db:"provider_id"`
+	JasaId        int64 `db:"jasa_id"`
+	PaymentMethod int64 `db:"payment_method"`
+}
+
+const (
+	// money received by the payment gateway for the platform
+	ledgerGatewayClearing = "gateway_clearing"
+	// cash collected by provider from customer
+	ledgerProviderCash = "provider_cash"
+	// platform owes provider when credit, provider owes platform when debit
+	ledgerProviderBalance   = "provider_balance"
+	ledgerCommissionRevenue = "commission_revenue"
+	// payout generated but not transferred yet
+	ledgerPayoutClearing = "payout_clearing"
+	ledgerPlatformBank   = "platform_bank"
+	// in-app balance of customer, credited by refunds of cash orders
+	ledgerCustomerWallet = "customer_wallet"
+	// voucher discount given to customer
+	ledgerVoucherExpense = "voucher_expense"
+	// referral reward given to referrer and referee
+	ledgerReferralExpense = "referral_expense"
+	// loyalty points redeemed as discount
+	ledgerLoyaltyExpense = "loyalty_expense"
+	// captured payment until a complete order takes it, debit while a supplement is unpaid
+	ledgerCustomerClearing = "customer_clearing"
+	// cancellation fee kept from the customer payment or charged to the provider
+	ledgerCancelFeeRevenue = "cancel_fee_revenue"
+)
+
+var errLedgerPosted = errors.New("ledger transaction already posted")
+
+// postLedgerTransaction insert balanced entries, errLedgerPosted when reference exists
+func postLedgerTransaction(kind string, orderId int64, reference string, description string,
+	lines []LedgerLine) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	transactionId, err := postLedgerTransactionTx(tx, kind, orderId, reference, description, lines)
+	if err != nil {
+		return 0, err
+	}
+
+	return transactionId, tx.Commit()
+}
+
+// checkLedgerLines lines of a transaction are at least two, never negative, and balanced
+func checkLedgerLines(reference string, lines []LedgerLine) error {
+	var debit, credit int64
+	for _, line := range lines {
+		if line.Debit < 0 || line.Credit < 0 {
+			return errors.New("negative ledger amount")
+		}
+		debit += line.Debit
+		credit += line.Credit
+	}
+
+	if len(lines) < 2 || debit != credit {
+		return fmt.Errorf("unbalanced ledger transaction %s debit %d credit %d", reference, debit, credit)
+	}
+
+	return nil
+}
+
+// postLedgerTransactionTx same as postLedgerTransaction inside a transaction of the caller
+func postLedgerTransactionTx(tx *sql.Tx, kind string, orderId int64, reference string,
+	description string, lines []LedgerLine) (int64, error) {
+	if err := checkLedgerLines(reference, lines); err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+
+	var transactionId int64
+	err := tx.QueryRow(`INSERT INTO ledgertransaction(kind, order_id, reference, description, created_date)
+		VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (reference) DO NOTHING RETURNING id`, kind, orderId, reference, description,
+		now).Scan(&transactionId)
+
+	if err == sql.ErrNoRows {
+		return 0, errLedgerPosted
+	} else if err != nil {
+		return 0, err
+	}
+
+	for _, line := range lines {
+		if line.Debit == 0 && line.Credit == 0 {
+			continue
+		}
+
+		if _, err := tx.Exec(`INSERT INTO ledgerentry(transaction_id, account, provider_id, user_id,
+			debit, credit, created_date)
+			VALUES($1, $2, $3, $4, $5, $6, $7)`, transactionId, line.Account, line.ProviderId,
+			line.UserId, line.Debit, line.Credit, now); err != nil {
+			return 0, err
+		}
+	}
+
+	return transactionId, nil
+}
+
+func getCommissionRate(jasaId int64) int64 {
+	var rule CommissionRule
+	if err := dbmap.SelectOne(&rule, `SELECT * FROM commissionrule WHERE jasa_id=$1`, jasaId); err != nil {
+		return getEnvInt64("COMMISSION_RATE", 1000)
+	}
+	return rule.Rate
+}
+
+// postOrderLedger post customer charge, commission and provider earning of complete order,
+// an order whose payment is not captured stays out of the ledger
+func postOrderLedger(orderId int64) error {
+	if status, err := getOrderStatus(orderId); err != nil || status != orderStatusComplete {
+		return errors.New("order is not complete")
+	}
+
+	if payment, err := getOrderPayment(orderId); err != nil ||
+		(payment.Status != paymentCaptured && payment.Status != paymentRefunded) {
+		return errors.New("order payment is not captured")
+	}
+
+	var order LedgerOrder
+	if err := dbmap.SelectOne(&order, `SELECT ov.id, ov.provider_id, pd.jasa_id, ov.payment_method
+		FROM ordervendor ov
+			JOIN providerdata pd ON pd.id = ov.provider_id
+		WHERE ov.id=$1`, orderId); err != nil {
+		return err
+	}
+
+	total, discount, err := getOrderCharge(orderId)
+	if err != nil || total == 0 {
+		return err
+	}
+
+	// commission and earning are based on full price, voucher discount is paid by the platform
+	commission := total * getCommissionRate(order.JasaId) / 10000
+	earning := total - commission
+	charged := total - discount
+
+	pointsDiscount, _ := dbmap.SelectInt(`SELECT points_discount FROM ordervendor WHERE id=$1`, orderId)
+	if pointsDiscount > discount {
+		pointsDiscount = discount
+	}
+
+	lines := []LedgerLine{
+		{Account: ledgerCommissionRevenue, Credit: commission},
+		{Account: ledgerProviderBalance, ProviderId: order.ProviderId, Credit: earning},
+		{Account: ledgerVoucherExpense, Debit: discount - pointsDiscount},
+		{Account: ledgerLoyaltyExpense, Debit: pointsDiscount},
+	}
+
+	if order.PaymentMethod == paymentMethodCash {
+		// provider keeps the cash, what is left on the balance is commission debt
+		lines = append(lines,
+			LedgerLine{Account: ledgerProviderCash, ProviderId: order.ProviderId, Debit: charged},
+			LedgerLine{Account: ledgerProviderBalance, ProviderId: order.ProviderId, Debit: charged},
+			LedgerLine{Account: ledgerProviderCash, ProviderId: order.ProviderId, Credit: charged})
+	} else {
+		// captured payments were posted to customer clearing when the gateway took them
+		lines = append(lines, LedgerLine{Account: ledgerCustomerClearing, Debit: charged})
+	}
+
+	_, err = postLedgerTransaction("order", orderId, "order:"+strconv.FormatInt(orderId, 10),
+		"Pesanan #"+strconv.FormatInt(orderId, 10), lines)
+	if err == errLedgerPosted {
+		return nil
+	}
+	return err
+}
+
+// postPaymentLedger post money the gateway captured for an order
+func postPaymentLedger(payment Payment) error {
+	_, err := postLedgerTransaction("payment", payment.OrderId,
+		"payment:"+strconv.FormatInt(payment.Id, 10),
+		"Pembayaran pesanan #"+strconv.FormatInt(payment.OrderId, 10), []LedgerLine{
+			{Account: ledgerGatewayClearing, Debit: payment.Amount},
+			{Account: ledgerCustomerClearing, Credit: payment.Amount},
+		})
+	if err == errLedgerPosted {
+		return nil
+	}
+	return err
+}
+
+// settleOrderPayment capture payment of complete order, the order is posted once it is paid
+func settleOrderPayment(orderId int64) {
+	if err := captureOrderPayment(orderId); err != nil {
+		log.Println("Capture payment failed", orderId, err)
+		return
+	}
+
+	if err := postOrderLedger(orderId); err != nil {
+		log.Println("Post order ledger failed", orderId, err)
+	}
+}
+
+// completeOrder settle payment, ledger and receipt of complete order, in this order
+func completeOrder(orderId int64) {
+	redeemOrderVoucher(orderId)
+	settleOrderPayment(orderId)
+
+	sendReceiptOnComplete(orderId)
+	rewardOrderReferrals(orderId)
+	earnOrderPoints(orderId)
+}
+
+// getProviderBalance positive when platform owes provider, negative for commission debt
+func getProviderBalance(providerId int64, before int64) int64 {
+	balance, _ := dbmap.SelectInt(`SELECT COALESCE(SUM(credit - debit), 0) FROM ledgerentry
+		WHERE account=$1 AND provider_id=$2 AND created_date < $3`, ledgerProviderBalance,
+		providerId, before)
+	return balance
+}
+
+// GetProviderBalance balance of provider from the ledger
+func GetProviderBalance(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	balance := getProviderBalance(providerId, time.Now().Unix()+1)
+
+	c.JSON(200, gin.H{"balance": balance, "commission_debt": balance < 0})
+}
+
+// GetProviderStatement ledger lines of provider balance, optional from and to unix date
+func GetProviderStatement(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	from, _ := strconv.ParseInt(c.Query("from"), 10, 64)
+	to, err := strconv.ParseInt(c.Query("to"), 10, 64)
+	if err != nil || to <= 0 {
+		to = time.Now().Unix() + 1
+	}
+
+	var lines []StatementLine
+	_, err = dbmap.Select(&lines, `SELECT le.id, lt.kind, lt.order_id, lt.description,
+			le.debit, le.credit, le.created_date
+		FROM ledgerentry le
+			JOIN ledgertransaction lt ON lt.id = le.transaction_id
+		WHERE le.account=$1 AND le.provider_id=$2 AND le.created_date >= $3 AND le.created_date < $4
+		ORDER BY le.id DESC`, ledgerProviderBalance, providerId, from, to)
+
+	if err == nil {
+		c.JSON(200, gin.H{
+			"data":            lines,
+			"opening_balance": getProviderBalance(providerId, from),
+			"closing_balance": getProviderBalance(providerId, to),
+		})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// PostCommissionRule set commission rate of a kategori jasa
+func PostCommissionRule(c *gin.Context) {
+	var rule CommissionRule
+	c.Bind(&rule)
+
+	if rule.JasaId <= 0 || rule.Rate < 0 || rule.Rate > 10000 {
+		c.JSON(400, gin.H{"error": "Komisi tidak valid"})
+		return
+	}
+
+	if err := db.QueryRow(`INSERT INTO commissionrule(jasa_id, rate) VALUES($1, $2)
+		ON CONFLICT (jasa_id) DO UPDATE SET rate=$2
+		RETURNING id`, rule.JasaId, rule.Rate).Scan(&rule.Id); err == nil {
+		c.JSON(200, rule)
+	} else {
+		c.JSON(400, gin.H{"error": "insert failed"})
+	}
+}
+
+// GetCommissionRules list commission rules and the default rate
+func GetCommissionRules(c *gin.Context) {
+	var rules []CommissionRule
+	_, err := dbmap.Select(&rules, `SELECT * FROM commissionrule ORDER BY jasa_id ASC`)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": rules, "default": getEnvInt64("COMMISSION_RATE", 1000)})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
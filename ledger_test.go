@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckLedgerLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []LedgerLine
+		valid bool
+	}{
+		{"balanced", []LedgerLine{
+			{Account: ledgerCustomerClearing, Debit: 100000},
+			{Account: ledgerCommissionRevenue, Credit: 10000},
+			{Account: ledgerProviderBalance, ProviderId: 1, Credit: 90000},
+		}, true},
+		{"zero line is allowed", []LedgerLine{
+			{Account: ledgerCustomerClearing, Debit: 50000},
+			{Account: ledgerCommissionRevenue},
+			{Account: ledgerProviderBalance, ProviderId: 1, Credit: 50000},
+		}, true},
+		{"unbalanced", []LedgerLine{
+			{Account: ledgerCustomerClearing, Debit: 100000},
+			{Account: ledgerProviderBalance, ProviderId: 1, Credit: 90000},
+		}, false},
+		{"single line", []LedgerLine{
+			{Account: ledgerCustomerClearing},
+		}, false},
+		{"no lines", nil, false},
+		{"negative balanced", []LedgerLine{
+			{Account: ledgerCustomerClearing, Debit: -5000},
+			{Account: ledgerProviderBalance, ProviderId: 1, Credit: -5000},
+		}, false},
+	}
+
+	for _, test := range tests {
+		if err := checkLedgerLines("test", test.lines); (err == nil) != test.valid {
+			t.Errorf("%s: error %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
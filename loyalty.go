@@ -0,0 +1,476 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= LOYALTY POINTS
+
+/**
+Loyalty point mutation of a customer, balance is the sum of points
+Id
+UserId
+OrderId
+Kind		earn, redeem, release, expire, clawback
+Points		positive for earn and release, negative otherwise
+Remaining	earn only, points of the lot not redeemed or expired yet
+ExpiryDate	earn only
+Reference	unique, the same event never changes points twice
+CreatedDate
+
+Earned lots are redeemed oldest expiry first, balance always equals the sum of remaining
+*/
+type LoyaltyPoint struct {
+	Id          int64  `db:"id" json:"id"`
+	UserId      int64  `db:"user_id" json:"-"`
+	OrderId     int64  `db:"order_id" json:"order_id"`
+	Kind        string `db:"kind" json:"kind"`
+	Points      int64  `db:"points" json:"points"`
+	Remaining   int64  `db:"remaining" json:"remaining"`
+	ExpiryDate  int64  `db:"expiry_date" json:"expiry_date"`
+	Reference   string `db:"reference" json:"-"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Loyalty point use, earned lot consumed by a redeem or clawback
+Id
+PointId		redeem or clawback row
+LotId		earn row
+Points
+*/
+type LoyaltyPointUse struct {
+	Id      int64 `db:"id" json:"id"`
+	PointId int64 `db:"point_id" json:"point_id"`
+	LotId   int64 `db:"lot_id" json:"lot_id"`
+	Points  int64 `db:"points" json:"points"`
+}
+
+/**
+Loyalty multiplier per kategori jasa
+Id
+JasaId
+Multiplier	percent of base points, 100 = normal, 200 = double points
+*/
+type LoyaltyMultiplier struct {
+	Id         int64 `db:"id" json:"id"`
+	JasaId     int64 `db:"jasa_id" json:"jasa_id"`
+	Multiplier int64 `db:"multiplier" json:"multiplier"`
+}
+
+type LoyaltyOrder struct {
+	UserId int64 `db:"user_id"`
+	JasaId int64 `db:"jasa_id"`
+}
+
+type LoyaltyLot struct {
+	Id        int64 `db:"id"`
+	Remaining int64 `db:"remaining"`
+}
+
+const (
+	loyaltyEarn     = "earn"
+	loyaltyRedeem   = "redeem"
+	loyaltyRelease  = "release"
+	loyaltyExpire   = "expire"
+	loyaltyClawback = "clawback"
+)
+
+var (
+	// rupiah of order total per point earned
+	loyaltyEarnUnit = getEnvInt64("LOYALTY_EARN_UNIT", 10000)
+	// rupiah of discount per point redeemed
+	loyaltyPointValue  = getEnvInt64("LOYALTY_POINT_VALUE", 100)
+	loyaltyExpiryDays  = getEnvInt64("LOYALTY_EXPIRY_DAYS", 365)
+	errLoyaltyNoPoints = errors.New("Poin tidak cukup")
+)
+
+func getLoyaltyMultiplier(jasaId int64) int64 {
+	var rule LoyaltyMultiplier
+	if err := dbmap.SelectOne(&rule, `SELECT * FROM loyaltymultiplier WHERE jasa_id=$1`, jasaId); err != nil {
+		return 100
+	}
+	return rule.Multiplier
+}
+
+// getLoyaltyBalance points customer can redeem now
+func getLoyaltyBalance(userId int64) int64 {
+	balance, _ := dbmap.SelectInt(`SELECT COALESCE(SUM(remaining), 0) FROM loyaltypoint
+		WHERE user_id=$1 AND kind=$2 AND remaining > 0 AND expiry_date > $3`, userId, loyaltyEarn,
+		time.Now().Unix())
+	return balance
+}
+
+// lockLoyaltyPoints serialize point changes of a customer until the transaction ends
+func lockLoyaltyPoints(tx *sql.Tx, userId int64) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(44001, $1)`, userId)
+	return err
+}
+
+// consumeLoyaltyLots take up to points from lots which expire first, returns points taken
+func consumeLoyaltyLots(tx *sql.Tx, userId int64, kind string, orderId int64, reference string,
+	points int64) (int64, error) {
+	now := time.Now().Unix()
+
+	rows, err := tx.Query(`SELECT id, remaining FROM loyaltypoint
+		WHERE user_id=$1 AND kind=$2 AND remaining > 0 AND expiry_date > $3
+		ORDER BY expiry_date ASC, id ASC`, userId, loyaltyEarn, now)
+	if err != nil {
+		return 0, err
+	}
+
+	var lots []LoyaltyLot
+	for rows.Next() {
+		var lot LoyaltyLot
+		if err := rows.Scan(&lot.Id, &lot.Remaining); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		lots = append(lots, lot)
+	}
+	rows.Close()
+
+	var uses []LoyaltyPointUse
+	var taken int64
+	for _, lot := range lots {
+		if taken == points {
+			break
+		}
+
+		use := lot.Remaining
+		if use > points-taken {
+			use = points - taken
+		}
+
+		if _, err := tx.Exec(`UPDATE loyaltypoint SET remaining=remaining - $1 WHERE id=$2`,
+			use, lot.Id); err != nil {
+			return 0, err
+		}
+
+		uses = append(uses, LoyaltyPointUse{LotId: lot.Id, Points: use})
+		taken += use
+	}
+
+	if taken == 0 {
+		return 0, nil
+	}
+
+	var pointId int64
+	if err := tx.QueryRow(`INSERT INTO loyaltypoint(user_id, order_id, kind, points, remaining,
+		expiry_date, reference, created_date) VALUES($1, $2, $3, $4, 0, 0, $5, $6) RETURNING id`,
+		userId, orderId, kind, -taken, reference, now).Scan(&pointId); err != nil {
+		return 0, err
+	}
+
+	for _, use := range uses {
+		if _, err := tx.Exec(`INSERT INTO loyaltypointuse(point_id, lot_id, points) VALUES($1, $2, $3)`,
+			pointId, use.LotId, use.Points); err != nil {
+			return 0, err
+		}
+	}
+
+	return taken, nil
+}
+
+// checkLoyaltyPoints points to redeem must be available and worth no more than amount due
+func checkLoyaltyPoints(userId int64, points int64, due int64) error {
+	if points == 0 {
+		return nil
+	}
+
+	if points < 0 || points*loyaltyPointValue > due {
+		return errors.New("Jumlah poin tidak valid")
+	}
+
+	if getLoyaltyBalance(userId) < points {
+		return errLoyaltyNoPoints
+	}
+
+	return nil
+}
+
+// redeemLoyaltyPoints spend points as discount of a new order, returns points and discount
+func redeemLoyaltyPoints(userId int64, orderId int64, points int64) (int64, int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockLoyaltyPoints(tx, userId); err != nil {
+		return 0, 0, err
+	}
+
+	taken, err := consumeLoyaltyLots(tx, userId, loyaltyRedeem, orderId,
+		"redeem:"+strconv.FormatInt(orderId, 10), points)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if taken < points {
+		return 0, 0, errLoyaltyNoPoints
+	}
+
+	discount := taken * loyaltyPointValue
+	if _, err := tx.Exec(`UPDATE ordervendor SET points_used=$1, points_discount=$2 WHERE id=$3`,
+		taken, discount, orderId); err != nil {
+		return 0, 0, err
+	}
+
+	return taken, discount, tx.Commit()
+}
+
+// releaseOrderPoints give back points redeemed for canceled order to the same lots
+func releaseOrderPoints(orderId int64) {
+	var redeem LoyaltyPoint
+	if err := dbmap.SelectOne(&redeem, `SELECT * FROM loyaltypoint WHERE reference=$1`,
+		"redeem:"+strconv.FormatInt(orderId, 10)); err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if err := lockLoyaltyPoints(tx, redeem.UserId); err != nil {
+		return
+	}
+
+	result, err := tx.Exec(`INSERT INTO loyaltypoint(user_id, order_id, kind, points, remaining,
+		expiry_date, reference, created_date) VALUES($1, $2, $3, $4, 0, 0, $5, $6)
+		ON CONFLICT (reference) DO NOTHING`, redeem.UserId, orderId, loyaltyRelease, -redeem.Points,
+		"release:"+strconv.FormatInt(orderId, 10), time.Now().Unix())
+	if err != nil {
+		log.Println("Release points failed", orderId, err)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return
+	}
+
+	// lot which expired meanwhile is expired again by the worker
+	if _, err := tx.Exec(`UPDATE loyaltypoint lp SET remaining = lp.remaining + lpu.points
+		FROM loyaltypointuse lpu WHERE lpu.point_id=$1 AND lp.id = lpu.lot_id`, redeem.Id); err != nil {
+		log.Println("Release points failed", orderId, err)
+		return
+	}
+
+	tx.Commit()
+}
+
+// earnOrderPoints credit points of complete order, proportional to line items total
+func earnOrderPoints(orderId int64) {
+	var order LoyaltyOrder
+	if err := dbmap.SelectOne(&order, `SELECT ov.user_id, pd.jasa_id
+		FROM ordervendor ov
+			JOIN providerdata pd ON pd.id = ov.provider_id
+		WHERE ov.id=$1`, orderId); err != nil {
+		return
+	}
+
+	total, err := getOrderTotal(orderId)
+	if err != nil || loyaltyEarnUnit <= 0 {
+		return
+	}
+
+	// multiplier first, a 150% order of one unit still earns the extra half point when it adds up
+	points := total * getLoyaltyMultiplier(order.JasaId) / 100 / loyaltyEarnUnit
+	if points <= 0 {
+		return
+	}
+
+	now := time.Now()
+	_, err = db.Exec(`INSERT INTO loyaltypoint(user_id, order_id, kind, points, remaining,
+		expiry_date, reference, created_date) VALUES($1, $2, $3, $4, $4, $5, $6, $7)
+		ON CONFLICT (reference) DO NOTHING`, order.UserId, orderId, loyaltyEarn, points,
+		now.AddDate(0, 0, int(loyaltyExpiryDays)).Unix(), "earn:"+strconv.FormatInt(orderId, 10),
+		now.Unix())
+	if err != nil {
+		log.Println("Earn points failed", orderId, err)
+	}
+}
+
+// clawbackRefundPoints take back points earned by the refunded part of an order,
+// limited to points customer still has
+func clawbackRefundPoints(refund Refund) {
+	// adjustment refund returns an overpayment, points were earned on the order total only
+	if refund.CancelId == 0 && refund.DisputeId == 0 {
+		return
+	}
+
+	var earn LoyaltyPoint
+	if err := dbmap.SelectOne(&earn, `SELECT * FROM loyaltypoint WHERE reference=$1`,
+		"earn:"+strconv.FormatInt(refund.OrderId, 10)); err != nil {
+		return
+	}
+
+	due, err := getOrderAmountDue(refund.OrderId)
+	if err != nil || due <= 0 {
+		return
+	}
+
+	points := earn.Points * refund.Amount / due
+	if points > earn.Points {
+		points = earn.Points
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if err := lockLoyaltyPoints(tx, earn.UserId); err != nil {
+		return
+	}
+
+	var clawed int64
+	if err := tx.QueryRow(`SELECT COALESCE(-SUM(points), 0) FROM loyaltypoint
+		WHERE order_id=$1 AND kind=$2`, refund.OrderId, loyaltyClawback).Scan(&clawed); err != nil {
+		return
+	}
+
+	if points > earn.Points-clawed {
+		points = earn.Points - clawed
+	}
+
+	if points <= 0 {
+		return
+	}
+
+	if _, err := consumeLoyaltyLots(tx, earn.UserId, loyaltyClawback, refund.OrderId,
+		"clawback:"+strconv.FormatInt(refund.Id, 10), points); err != nil {
+		log.Println("Clawback points failed", refund.Id, err)
+		return
+	}
+
+	tx.Commit()
+}
+
+// expireLoyaltyPoints remaining points of expired lots
+func expireLoyaltyPoints() {
+	var lots []LoyaltyPoint
+	_, err := dbmap.Select(&lots, `SELECT * FROM loyaltypoint
+		WHERE kind=$1 AND remaining > 0 AND expiry_date <= $2 ORDER BY id ASC LIMIT 500`,
+		loyaltyEarn, time.Now().Unix())
+	if err != nil {
+		log.Println("Select expired points failed", err)
+		return
+	}
+
+	for _, lot := range lots {
+		if err := expireLoyaltyLot(lot); err != nil {
+			log.Println("Expire points failed", lot.Id, err)
+		}
+	}
+}
+
+// expireLoyaltyLot a lot expired before may expire again after points are released to it
+func expireLoyaltyLot(lot LoyaltyPoint) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockLoyaltyPoints(tx, lot.UserId); err != nil {
+		return err
+	}
+
+	var remaining int64
+	if err := tx.QueryRow(`SELECT remaining FROM loyaltypoint WHERE id=$1`, lot.Id).Scan(&remaining); err != nil {
+		return err
+	}
+
+	if remaining <= 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+
+	if _, err := tx.Exec(`UPDATE loyaltypoint SET remaining=0 WHERE id=$1`, lot.Id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO loyaltypoint(user_id, order_id, kind, points, remaining,
+		expiry_date, reference, created_date) VALUES($1, $2, $3, $4, 0, 0, $5, $6)`,
+		lot.UserId, lot.OrderId, loyaltyExpire, -remaining,
+		"expire:"+strconv.FormatInt(lot.Id, 10)+":"+strconv.FormatInt(now, 10), now); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// runLoyaltyExpiryWorker expire points of lots past their expiry date
+func runLoyaltyExpiryWorker() {
+	for range time.Tick(time.Hour) {
+		runLocked(workerLockLoyaltyExpiry, expireLoyaltyPoints)
+	}
+}
+
+// GetUserPoints balance and history of loyalty points
+func GetUserPoints(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	var history []LoyaltyPoint
+	_, err := dbmap.Select(&history, `SELECT * FROM loyaltypoint WHERE user_id=$1 ORDER BY id DESC`,
+		userId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	var expiring LoyaltyPoint
+	dbmap.SelectOne(&expiring, `SELECT * FROM loyaltypoint
+		WHERE user_id=$1 AND kind=$2 AND remaining > 0 AND expiry_date > $3
+		ORDER BY expiry_date ASC, id ASC LIMIT 1`, userId, loyaltyEarn, time.Now().Unix())
+
+	c.JSON(200, gin.H{
+		"balance":         getLoyaltyBalance(userId),
+		"point_value":     loyaltyPointValue,
+		"next_expiry":     expiring.ExpiryDate,
+		"expiring_points": expiring.Remaining,
+		"data":            history,
+	})
+}
+
+// PostLoyaltyMultiplier admin set points multiplier of kategori jasa
+func PostLoyaltyMultiplier(c *gin.Context) {
+	var rule LoyaltyMultiplier
+	c.Bind(&rule)
+
+	if rule.JasaId <= 0 || rule.Multiplier < 0 {
+		c.JSON(400, gin.H{"error": "Multiplier tidak valid"})
+		return
+	}
+
+	if err := db.QueryRow(`INSERT INTO loyaltymultiplier(jasa_id, multiplier) VALUES($1, $2)
+		ON CONFLICT (jasa_id) DO UPDATE SET multiplier=$2
+		RETURNING id`, rule.JasaId, rule.Multiplier).Scan(&rule.Id); err == nil {
+		c.JSON(200, rule)
+	} else {
+		c.JSON(400, gin.H{"error": "insert failed"})
+	}
+}
+
+// GetLoyaltyMultipliers list points multipliers, kategori jasa without rule earns 100
+func GetLoyaltyMultipliers(c *gin.Context) {
+	var rules []LoyaltyMultiplier
+	_, err := dbmap.Select(&rules, `SELECT * FROM loyaltymultiplier ORDER BY jasa_id ASC`)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": rules, "earn_unit": loyaltyEarnUnit, "point_value": loyaltyPointValue})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
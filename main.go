@@ -35,8 +35,17 @@ const (
 	DB_NAME            = "panggilin_core_data"
 )
 
+/* Who canceled an order, stored in ordercancel.canceled_by */
+const (
+	canceledByUser     = 1
+	canceledByProvider = 2
+	canceledBySystem   = 3
+)
+
 var db = initDb()
-var dbmap = initDbmap()
+
+// dbmap created in main, tests of pure functions run without a database
+var dbmap *gorp.DbMap
 
 func initDb() *sql.DB {
 
@@ -113,6 +122,181 @@ func initDbmap() *gorp.DbMap {
 	dbmapInit.AddTableWithName(Promo{}, "promo").SetKeys(true, "Id")
 	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
 
+	dbmapInit.AddTableWithName(OrderExpiryRule{}, "orderexpiryrule").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(DispatchRequest{}, "dispatchrequest").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(DispatchOffer{}, "dispatchoffer").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(OrderVendorTrackingPoint{}, "ordervendortrackingpoint").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	// breadcrumb trail is read per order in recorded order
+	_, errTrackingIndex := db.Exec(`CREATE INDEX IF NOT EXISTS ordervendortrackingpoint_order_idx
+		ON ordervendortrackingpoint(order_id, recorded_date)`)
+	checkErr(errTrackingIndex, "Create tracking point index failed")
+
+	dbmapInit.AddTableWithName(OrderEta{}, "ordereta").SetKeys(true, "Id").
+		ColMap("OrderId").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	// table created before the unique column may hold concurrent duplicates, keep the latest
+	_, errEtaDuplicate := db.Exec(`DELETE FROM ordereta a USING ordereta b
+		WHERE a.order_id = b.order_id AND a.id < b.id`)
+	checkErr(errEtaDuplicate, "Remove duplicate order eta failed")
+
+	_, errEtaIndex := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS ordereta_order_idx ON ordereta(order_id)`)
+	checkErr(errEtaIndex, "Create order eta index failed")
+
+	dbmapInit.AddTableWithName(OrderEvent{}, "orderevent").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	// replay reads events of an order after the last event id
+	_, errEventIndex := db.Exec(`CREATE INDEX IF NOT EXISTS orderevent_order_idx ON orderevent(order_id, id)`)
+	checkErr(errEventIndex, "Create order event index failed")
+
+	dbmapInit.AddTableWithName(BusEvent{}, "busevent").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	// webhook worker claims undelivered events by next attempt date
+	_, errWebhookIndex := db.Exec(`CREATE INDEX IF NOT EXISTS busevent_webhook_idx
+		ON busevent(webhook_next_date) WHERE webhook_date = 0`)
+	checkErr(errWebhookIndex, "Create bus event webhook index failed")
+
+	dbmapInit.AddTableWithName(OrderMessage{}, "ordermessage").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(OrderAmendment{}, "orderamendment").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(OrderReceipt{}, "orderreceipt").SetKeys(true, "Id").
+		ColMap("OrderId").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(ReceiptSequence{}, "receiptsequence").SetKeys(false, "Period")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(CancelReason{}, "cancelreason").SetKeys(true, "Id").
+		ColMap("Code").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(CancelPolicy{}, "cancelpolicy").SetKeys(true, "Id").
+		ColMap("JasaId").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(OrderDispute{}, "orderdispute").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(DisputePhoto{}, "disputephoto").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(DisputeLog{}, "disputelog").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(Payment{}, "payment").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(PaymentLog{}, "paymentlog").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(LedgerTransaction{}, "ledgertransaction").SetKeys(true, "Id").
+		ColMap("Reference").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(LedgerEntry{}, "ledgerentry").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(CommissionRule{}, "commissionrule").SetKeys(true, "Id").
+		ColMap("JasaId").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(ProviderBankAccount{}, "providerbankaccount").SetKeys(true, "Id").
+		ColMap("ProviderId").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(PayoutBatch{}, "payoutbatch").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(Payout{}, "payout").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(Refund{}, "refund").SetKeys(true, "Id").
+		ColMap("IdempotencyKey").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(Voucher{}, "voucher").SetKeys(true, "Id").
+		ColMap("Code").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(VoucherEligibility{}, "vouchereligibility").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(VoucherUsage{}, "voucherusage").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(PromoCreative{}, "promocreative").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(PromoStat{}, "promostat").SetKeys(true, "Id").
+		SetUniqueTogether("promo_id", "creative_id", "day")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(PromoClick{}, "promoclick").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(ReferralCode{}, "referralcode").SetKeys(true, "Id").
+		SetUniqueTogether("owner_type", "owner_id").ColMap("Code").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(Referral{}, "referral").SetKeys(true, "Id").
+		SetUniqueTogether("referee_type", "referee_id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(LoyaltyPoint{}, "loyaltypoint").SetKeys(true, "Id").
+		ColMap("Reference").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(LoyaltyPointUse{}, "loyaltypointuse").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(LoyaltyMultiplier{}, "loyaltymultiplier").SetKeys(true, "Id").
+		ColMap("JasaId").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(RatingPhoto{}, "ratingphoto").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(RatingReport{}, "ratingreport").SetKeys(true, "Id").
+		SetUniqueTogether("rating_id", "reporter_type", "reporter_id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(ModerationWord{}, "moderationword").SetKeys(true, "Id").
+		ColMap("Word").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(ModerationLog{}, "moderationlog").SetKeys(true, "Id")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(ProviderStats{}, "provider_stats").SetKeys(false, "ProviderId")
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(CustomerRating{}, "customerrating").SetKeys(true, "Id").
+		ColMap("OrderId").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(CustomerBlock{}, "customerblock").SetKeys(true, "Id").
+		ColMap("UserId").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	dbmapInit.AddTableWithName(TravelFeeBand{}, "travelfeeband").SetKeys(true, "Id").
+		ColMap("MaxDistance").SetUnique(true)
+	checkErr(dbmapInit.CreateTablesIfNotExists(), "Create tables failed")
+
+	migrateSchema()
+
 	return dbmapInit
 }
 
@@ -123,6 +307,8 @@ func checkErr(err error, msg string) {
 }
 
 func main() {
+	dbmap = initDbmap()
+
 	r := gin.New()
 
 	r.Use(gin.Logger())
@@ -136,13 +322,30 @@ func main() {
 		v1.POST("/provider/signin", PostSignInProvider)
 		v1.POST("/jasa/create", PostCreateNewJasa)
 		v1.GET("/jasa/list", GetListJasa)
-		v1.POST("/promo/create", PostPromo)
+		v1.POST("/jasa/expiry", TokenAuthAdminMiddleware(), PostOrderExpiryRule)
+		v1.GET("/jasa/expiry", GetOrderExpiryRules)
+		v1.POST("/jasa/cancelpolicy", TokenAuthAdminMiddleware(), PostCancelPolicy)
+		v1.GET("/jasa/cancelpolicy", GetCancelPolicies)
+		v1.POST("/jasa/commission", TokenAuthAdminMiddleware(), PostCommissionRule)
+		v1.GET("/jasa/commission", GetCommissionRules)
+		v1.POST("/jasa/loyalty", TokenAuthAdminMiddleware(), PostLoyaltyMultiplier)
+		v1.GET("/jasa/loyalty", GetLoyaltyMultipliers)
+		v1.POST("/travelfee/band", TokenAuthAdminMiddleware(), PostTravelFeeBand)
+		v1.POST("/travelfee/band/delete", TokenAuthAdminMiddleware(), PostDeleteTravelFeeBand)
+		v1.GET("/travelfee/band", GetTravelFeeBands)
+		v1.GET("/cancel/reasons", GetCancelReasons)
+		v1.POST("/cancel/reason", TokenAuthAdminMiddleware(), PostCancelReason)
+		v1.GET("/dispute/categories", GetDisputeCategories)
+		v1.POST("/payment/webhook", PostPaymentWebhook)
+		v1.POST("/promo/create", TokenAuthAdminMiddleware(), PostPromo)
+		v1.POST("/voucher/create", TokenAuthAdminMiddleware(), PostVoucher)
 		v1.GET("/providers/new", GetNewProviders)
 		v1.GET("/providers/offline", GetOfflineProviders)
 		v1.GET("/providers/online", GetOnlineProviders)
 		v1.PUT("/provider/approved/:provider_id", ApprovedProvider)
 		v1.PUT("/provider/disapproved/:provider_id", DisapprovedProvider)
 		v1.GET("/provider/profile/:id", GetProvider)
+		v1.GET("/order/events/:order_id", GetOrderEvents)
 
 		v1.GET("/providers/near", TokenAuthUserMiddleware(), GetNearProviderForMap)
 		v1.POST("/providers/search", TokenAuthUserMiddleware(), GetProvidersByKeyword)
@@ -153,6 +356,7 @@ func main() {
 		v1.GET("/rating/get/:provider_id", TokenAuthUserMiddleware(), GetProviderRating)
 		v1.GET("/jobque/get/:provider_id", TokenAuthUserMiddleware(), GetJobQueProvider)
 		v1.PUT("/provider/rating/edit", TokenAuthUserMiddleware(), UpdateProviderRating)
+		v1.POST("/rating/report", TokenAuthUserMiddleware(), PostUserRatingReport)
 		v1.GET("/gallery/data/:provider_id", TokenAuthUserMiddleware(), GetListImageGallery)
 		v1.GET("/profile/data/:provider_id", TokenAuthUserMiddleware(), GetProfileProvider)
 		v1.POST("/order/new", TokenAuthUserMiddleware(), PostNewOrder)
@@ -164,6 +368,27 @@ func main() {
 		v1.POST("/user/order/cancel", TokenAuthUserMiddleware(), PostOrderCancel)
 		v1.POST("/user/cancel/order", TokenAuthUserMiddleware(), PostUserNewOrderJourney)
 		v1.GET("/user/promo", TokenAuthUserMiddleware(), GetUserPromo)
+		v1.POST("/user/promo/impression", TokenAuthUserMiddleware(), PostPromoImpression)
+		v1.POST("/user/promo/click", TokenAuthUserMiddleware(), PostPromoClick)
+		v1.POST("/order/dispatch", TokenAuthUserMiddleware(), PostDispatchOrder)
+		v1.GET("/order/dispatch/:order_id", TokenAuthUserMiddleware(), GetDispatchStatus)
+		v1.GET("/order/route/:order_id", TokenAuthUserMiddleware(), GetOrderRoute)
+		v1.POST("/order/message/send", TokenAuthUserMiddleware(), PostUserOrderMessage)
+		v1.GET("/order/message/list/:order_id", TokenAuthUserMiddleware(), GetUserOrderMessages)
+		v1.POST("/order/message/read", TokenAuthUserMiddleware(), PostUserOrderMessageRead)
+		v1.GET("/order/amendment/list/:order_id", TokenAuthUserMiddleware(), GetUserAmendments)
+		v1.POST("/order/amendment/approve", TokenAuthUserMiddleware(), PostApproveAmendment)
+		v1.POST("/order/amendment/reject", TokenAuthUserMiddleware(), PostRejectAmendment)
+		v1.GET("/order/receipt/:order_id", TokenAuthUserMiddleware(), GetUserOrderReceipt)
+		v1.POST("/order/receipt/email", TokenAuthUserMiddleware(), PostEmailOrderReceipt)
+		v1.POST("/order/dispute/open", TokenAuthUserMiddleware(), PostOpenDispute)
+		v1.GET("/order/payment/:order_id", TokenAuthUserMiddleware(), GetOrderPayment)
+		v1.POST("/order/payment/retry", TokenAuthUserMiddleware(), PostRetryOrderPayment)
+		v1.GET("/order/refund/list/:order_id", TokenAuthUserMiddleware(), GetOrderRefunds)
+		v1.GET("/user/wallet", TokenAuthUserMiddleware(), GetUserWallet)
+		v1.GET("/user/referral", TokenAuthUserMiddleware(), GetUserReferral)
+		v1.GET("/user/points", TokenAuthUserMiddleware(), GetUserPoints)
+		v1.POST("/voucher/validate", TokenAuthUserMiddleware(), PostValidateVoucher)
 
 		v1.POST("/provider/mylocation", TokenAuthProviderMiddleware(), PostMyLocationProvider)
 		v1.POST("/provider/price/add", TokenAuthProviderMiddleware(), PostAddProviderPriceList)
@@ -179,6 +404,9 @@ func main() {
 		v1.POST("/order/status", TokenAuthProviderMiddleware(), PostNewOrderJourney)
 		v1.PUT("/order/tracking", TokenAuthProviderMiddleware(), UpdateOrderTracking)
 		v1.GET("/rating/me", TokenAuthProviderMiddleware(), GetProviderRatingProvider)
+		v1.POST("/provider/rating/reply", TokenAuthProviderMiddleware(), PostProviderRatingReply)
+		v1.POST("/provider/rating/report", TokenAuthProviderMiddleware(), PostProviderRatingReport)
+		v1.POST("/provider/customer/rating", TokenAuthProviderMiddleware(), PostProviderCustomerRating)
 		v1.GET("/provider/quickinfo", TokenAuthProviderMiddleware(), GetProviderQuickInfo)
 		v1.GET("/provider/order/me", TokenAuthProviderMiddleware(), GetProviderOrder)
 		v1.GET("/provider/order/detail/:order_id", TokenAuthProviderMiddleware(), GetProviderOrderDetail)
@@ -191,8 +419,68 @@ func main() {
 		v1.PUT("/provider/inactive", TokenAuthProviderMiddleware(), InActiveProvider)
 		v1.PUT("/provider/active", TokenAuthProviderMiddleware(), ActiveProvider)
 		v1.DELETE("/provider/image/:image_id", TokenAuthProviderMiddleware(), DeleteProviderImageGallery)
-
-	}
+		v1.GET("/provider/dispatch/offers", TokenAuthProviderMiddleware(), GetProviderDispatchOffers)
+		v1.POST("/provider/dispatch/accept", TokenAuthProviderMiddleware(), PostAcceptDispatch)
+		v1.POST("/provider/dispatch/decline", TokenAuthProviderMiddleware(), PostDeclineDispatch)
+		v1.GET("/provider/order/route/:order_id", TokenAuthProviderMiddleware(), GetProviderOrderRoute)
+		v1.POST("/provider/order/message/send", TokenAuthProviderMiddleware(), PostProviderOrderMessage)
+		v1.GET("/provider/order/message/list/:order_id", TokenAuthProviderMiddleware(), GetProviderOrderMessages)
+		v1.POST("/provider/order/message/read", TokenAuthProviderMiddleware(), PostProviderOrderMessageRead)
+		v1.POST("/provider/order/amendment", TokenAuthProviderMiddleware(), PostProviderAmendment)
+		v1.GET("/provider/order/amendment/list/:order_id", TokenAuthProviderMiddleware(), GetProviderAmendments)
+		v1.GET("/provider/order/receipt/:order_id", TokenAuthProviderMiddleware(), GetProviderOrderReceipt)
+		v1.POST("/provider/order/dispute/respond", TokenAuthProviderMiddleware(), PostProviderDisputeResponse)
+		v1.GET("/provider/balance", TokenAuthProviderMiddleware(), GetProviderBalance)
+		v1.GET("/provider/statement", TokenAuthProviderMiddleware(), GetProviderStatement)
+		v1.POST("/provider/bank", TokenAuthProviderMiddleware(), PostProviderBankAccount)
+		v1.GET("/provider/bank", TokenAuthProviderMiddleware(), GetProviderBankAccount)
+		v1.GET("/provider/payouts", TokenAuthProviderMiddleware(), GetProviderPayouts)
+		v1.GET("/provider/referral", TokenAuthProviderMiddleware(), GetProviderReferral)
+
+		v1.GET("/admin/order/message/:order_id", TokenAuthAdminMiddleware(), GetAdminOrderMessages)
+		v1.GET("/admin/dispute/list", TokenAuthAdminMiddleware(), GetAdminDisputes)
+		v1.GET("/admin/dispute/detail/:dispute_id", TokenAuthAdminMiddleware(), GetAdminDisputeDetail)
+		v1.POST("/admin/dispute/review", TokenAuthAdminMiddleware(), PostAdminDisputeReview)
+		v1.POST("/admin/dispute/resolve", TokenAuthAdminMiddleware(), PostAdminDisputeResolve)
+		v1.GET("/admin/payout/list", TokenAuthAdminMiddleware(), GetPayoutBatches)
+		v1.POST("/admin/payout/generate", TokenAuthAdminMiddleware(), PostGeneratePayoutBatch)
+		v1.POST("/admin/payout/paid", TokenAuthAdminMiddleware(), PostPayoutBatchPaid)
+		v1.GET("/admin/payout/export/:batch_id", TokenAuthAdminMiddleware(), GetPayoutBatchExport)
+		v1.GET("/admin/refund/list", TokenAuthAdminMiddleware(), GetAdminRefunds)
+		v1.POST("/admin/refund/retry", TokenAuthAdminMiddleware(), PostAdminRetryRefund)
+		v1.GET("/admin/voucher/list", TokenAuthAdminMiddleware(), GetAdminVouchers)
+		v1.GET("/admin/promo/list", TokenAuthAdminMiddleware(), GetAdminPromos)
+		v1.GET("/admin/promo/detail/:promo_id", TokenAuthAdminMiddleware(), GetAdminPromo)
+		v1.POST("/admin/promo/update", TokenAuthAdminMiddleware(), PostUpdatePromo)
+		v1.POST("/admin/promo/deactivate", TokenAuthAdminMiddleware(), PostDeactivatePromo)
+		v1.POST("/admin/promo/delete", TokenAuthAdminMiddleware(), PostDeletePromo)
+		v1.POST("/admin/promo/creative", TokenAuthAdminMiddleware(), PostPromoCreative)
+		v1.GET("/admin/promo/creative/:promo_id", TokenAuthAdminMiddleware(), GetPromoCreatives)
+		v1.GET("/admin/promo/results/:promo_id", TokenAuthAdminMiddleware(), GetPromoResults)
+		v1.GET("/admin/rating/moderation", TokenAuthAdminMiddleware(), GetAdminModerationQueue)
+		v1.POST("/admin/rating/moderate", TokenAuthAdminMiddleware(), PostAdminModerateRating)
+		v1.GET("/admin/rating/log/:rating_id", TokenAuthAdminMiddleware(), GetAdminModerationLog)
+		v1.GET("/admin/moderation/word", TokenAuthAdminMiddleware(), GetModerationWords)
+		v1.POST("/admin/moderation/word", TokenAuthAdminMiddleware(), PostModerationWord)
+		v1.POST("/admin/moderation/word/delete", TokenAuthAdminMiddleware(), PostDeleteModerationWord)
+		v1.GET("/admin/stats/provider/:provider_id", TokenAuthAdminMiddleware(), GetProviderStats)
+		v1.POST("/admin/stats/rebuild", TokenAuthAdminMiddleware(), PostRebuildProviderStats)
+		v1.GET("/admin/customer/rating/:user_id", TokenAuthAdminMiddleware(), GetAdminCustomerRating)
+		v1.GET("/admin/customer/blocked", TokenAuthAdminMiddleware(), GetAdminBlockedCustomers)
+		v1.POST("/admin/customer/block", TokenAuthAdminMiddleware(), PostAdminBlockCustomer)
+		v1.POST("/admin/customer/unblock", TokenAuthAdminMiddleware(), PostAdminUnblockCustomer)
+
+	}
+
+	registerEventSubscribers()
+	go runEventBusListener()
+	go runWebhookWorker()
+
+	go runOrderExpiryWorker()
+	go runDispatchWorker()
+	go runTrackingRetentionWorker()
+	go runRefundWorker()
+	go runLoyaltyExpiryWorker()
 
 	r.Run(GetPort())
 
@@ -265,6 +553,22 @@ func TokenAuthUserMiddleware() gin.HandlerFunc {
 	}
 }
 
+// TokenAuthAdminMiddleware admin token is configured in ADMIN_AUTH_TOKEN
+func TokenAuthAdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenStr := getTokenFromHeader(c)
+		adminToken := os.Getenv("ADMIN_AUTH_TOKEN")
+
+		if tokenStr == "" || adminToken == "" || tokenStr != adminToken {
+			c.JSON(401, gin.H{"error": "Unauthorize request. Invalid auth token."})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
 func removeExpiredToken(tokenId int64) {
 	db.QueryRow(`DELETE FROM authtoken WHERE id=$1`, tokenId)
 }
@@ -277,6 +581,15 @@ func GetPort() string {
 	return ":" + port
 }
 
+// getEnvInt64 read integer config from environment, fallback to def
+func getEnvInt64(key string, def int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
 // =============================== STRUCT
 
 /**
@@ -405,6 +718,7 @@ JenisJasa
 Latitude
 Longitude
 Distance
+TravelFee	by distance band
 */
 type NearProviderForMap struct {
 	Id          int64   `db:"id" json:"id"`
@@ -419,6 +733,7 @@ type NearProviderForMap struct {
 	Rating      float32 `db:"rating" json:"rating"`
 	ProfilePict string  `db:"profile_pict" json:"profile_pict"`
 	Status      int8    `db:"status" json:"status"`
+	TravelFee   int64   `db:"-" json:"travel_fee"`
 }
 
 /**
@@ -458,14 +773,29 @@ Rating provider
 Id
 ProviderId
 UserId
-UserRating
+UserRating	1 - 5
+Review
+OrderId		rated order, one rating per order, 0 = rating before ratings were tied to orders
+CreatedDate
+UpdatedDate
+Reply		public reply of provider, once per review
+ReplyDate
+Hidden		1 = hidden by moderation, left out of provider rating
+Flagged		1 = waiting in moderation queue
 */
 type ProviderRating struct {
-	Id         int64  `db:"id" json:"id"`
-	ProviderId int64  `db:"provider_id" json:"provider_id"`
-	UserId     int64  `db:"user_id" json:"user_id"`
-	UserRating int64  `db:"user_rating" json:"user_rating"`
-	Review     string `db:"review" json:"review"`
+	Id          int64  `db:"id" json:"id"`
+	ProviderId  int64  `db:"provider_id" json:"provider_id"`
+	UserId      int64  `db:"user_id" json:"user_id"`
+	UserRating  int64  `db:"user_rating" json:"user_rating"`
+	Review      string `db:"review" json:"review"`
+	OrderId     int64  `db:"order_id" json:"order_id"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+	UpdatedDate int64  `db:"updated_date" json:"updated_date"`
+	Reply       string `db:"reply" json:"reply"`
+	ReplyDate   int64  `db:"reply_date" json:"reply_date"`
+	Hidden      int8   `db:"hidden" json:"hidden"`
+	Flagged     int8   `db:"flagged" json:"flagged"`
 }
 
 /**
@@ -530,6 +860,12 @@ DestinationDesc
 Notes
 PaymentMethod
 OrderDate
+CurrentRevision	approved revision of order details
+CancelFee	fee of cancel policy when order is canceled
+Discount	voucher discount, paid by the platform
+VoucherId
+PointsUsed	loyalty points redeemed for the order
+PointsDiscount	discount of redeemed points, paid by the platform
 */
 type OrderVendor struct {
 	Id              int64   `db:"id" json:"id"`
@@ -542,6 +878,12 @@ type OrderVendor struct {
 	Notes           string  `db:"notes" json:"notes"`
 	PaymentMethod   int     `db:"payment_method" json:"payment_method"`
 	OrderDate       int64   `db:"order_date" json:"order_date"`
+	CurrentRevision int64   `db:"current_revision" json:"current_revision"`
+	CancelFee       int64   `db:"cancel_fee" json:"cancel_fee"`
+	Discount        int64   `db:"discount" json:"discount"`
+	VoucherId       int64   `db:"voucher_id" json:"voucher_id"`
+	PointsUsed      int64   `db:"points_used" json:"points_used"`
+	PointsDiscount  int64   `db:"points_discount" json:"points_discount"`
 }
 
 /**
@@ -553,6 +895,7 @@ ServiceName
 ServicePrice
 Qty
 ModifiedDate
+Revision	order amendment revision, 0 = original order
 */
 type OrderVendorDetail struct {
 	Id           int64  `db:"id" json:"id"`
@@ -562,6 +905,7 @@ type OrderVendorDetail struct {
 	ServicePrice int64  `db:"service_price" json:"service_price"`
 	Qty          int64  `db:"qty" json:"qty"`
 	ModifiedDate int64  `db:"modified_date" json:"modified_date"`
+	Revision     int64  `db:"revision" json:"revision"`
 }
 
 /**
@@ -578,6 +922,13 @@ type OrderVendorJourney struct {
 	Message string `db:"message" json:"message"`
 }
 
+type PostOrderJourney struct {
+	OrderId  int64  `json:"order_id"`
+	Status   int64  `json:"status"`
+	Message  string `json:"message"`
+	ReasonId int64  `json:"reason_id"`
+}
+
 /**
 Order vendor tracking location
 Id
@@ -595,6 +946,7 @@ type OrderVendorTracking struct {
 /**
 Post transaction request
 ProviderId
+JasaId		only for dispatch order
 UserId
 Destination
 DestinationLat
@@ -605,9 +957,12 @@ PaymentMethod
 Notes
 Data
 OrderDate
+VoucherCode	optional, discount is reserved when order is created
+Points		optional, loyalty points redeemed as discount
 */
 type PostTransaction struct {
 	ProviderId      int64                   `json:"provider_id"`
+	JasaId          int64                   `json:"jasa_id"`
 	Destination     string                  `json:"destination"`
 	DestinationLat  float64                 `json:"destination_lat"`
 	DestinationLong float64                 `json:"destination_long"`
@@ -615,6 +970,8 @@ type PostTransaction struct {
 	Notes           string                  `json:"notes"`
 	PaymentMethod   int                     `json:"payment_method"`
 	Data            []PostTransactionDetail `json:"data"`
+	VoucherCode     string                  `json:"voucher_code"`
+	Points          int64                   `json:"points"`
 }
 
 /**
@@ -643,6 +1000,7 @@ MinPrice
 MaxPrice
 Rating
 Distance
+TravelFee	by distance band
 */
 type ProviderByCat struct {
 	Id          int64   `db:"id" json:"id"`
@@ -655,6 +1013,7 @@ type ProviderByCat struct {
 	Distance    float64 `db:"distance" json:"distance"`
 	ProfilePict string  `db:"profile_pict" json:"profile_pict"`
 	Status      int8    `db:"status" json:"status"`
+	TravelFee   int64   `db:"-" json:"travel_fee"`
 }
 
 /**
@@ -818,6 +1177,7 @@ type OrderItemList struct {
 	Status       int     `db:"status" json:"status"`
 	OrderDate    int64   `db:"order_date" json:"order_date"`
 	CompleteDate int64   `db:"complete_date" json:"complete_date"`
+	UnreadCount  int64   `db:"unread_count" json:"unread_count"`
 }
 
 type OrderItemListProvider struct {
@@ -840,6 +1200,14 @@ type OrderItemListProvider struct {
 	PhoneNumber      string  `db:"phone_number" json:"phone_number"`
 	DestinationDesc  string  `db:"destination_desc" json:"destination_desc"`
 	Notes            string  `db:"notes" json:"notes"`
+	UnreadCount      int64   `db:"unread_count" json:"unread_count"`
+
+	// ratings of the customer by providers, for providers only
+	CustomerRating       float64 `db:"customer_rating" json:"customer_rating"`
+	CustomerRatingCount  int64   `db:"customer_rating_count" json:"customer_rating_count"`
+	CustomerNoShow       int64   `db:"customer_no_show" json:"customer_no_show"`
+	CustomerRude         int64   `db:"customer_rude" json:"customer_rude"`
+	CustomerWrongAddress int64   `db:"customer_wrong_address" json:"customer_wrong_address"`
 }
 
 type Query struct {
@@ -880,12 +1248,28 @@ type PostSearchType struct {
 	Longitude float64 `json:"longitude"`
 }
 
+/**
+Order cancel
+Id
+JourneyId
+OrderId
+CanceledBy
+Message
+ReasonId
+Fee
+FeeChargedTo	1 = customer, 2 = provider, 0 = no fee
+CreatedDate
+*/
 type OrderCancel struct {
-	Id         int64  `db:"id" json:"id"`
-	JourneyId  int64  `db:"journey_id" json:"journey_id"`
-	OrderId    int64  `db:"order_id" json:"order_id"`
-	CanceledBy int8   `db:"canceled_by" json:"canceled_by"`
-	Message    string `db:"message" json:"message"`
+	Id           int64  `db:"id" json:"id"`
+	JourneyId    int64  `db:"journey_id" json:"journey_id"`
+	OrderId      int64  `db:"order_id" json:"order_id"`
+	CanceledBy   int8   `db:"canceled_by" json:"canceled_by"`
+	Message      string `db:"message" json:"message"`
+	ReasonId     int64  `db:"reason_id" json:"reason_id"`
+	Fee          int64  `db:"fee" json:"fee"`
+	FeeChargedTo int8   `db:"fee_charged_to" json:"fee_charged_to"`
+	CreatedDate  int64  `db:"created_date" json:"created_date"`
 }
 
 type Promo struct {
@@ -984,12 +1368,7 @@ func GetProvider(c *gin.Context) {
 		FROM providerdata pd
 		JOIN kategorijasa kj ON kj.id = pd.jasa_id
 		JOIN provideraccount pa ON pa.provider_id = pd.id
-		LEFT JOIN (
-			SELECT provider_id, ((sum_rating + 0.0)/count)::float as rating
-			FROM (
-				SELECT provider_id, count(*) as count, sum(user_rating) sum_rating
-				FROM providerrating group by provider_id) rating_counter) pr
-		ON pr.provider_id = pd.id
+		LEFT JOIN provider_stats pr ON pr.provider_id = pd.id
 		WHERE pd.id=$1`, providerId)
 
 	if errBasicInfo != nil {
@@ -1065,7 +1444,7 @@ func GetProvider(c *gin.Context) {
 	// get count rate and review
 	var providerRating []ProviderRating
 	_, errRating := dbmap.Select(&providerRating, `SELECT * FROM providerrating
-		WHERE provider_id=$1`, providerId)
+		WHERE provider_id=$1 AND order_id <> 0 AND hidden=0`, providerId)
 
 	if errRating != nil {
 		log.Println("Fail select rating")
@@ -1091,6 +1470,7 @@ func GetProvider(c *gin.Context) {
 		"dokumen":         providerBasicInfo.Dokumen,
 		"phone_number":    providerBasicInfo.PhoneNumber,
 		"approved":        providerBasicInfo.Approved,
+		"reliability":     getProviderReliability(providerBasicInfo.Id),
 	})
 
 }
@@ -1125,22 +1505,14 @@ func GetNearProviderForMap(c *gin.Context) {
 		FROM providerlocation pl
 			JOIN providerdata pd on pd.id = pl.provider_id
 			JOIN kategorijasa kj on kj.id = pd.jasa_id
-			LEFT JOIN (
-				SELECT provider_id, MIN(service_price) as min_price, MAX(service_price)
-				as max_price
-				FROM providerpricelist
-				GROUP BY provider_id) pp
-			ON pp.provider_id = pd.id
-			LEFT JOIN (
-				SELECT provider_id, ((sum_rating + 0.0)/count)::float as rating
-				FROM (
-					SELECT provider_id, count(*) as count, sum(user_rating) sum_rating
-					FROM providerrating group by provider_id) rating_counter) pr
-			ON pr.provider_id = pd.id
+			LEFT JOIN provider_stats ps ON ps.provider_id = pd.id
 			LEFT JOIN providerprofileimage ppi ON ppi.provider_id = pd.id
 			JOIN provideraccount pa ON pa.provider_id = pd.id
-		WHERE earth_distance(ll_to_earth($1, $2),
+		WHERE earth_box(ll_to_earth($1, $2), $3) @> ll_to_earth(pl.latitude, pl.longitude)
+			AND earth_distance(ll_to_earth($1, $2),
 		ll_to_earth(pl.latitude, pl.longitude)) <= $3
+			AND (COALESCE(pa.max_distance, 0) = 0
+				OR earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) <= pa.max_distance)
 		ORDER BY distance ASC`, lat, long, searchDistance)
 
 	var nearProviderByType []NearProviderByType
@@ -1153,13 +1525,22 @@ func GetNearProviderForMap(c *gin.Context) {
 			FROM providerlocation pl
 				JOIN providerdata pd on pd.id = pl.provider_id
 				JOIN kategorijasa kj on kj.id = pd.jasa_id
-			WHERE earth_distance(ll_to_earth($1, $2),
+				JOIN provideraccount pa ON pa.provider_id = pd.id
+			WHERE earth_box(ll_to_earth($1, $2), $3) @> ll_to_earth(pl.latitude, pl.longitude)
+				AND earth_distance(ll_to_earth($1, $2),
 			ll_to_earth(pl.latitude, pl.longitude)) <= $3
+				AND (COALESCE(pa.max_distance, 0) = 0
+					OR earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) <= pa.max_distance)
 			ORDER BY distance ASC) as provider_by_location
 		GROUP BY jasa_id, jenis_jasa
 		ORDER BY jasa_id ASC`, lat, long, searchDistance)
 
 	if errNPM == nil && errNPT == nil {
+		bands := getTravelFeeBands()
+		for i := range nearProviderForMap {
+			nearProviderForMap[i].TravelFee = travelFee(bands, nearProviderForMap[i].Distance)
+		}
+
 		c.JSON(200, gin.H{
 			"map":  nearProviderForMap,
 			"type": nearProviderByType})
@@ -1199,27 +1580,20 @@ AS distance,
 CASE WHEN (ppi.profile_pict IS NULL OR ppi.profile_pict = '') THEN '' ELSE ppi.profile_pict END,
 pa.status
 FROM providerdata pd join providerlocation pl on pl.provider_id = pd.id
-LEFT JOIN (
-	SELECT provider_id, MIN(service_price) as min_price, MAX(service_price)
-	as max_price
-	FROM providerpricelist
-	GROUP BY provider_id) pp
-ON pp.provider_id = pd.id
-LEFT JOIN (
-	SELECT provider_id, ((sum_rating + 0.0)/count)::float as rating
-	FROM (
-		SELECT provider_id, count(*) as count, sum(user_rating) sum_rating
-		FROM providerrating group by provider_id) rating_counter) pr
-ON pr.provider_id = pd.id
+LEFT JOIN provider_stats ps ON ps.provider_id = pd.id
 LEFT JOIN providerprofileimage ppi ON ppi.provider_id = pd.id
 JOIN provideraccount pa ON pa.provider_id = pd.id
 WHERE pd.jasa_id=$3
+	AND earth_box(ll_to_earth($1, $2), $4) @> ll_to_earth(pl.latitude, pl.longitude)
 	AND earth_distance(ll_to_earth($1, $2),
 	ll_to_earth(pl.latitude, pl.longitude)) <= $4
+	AND (COALESCE(pa.max_distance, 0) = 0
+		OR earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) <= pa.max_distance)
 ORDER BY distance ASC;
 	`, lat, long, jasaId, searchDistance)
 
 		if err == nil {
+			setProviderTravelFee(providerByCat)
 			c.JSON(200, gin.H{"data": providerByCat})
 		} else {
 			checkErr(err, "Select failed")
@@ -1235,26 +1609,19 @@ AS distance,
 CASE WHEN (ppi.profile_pict IS NULL OR ppi.profile_pict = '') THEN '' ELSE ppi.profile_pict END,
 pa.status
 FROM providerdata pd join providerlocation pl on pl.provider_id = pd.id
-LEFT JOIN (
-	SELECT provider_id, MIN(service_price) as min_price, MAX(service_price)
-	as max_price
-	FROM providerpricelist
-	GROUP BY provider_id) pp
-ON pp.provider_id = pd.id
-LEFT JOIN (
-	SELECT provider_id, ((sum_rating + 0.0)/count)::float as rating
-	FROM (
-		SELECT provider_id, count(*) as count, sum(user_rating) sum_rating
-		FROM providerrating group by provider_id) rating_counter) pr
-ON pr.provider_id = pd.id
+LEFT JOIN provider_stats ps ON ps.provider_id = pd.id
 LEFT JOIN providerprofileimage ppi ON ppi.provider_id = pd.id
 JOIN provideraccount pa ON pa.provider_id = pd.id
-WHERE earth_distance(ll_to_earth($1, $2),
+WHERE earth_box(ll_to_earth($1, $2), $3) @> ll_to_earth(pl.latitude, pl.longitude)
+	AND earth_distance(ll_to_earth($1, $2),
 	ll_to_earth(pl.latitude, pl.longitude)) <= $3
+	AND (COALESCE(pa.max_distance, 0) = 0
+		OR earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) <= pa.max_distance)
 ORDER BY distance ASC;
 	`, lat, long, searchDistance)
 
 		if err == nil {
+			setProviderTravelFee(providerByCat)
 			c.JSON(200, gin.H{"data": providerByCat})
 		} else {
 			checkErr(err, "Select failed")
@@ -1280,25 +1647,17 @@ func GetProvidersByKeyword(c *gin.Context) {
 		CASE WHEN (ppi.profile_pict IS NULL OR ppi.profile_pict = '') THEN '' ELSE ppi.profile_pict END,
 		pa.status
 		FROM providerdata pd join providerlocation pl on pl.provider_id = pd.id
-		LEFT JOIN (
-			SELECT provider_id, MIN(service_price) as min_price, MAX(service_price)
-			as max_price
-			FROM providerpricelist
-			GROUP BY provider_id) pp
-		ON pp.provider_id = pd.id
-		LEFT JOIN (
-			SELECT provider_id, ((sum_rating + 0.0)/count)::float as rating
-			FROM (
-				SELECT provider_id, count(*) as count, sum(user_rating) sum_rating
-				FROM providerrating group by provider_id) rating_counter) pr
-		ON pr.provider_id = pd.id
+		LEFT JOIN provider_stats ps ON ps.provider_id = pd.id
 		LEFT JOIN kategorijasa kj ON kj.id = pd.jasa_id
 		LEFT JOIN providerprofileimage ppi ON ppi.provider_id = pd.id
 		JOIN provideraccount pa ON pa.provider_id = pd.id
-		WHERE LOWER(kj.jenis) LIKE LOWER('%' || $3 || '%') OR LOWER(pd.nama) LIKE LOWER('%' || $3 || '%')
+		WHERE (LOWER(kj.jenis) LIKE LOWER('%' || $3 || '%') OR LOWER(pd.nama) LIKE LOWER('%' || $3 || '%'))
+			AND (COALESCE(pa.max_distance, 0) = 0
+				OR earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) <= pa.max_distance)
 		ORDER BY distance ASC`, postSearchType.Latitude, postSearchType.Longitude, postSearchType.Keyword)
 
 		if err == nil {
+			setProviderTravelFee(providerByCat)
 			c.JSON(200, gin.H{"data": providerByCat})
 		} else {
 			checkErr(err, "failed")
@@ -1366,8 +1725,19 @@ func PostSignInProvider(c *gin.Context) {
 
 func PostCreateProvider(c *gin.Context) {
 	// Create new provider
-	var providerData ProviderData
-	c.Bind(&providerData)
+	var signUp PostProviderSignUp
+	c.Bind(&signUp)
+
+	providerData := signUp.ProviderData
+
+	var referralCode ReferralCode
+	if signUp.ReferralCode != "" {
+		var err error
+		if referralCode, err = findReferralCode(strings.ToUpper(signUp.ReferralCode)); err != nil {
+			c.JSON(400, gin.H{"error": "Kode referral tidak ditemukan"})
+			return
+		}
+	}
 
 	if insert := db.QueryRow(`INSERT INTO providerdata(nama, email,
 		phone_number, jasa_id, alamat, provinsi,
@@ -1387,6 +1757,11 @@ func PostCreateProvider(c *gin.Context) {
 			VALUES($1, $2, $3)`, id, providerData.Email, 0)
 
 		if err == nil && insertAccount != nil {
+			if referralCode.Id != 0 {
+				recordReferral(referralCode, referralOwnerProvider, id, providerData.Email,
+					signUp.DeviceToken)
+			}
+
 			content := &ProviderData{
 				Id:           id,
 				Nama:         providerData.Nama,
@@ -1490,6 +1865,7 @@ func InActiveProvider(c *gin.Context) {
 		if update := db.QueryRow(`UPDATE provideraccount SET status=$1
 			WHERE provider_id=$2`, 0,
 			providerId); update != nil {
+			publishEvent(topicProviderOffline, 0, providerId, gin.H{"provider_id": providerId, "status": 0})
 			c.JSON(200, gin.H{"status": "update success"})
 		} else {
 			c.JSON(400, gin.H{"error": "update failed"})
@@ -1510,6 +1886,7 @@ func ActiveProvider(c *gin.Context) {
 	if err == nil {
 		if update := db.QueryRow(`UPDATE provideraccount SET status=$1
 			WHERE provider_id=$2`, 1, providerId); update != nil {
+			publishEvent(topicProviderOnline, 0, providerId, gin.H{"provider_id": providerId, "status": 1})
 			c.JSON(200, gin.H{"status": "update success"})
 		} else {
 			c.JSON(400, gin.H{"error": "update failed"})
@@ -1595,6 +1972,7 @@ func PostAddProviderPriceList(c *gin.Context) {
 		providerPriceItem.Negotiable,
 		providerPriceItem.SupportPerItem,
 		providerPriceItem.MinOrderQty); insert != nil {
+		syncProviderStats(providerId)
 		c.JSON(200, gin.H{"status": "Success add new price"})
 	}
 
@@ -1644,76 +2022,11 @@ func UpdateProviderPrice(c *gin.Context) {
 		providerPrice.ServicePrice, providerPrice.Negotiable,
 		providerPrice.SupportPerItem, providerPrice.MinOrderQty,
 		providerPrice.Id, providerId); update != nil {
+		syncProviderStats(providerId)
 		c.JSON(200, gin.H{"status": "Update success"})
 	}
 }
 
-func PostAddedRating(c *gin.Context) {
-
-	userId := getUserIdFromToken(c)
-
-	var providerRating ProviderRating
-	c.Bind(&providerRating)
-
-	var recProvider ProviderData
-	errProvider := dbmap.SelectOne(&recProvider, `SELECT * FROM providerdata
-		WHERE id=$1`,
-		providerRating.ProviderId)
-
-	if errProvider == nil {
-
-		var recProviderRating ProviderRating
-		errRating := dbmap.SelectOne(&recProviderRating, `SELECT *
-			FROM providerrating
-			WHERE user_id=$1 AND provider_id=$2`, userId, providerRating.ProviderId)
-
-		if errRating != nil {
-			if insert := db.QueryRow(`INSERT
-				INTO providerrating(provider_id, user_id, user_rating)
-			VALUES($1, $2, $3)`,
-				providerRating.ProviderId,
-				userId,
-				providerRating.UserRating); insert != nil {
-				c.JSON(200, gin.H{"status": "Success give rating"})
-			}
-		} else {
-			c.JSON(400, gin.H{"error": "Only can give rating once"})
-		}
-
-	} else {
-		c.JSON(400, gin.H{"error": "select failed"})
-	}
-}
-
-func GetProviderRating(c *gin.Context) {
-	providerId := c.Params.ByName("provider_id")
-
-	var providerRating []ProviderRating
-	_, err := dbmap.Select(&providerRating, `SELECT * FROM providerrating
-		WHERE provider_id=$1`, providerId)
-
-	if err == nil {
-		c.JSON(200, gin.H{"data": providerRating})
-	} else {
-		c.JSON(400, gin.H{"error": "select failed"})
-	}
-}
-
-func GetProviderRatingProvider(c *gin.Context) {
-	providerId := getProviderIdFromToken(c)
-
-	var providerRating []ProviderRating
-	_, err := dbmap.Select(&providerRating, `SELECT * FROM providerrating
-		WHERE provider_id=$1`, providerId)
-
-	if err == nil {
-		c.JSON(200, gin.H{"data": providerRating})
-	} else {
-
-		c.JSON(400, gin.H{"error": "select failed"})
-	}
-}
-
 func GetProviderQuickInfo(c *gin.Context) {
 	providerId := getProviderIdFromToken(c)
 
@@ -1732,7 +2045,7 @@ func GetProviderQuickInfo(c *gin.Context) {
 			JOIN providerdata pd ON pd.id = ov.provider_id
 			JOIN kategorijasa kj ON kj.id = pd.jasa_id
 			JOIN (SELECT order_id, SUM(service_price * qty) as total_price
-					FROM ordervendordetail WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
+					FROM ordervendorcurrentdetail WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
 				as otp ON otp.order_id = ov.id
 			JOIN (SELECT order_id, MAX(status) as status FROM ordervendorjourney WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
 				as ouj ON ouj.order_id = ov.id
@@ -1740,13 +2053,14 @@ func GetProviderQuickInfo(c *gin.Context) {
 
 	var providerRating []ProviderRating
 	_, errRating := dbmap.Select(&providerRating, `SELECT * FROM providerrating
-		WHERE provider_id=$1`, providerId)
+		WHERE provider_id=$1 AND order_id <> 0`, providerId)
 
 	if errPrice == nil && errOrderList == nil && errRating == nil {
 		c.JSON(200, gin.H{
 			"count_jasa":   len(providerPrice),
 			"count_order":  len(orders),
 			"count_review": len(providerRating),
+			"reliability":  getProviderReliability(providerId),
 		})
 	} else {
 		c.JSON(400, gin.H{"error": "select failed"})
@@ -1786,30 +2100,6 @@ func GetJobQueProvider(c *gin.Context) {
 
 }
 
-func UpdateProviderRating(c *gin.Context) {
-
-	userId := getUserIdFromToken(c)
-
-	var providerRating ProviderRating
-	c.Bind(&providerRating)
-
-	var recProviderRating ProviderRating
-	err := dbmap.SelectOne(&recProviderRating, `SELECT * FROM providerrating
-		WHERE provider_id=$1 AND user_id=$2`,
-		providerRating.ProviderId, userId)
-
-	if err == nil {
-		if update := db.QueryRow(`UPDATE providerrating SET user_rating=$1
-			WHERE provider_id=$2 AND user_id=$3`,
-			providerRating.UserRating, providerRating.ProviderId,
-			userId); update != nil {
-			c.JSON(200, gin.H{"status": "update success"})
-		}
-	} else {
-		c.JSON(400, gin.H{"error": "select failed"})
-	}
-}
-
 func PostProviderImageGallery(c *gin.Context) {
 
 	providerId := getProviderIdFromToken(c)
@@ -1842,6 +2132,7 @@ func DeleteService(c *gin.Context) {
 
 	if delete := db.QueryRow(`DELETE FROM providerpricelist
 	WHERE id=$1 AND provider_id=$2`, serviceId, providerId); delete != nil {
+		syncProviderStats(providerId)
 		c.JSON(200, gin.H{"status": "Delete success"})
 	}
 }
@@ -1994,7 +2285,39 @@ func PostNewOrder(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Penyedia Jasa tidak terdaftar atau tidak aktif"})
 	} else if errUser != nil {
 		c.JSON(400, gin.H{"error": "User tidak terdaftar"})
+	} else if isCustomerBlocked(userId) {
+		c.JSON(400, gin.H{"error": "Akun tidak dapat membuat pesanan, hubungi customer service"})
+	} else if !isPaymentMethod(postTransaction.PaymentMethod) {
+		c.JSON(400, gin.H{"error": "Metode pembayaran tidak valid"})
 	} else {
+		var voucherUsage VoucherUsage
+		if postTransaction.VoucherCode != "" {
+			jasaId, _ := dbmap.SelectInt(`SELECT jasa_id FROM providerdata WHERE id=$1`,
+				postTransaction.ProviderId)
+
+			var errVoucher error
+			voucherUsage, errVoucher = reserveVoucher(postTransaction.VoucherCode, VoucherOrder{
+				UserId:     userId,
+				JasaId:     jasaId,
+				ProviderId: postTransaction.ProviderId,
+				Total:      getTransactionTotal(postTransaction.Data),
+			})
+
+			if errVoucher != nil {
+				c.JSON(400, gin.H{"error": errVoucher.Error()})
+				return
+			}
+		}
+
+		if err := checkLoyaltyPoints(userId, postTransaction.Points,
+			getTransactionTotal(postTransaction.Data)-voucherUsage.Discount); err != nil {
+			if voucherUsage.Id != 0 {
+				releaseVoucherUsage(voucherUsage.Id)
+			}
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
 		if insert := db.QueryRow(`INSERT INTO ordervendor(provider_id,
 		user_id,
 		destination,
@@ -2003,8 +2326,10 @@ func PostNewOrder(c *gin.Context) {
 		destination_desc,
 		notes,
 		payment_method,
-		order_date)
-		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		order_date,
+		discount,
+		voucher_id)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
 			postTransaction.ProviderId,
 			userId,
 			postTransaction.Destination,
@@ -2013,12 +2338,28 @@ func PostNewOrder(c *gin.Context) {
 			postTransaction.DestinationDesc,
 			postTransaction.Notes,
 			postTransaction.PaymentMethod,
-			time.Now().Unix()); insert != nil {
+			time.Now().Unix(),
+			voucherUsage.Discount,
+			voucherUsage.VoucherId); insert != nil {
 
 			var orderId int64
 			err := insert.Scan(&orderId)
 
 			if err == nil {
+				if voucherUsage.Id != 0 {
+					attachVoucherUsage(voucherUsage, orderId)
+				}
+
+				var pointsUsed, pointsDiscount int64
+				if postTransaction.Points > 0 {
+					pointsUsed, pointsDiscount, err = redeemLoyaltyPoints(userId, orderId, postTransaction.Points)
+					if err != nil {
+						log.Println("Redeem points failed", orderId, err)
+						discardCheckoutOrder(orderId)
+						c.JSON(400, gin.H{"error": errLoyaltyNoPoints.Error()})
+						return
+					}
+				}
 
 				// insert order journey
 				/* status
@@ -2039,77 +2380,102 @@ func PostNewOrder(c *gin.Context) {
 				db.QueryRow(`INSERT INTO ordervendorjourney(order_id, status, date)
 			VALUES($1, $2, $3)`, orderVendorJourney.OrderId, orderVendorJourney.Status, orderVendorJourney.Date)
 
-				// insert order tracking
-				orderTracking := OrderVendorTracking{
-					OrderId:          orderId,
-					CurrentLatitude:  0,
-					CurrentLongitude: 0,
-				}
-
-				db.QueryRow("INSERT INTO ordervendortracking(order_id, latitude, longitude) VALUES($1, $2, $3)",
-					orderTracking.OrderId, orderTracking.CurrentLatitude, orderTracking.CurrentLongitude)
-
-				for i := 0; i < len(postTransaction.Data); i++ {
-					orderVendorDetail := &OrderVendorDetail{
-						OrderId:      orderId,
-						JasaId:       postTransaction.Data[i].JasaId,
-						ServiceName:  postTransaction.Data[i].ServiceName,
-						ServicePrice: postTransaction.Data[i].ServicePrice,
-						Qty:          postTransaction.Data[i].Qty,
-						ModifiedDate: postTransaction.Data[i].ModifiedDate,
-					}
+				insertOrderVendorDetails(orderId, postTransaction.Data)
 
-					db.QueryRow(`INSERT INTO ordervendordetail(order_id,
-					jasa_id,
-					service_name,
-					service_price,
-					qty,
-					modified_date)
-					VALUES($1, $2, $3, $4, $5, $6)`,
-						orderVendorDetail.OrderId,
-						orderVendorDetail.JasaId,
-						orderVendorDetail.ServiceName,
-						orderVendorDetail.ServicePrice,
-						orderVendorDetail.Qty,
-						orderVendorDetail.ModifiedDate)
+				payment, err := createOrderPayment(orderId, int64(postTransaction.PaymentMethod))
+				if err != nil {
+					log.Println("Create order payment failed", orderId, err)
+					discardCheckoutOrder(orderId)
+					c.JSON(400, gin.H{"error": "Pembayaran gagal dibuat"})
+					return
 				}
 
+				publishOrderJourney(orderId, 0)
+
 				// send notification to vendor
 
 				sendNotificationToProvider(orderId, 0)
 
-				c.JSON(200, gin.H{"status": "Success order", "order_id": orderId})
+				c.JSON(200, gin.H{"status": "Success order", "order_id": orderId, "payment": payment,
+					"discount": voucherUsage.Discount + pointsDiscount, "points_used": pointsUsed})
 			} else {
+				if voucherUsage.Id != 0 {
+					releaseVoucherUsage(voucherUsage.Id)
+				}
 				c.JSON(400, gin.H{"error": "insert failed"})
 			}
 		}
 	}
 }
 
+// discardCheckoutOrder undo order whose checkout failed halfway, voucher and points go back
+func discardCheckoutOrder(orderId int64) {
+	releaseOrderVoucher(orderId)
+	releaseOrderPoints(orderId)
+
+	db.Exec(`DELETE FROM payment WHERE order_id=$1`, orderId)
+	db.Exec(`DELETE FROM ordervendordetail WHERE order_id=$1`, orderId)
+	db.Exec(`DELETE FROM ordervendorjourney WHERE order_id=$1`, orderId)
+	db.Exec(`DELETE FROM ordervendor WHERE id=$1`, orderId)
+}
+
+// insertOrderVendorDetails save ordered services of an order
+func insertOrderVendorDetails(orderId int64, details []PostTransactionDetail) {
+	for i := 0; i < len(details); i++ {
+		orderVendorDetail := &OrderVendorDetail{
+			OrderId:      orderId,
+			JasaId:       details[i].JasaId,
+			ServiceName:  details[i].ServiceName,
+			ServicePrice: details[i].ServicePrice,
+			Qty:          details[i].Qty,
+			ModifiedDate: details[i].ModifiedDate,
+		}
+
+		db.Exec(`INSERT INTO ordervendordetail(order_id,
+			jasa_id,
+			service_name,
+			service_price,
+			qty,
+			modified_date)
+			VALUES($1, $2, $3, $4, $5, $6)`,
+			orderVendorDetail.OrderId,
+			orderVendorDetail.JasaId,
+			orderVendorDetail.ServiceName,
+			orderVendorDetail.ServicePrice,
+			orderVendorDetail.Qty,
+			orderVendorDetail.ModifiedDate)
+	}
+}
+
 func GetUserOrder(c *gin.Context) {
 	userId := getUserIdFromToken(c)
 
 	var query Query
 	c.Bind(&query)
 
+	// dispatch order has no provider until one claims it, its jasa comes from the dispatch request
 	var orderItemList []OrderItemList
 
 	if query.LowerThan > 0 {
 		_, err := dbmap.Select(&orderItemList, `SELECT ov.id, ov.destination, ov.destination_lat as latitude, ov.destination_long as longitude, order_date,
-		pd.id as vendor_id, pd.nama as vendor_name,
+		COALESCE(pd.id, 0) as vendor_id, COALESCE(pd.nama, '') as vendor_name,
 		kj.id as jasa_id, kj.jenis as jasa_name,
 		otp.total_price as price,
 		ouj.status,
-		CASE WHEN oouj.complete_date <> 0 THEN oouj.complete_date ELSE 0 END AS complete_date
+		CASE WHEN oouj.complete_date <> 0 THEN oouj.complete_date ELSE 0 END AS complete_date,
+		COALESCE(om.unread_count, 0) as unread_count
 		FROM ordervendor ov
-			JOIN providerdata pd ON pd.id = ov.provider_id
-			JOIN kategorijasa kj ON kj.id = pd.jasa_id
+			LEFT JOIN providerdata pd ON pd.id = ov.provider_id
+			LEFT JOIN dispatchrequest dr ON dr.order_id = ov.id
+			JOIN kategorijasa kj ON kj.id = COALESCE(pd.jasa_id, dr.jasa_id)
 			JOIN (SELECT order_id, SUM(service_price * qty) as total_price
-					FROM ordervendordetail WHERE order_id IN (SELECT id FROM ordervendor WHERE user_id=$1) GROUP BY order_id)
+					FROM ordervendorcurrentdetail WHERE order_id IN (SELECT id FROM ordervendor WHERE user_id=$1) GROUP BY order_id)
 				as otp ON otp.order_id = ov.id
 			JOIN (	SELECT order_id, MAX(status) as status FROM ordervendorjourney WHERE order_id IN (SELECT id FROM ordervendor WHERE user_id=$1) GROUP BY order_id)
 				as ouj ON ouj.order_id = ov.id
-			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status=6 OR status=7) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status >= 6) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, COUNT(*) as unread_count FROM ordermessage WHERE sender_type=2 AND read_date=0 GROUP BY order_id)
+				as om ON om.order_id = ov.id
 		WHERE ov.user_id=$1 AND status < $2 ORDER BY ov.id ASC`, userId, query.LowerThan)
 
 		if err == nil {
@@ -2121,20 +2487,24 @@ func GetUserOrder(c *gin.Context) {
 		}
 	} else if query.GreaterThan > 0 {
 		_, err := dbmap.Select(&orderItemList, `SELECT ov.id, ov.destination, ov.destination_lat as latitude, ov.destination_long as longitude, order_date,
-		pd.id as vendor_id, pd.nama as vendor_name,
+		COALESCE(pd.id, 0) as vendor_id, COALESCE(pd.nama, '') as vendor_name,
 		kj.id as jasa_id, kj.jenis as jasa_name,
 		otp.total_price as price,
 		ouj.status,
-		CASE WHEN oouj.complete_date <> 0 THEN oouj.complete_date ELSE 0 END AS complete_date
+		CASE WHEN oouj.complete_date <> 0 THEN oouj.complete_date ELSE 0 END AS complete_date,
+		COALESCE(om.unread_count, 0) as unread_count
 		FROM ordervendor ov
-			JOIN providerdata pd ON pd.id = ov.provider_id
-			JOIN kategorijasa kj ON kj.id = pd.jasa_id
+			LEFT JOIN providerdata pd ON pd.id = ov.provider_id
+			LEFT JOIN dispatchrequest dr ON dr.order_id = ov.id
+			JOIN kategorijasa kj ON kj.id = COALESCE(pd.jasa_id, dr.jasa_id)
 			JOIN (SELECT order_id, SUM(service_price * qty) as total_price
-					FROM ordervendordetail WHERE order_id IN (SELECT id FROM ordervendor WHERE user_id=$1) GROUP BY order_id)
+					FROM ordervendorcurrentdetail WHERE order_id IN (SELECT id FROM ordervendor WHERE user_id=$1) GROUP BY order_id)
 				as otp ON otp.order_id = ov.id
 			JOIN (	SELECT order_id, MAX(status) as status FROM ordervendorjourney WHERE order_id IN (SELECT id FROM ordervendor WHERE user_id=$1) GROUP BY order_id)
 				as ouj ON ouj.order_id = ov.id
-			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status=6 OR status=7) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status >= 6) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, COUNT(*) as unread_count FROM ordermessage WHERE sender_type=2 AND read_date=0 GROUP BY order_id)
+				as om ON om.order_id = ov.id
 		WHERE ov.user_id=$1 AND status > $2 ORDER BY ov.id DESC`, userId, query.GreaterThan)
 
 		if err == nil {
@@ -2145,20 +2515,24 @@ func GetUserOrder(c *gin.Context) {
 		}
 	} else {
 		_, err := dbmap.Select(&orderItemList, `SELECT ov.id, ov.destination, ov.destination_lat as latitude, ov.destination_long as longitude, order_date,
-		pd.id as vendor_id, pd.nama as vendor_name,
+		COALESCE(pd.id, 0) as vendor_id, COALESCE(pd.nama, '') as vendor_name,
 		kj.id as jasa_id, kj.jenis as jasa_name,
 		otp.total_price as price,
 		ouj.status,
-		CASE WHEN oouj.complete_date <> 0 THEN oouj.complete_date ELSE 0 END AS complete_date
+		CASE WHEN oouj.complete_date <> 0 THEN oouj.complete_date ELSE 0 END AS complete_date,
+		COALESCE(om.unread_count, 0) as unread_count
 		FROM ordervendor ov
-			JOIN providerdata pd ON pd.id = ov.provider_id
-			JOIN kategorijasa kj ON kj.id = pd.jasa_id
+			LEFT JOIN providerdata pd ON pd.id = ov.provider_id
+			LEFT JOIN dispatchrequest dr ON dr.order_id = ov.id
+			JOIN kategorijasa kj ON kj.id = COALESCE(pd.jasa_id, dr.jasa_id)
 			JOIN (SELECT order_id, SUM(service_price * qty) as total_price
-					FROM ordervendordetail WHERE order_id IN (SELECT id FROM ordervendor WHERE user_id=$1) GROUP BY order_id)
+					FROM ordervendorcurrentdetail WHERE order_id IN (SELECT id FROM ordervendor WHERE user_id=$1) GROUP BY order_id)
 				as otp ON otp.order_id = ov.id
 			JOIN (	SELECT order_id, MAX(status) as status FROM ordervendorjourney WHERE order_id IN (SELECT id FROM ordervendor WHERE user_id=$1) GROUP BY order_id)
 				as ouj ON ouj.order_id = ov.id
-			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status=6 OR status=7) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status >= 6) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, COUNT(*) as unread_count FROM ordermessage WHERE sender_type=2 AND read_date=0 GROUP BY order_id)
+				as om ON om.order_id = ov.id
 		WHERE ov.user_id=$1 ORDER BY ov.id ASC`, userId)
 
 		if err == nil {
@@ -2189,9 +2563,9 @@ func GetOrderDetail(c *gin.Context) {
 	var orderJourney []OrderJourneyItem
 	_, errOrderJourney := dbmap.Select(&orderJourney,
 		`SELECT ovj.id, status, ovj.date, jenis as jenis_jasa,
-			CASE WHEN ovj.status = 7 THEN true ELSE false END as is_canceled,
-			CASE WHEN ovj.status = 7 THEN oc.canceled_by ELSE 0 END as canceled_by,
-			CASE WHEN ovj.status = 7 THEN oc.message ELSE '' END as message
+			CASE WHEN ovj.status >= 7 THEN true ELSE false END as is_canceled,
+			CASE WHEN ovj.status >= 7 THEN oc.canceled_by ELSE 0 END as canceled_by,
+			CASE WHEN ovj.status >= 7 THEN oc.message ELSE '' END as message
 		FROM ordervendorjourney ovj
 			JOIN ordervendor ov ON ov.id = ovj.order_id
 			JOIN providerdata pd ON pd.id = ov.provider_id
@@ -2202,10 +2576,14 @@ func GetOrderDetail(c *gin.Context) {
 	var orderDetail []OrderDetailItem
 	_, errOrderDetailItem := dbmap.Select(&orderDetail,
 		`SELECT jasa_id, service_name, service_price, qty, modified_date
-		FROM ordervendordetail WHERE order_id=$1`, orderId)
+		FROM ordervendorcurrentdetail WHERE order_id=$1`, orderId)
+
+	parsedOrderId, _ := strconv.ParseInt(orderId, 10, 64)
+	_, discount, _ := getOrderCharge(parsedOrderId)
 
 	if errOrderJourney == nil && errOrderDetailItem == nil && errProviderData == nil {
 		c.JSON(200, gin.H{"journey": orderJourney,
+			"eta":                getOrderEta(parsedOrderId),
 			"items":              orderDetail,
 			"provider_id":        providerData.ProviderId,
 			"provider_name":      providerData.ProviderName,
@@ -2213,6 +2591,8 @@ func GetOrderDetail(c *gin.Context) {
 			"provider_bg_images": providerData.ProviderBgImage.String,
 			"provider_type":      providerData.ProviderType,
 			"phone_number":       providerData.PhoneNumber,
+			"disputes":           getOrderOpenDisputes(parsedOrderId),
+			"discount":           discount,
 		})
 	} else {
 		c.JSON(400, gin.H{"error": "Failed get order detail"})
@@ -2222,63 +2602,83 @@ func GetOrderDetail(c *gin.Context) {
 func PostNewOrderJourney(c *gin.Context) {
 	log.Println("Provider create new order journey")
 
-	var orderVendorJourney OrderVendorJourney
-	c.Bind(&orderVendorJourney)
+	var postJourney PostOrderJourney
+	c.Bind(&postJourney)
 
-	if insert := db.QueryRow(`INSERT INTO ordervendorjourney(order_id, status, date)
-	VALUES($1, $2, $3) RETURNING id`,
-		orderVendorJourney.OrderId, orderVendorJourney.Status, time.Now().Unix()); insert != nil {
+	if postJourney.Status >= orderStatusRejected {
+		handleCancelOrder(c, PostCancelOrder{
+			OrderId:  postJourney.OrderId,
+			ReasonId: postJourney.ReasonId,
+			Message:  postJourney.Message,
+		})
+		return
+	}
 
-		if orderVendorJourney.Status == 7 {
-			var journeyId int64
+	if err := insertProviderJourney(getProviderIdFromToken(c), postJourney.OrderId,
+		postJourney.Status); err == sql.ErrNoRows {
+		c.JSON(400, gin.H{"error": "Status pesanan tidak valid"})
+		return
+	} else if err != nil {
+		c.JSON(400, gin.H{"error": "Failed update order status"})
+		return
+	}
 
-			insert.Scan(&journeyId)
+	if postJourney.Status == 2 {
+		refreshOrderEta(postJourney.OrderId)
+	}
 
-			var checkCancelOrder OrderCancel
-			err := dbmap.SelectOne(&checkCancelOrder, "SELECT id FROM ordercancel WHERE order_id=$1", orderVendorJourney.OrderId)
+	if postJourney.Status == orderStatusComplete {
+		go completeOrder(postJourney.OrderId)
+	}
 
-			if err != nil {
-				log.Println("Provider create new order cancel")
-				db.QueryRow(`INSERT INTO ordercancel(journey_id, order_id, canceled_by, message)
-			VALUES($1, $2, $3, $4)`, journeyId, orderVendorJourney.OrderId,
-					2, orderVendorJourney.Message)
-			}
-		}
+	publishOrderJourney(postJourney.OrderId, postJourney.Status)
 
-		sendNotificationToCustomer(orderVendorJourney.OrderId, orderVendorJourney.Status)
+	sendNotificationToCustomer(postJourney.OrderId, postJourney.Status)
 
-		c.JSON(200, gin.H{"status": "Pesanan telah dibatalkan."})
-	} else {
-		c.JSON(400, gin.H{"error": "Failed update order status"})
+	c.JSON(200, gin.H{"status": "Pesanan telah dibatalkan."})
+}
+
+// insertProviderJourney move order of provider forward, complete only from status 5,
+// sql.ErrNoRows when the order is not of provider or the status does not move forward
+func insertProviderJourney(providerId int64, orderId int64, status int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-}
+	// lock the order so concurrent journeys of the same order are checked one by one
+	var ownerId int64
+	if err := tx.QueryRow(`SELECT provider_id FROM ordervendor WHERE id=$1 FOR UPDATE`,
+		orderId).Scan(&ownerId); err != nil {
+		return err
+	}
 
-func PostUserNewOrderJourney(c *gin.Context) {
-	log.Println("User create new order journey")
-	var orderVendorJourney OrderVendorJourney
-	c.Bind(&orderVendorJourney)
+	if ownerId != providerId {
+		return sql.ErrNoRows
+	}
 
-	if insert := db.QueryRow(`INSERT INTO ordervendorjourney(order_id, status, date)
-	VALUES($1, $2, $3) RETURNING id`,
-		orderVendorJourney.OrderId, orderVendorJourney.Status, time.Now().Unix()); insert != nil {
+	var journeyId int64
+	if err := tx.QueryRow(`INSERT INTO ordervendorjourney(order_id, status, date)
+		SELECT $1, $2, $3
+		WHERE NOT EXISTS (SELECT 1 FROM ordervendorjourney
+				WHERE order_id=$1 AND (status >= $2 OR status >= $4))
+			AND ($2 <> $4 OR EXISTS (SELECT 1 FROM ordervendorjourney WHERE order_id=$1 AND status=$5))
+		RETURNING id`, orderId, status, time.Now().Unix(), orderStatusComplete,
+		orderStatusComplete-1).Scan(&journeyId); err != nil {
+		return err
+	}
 
-		var journeyId int64
+	return tx.Commit()
+}
 
-		insert.Scan(&journeyId)
+func PostUserNewOrderJourney(c *gin.Context) {
+	log.Println("User create new order journey")
 
-		log.Println("User cancel order")
-		if insertCancel := db.QueryRow(`INSERT INTO ordercancel(journey_id, order_id, canceled_by, message)
-			VALUES($1, $2, $3, $4)`, journeyId, orderVendorJourney.OrderId,
-			1, orderVendorJourney.Message); insertCancel != nil {
-			sendNotificationToProvider(orderVendorJourney.OrderId,
-				orderVendorJourney.Status)
-		}
+	var postCancel PostCancelOrder
+	c.Bind(&postCancel)
 
-		c.JSON(200, gin.H{"status": "Pesanan telah dibatalkan"})
-	} else {
-		c.JSON(400, gin.H{"error": "Failed update order status"})
-	}
+	handleCancelOrder(c, postCancel)
 }
 
 type UserNotification struct {
@@ -2287,6 +2687,36 @@ type UserNotification struct {
 }
 
 func sendNotificationToCustomer(orderId int64, status int64) {
+	message := getMessageBasedStatusForCustomer(status)
+
+	// Create the message to be sent.
+	data := map[string]string{
+		"message":  message,
+		"order_id": strconv.FormatInt(orderId, 10),
+	}
+
+	pushToCustomer(orderId, data)
+}
+
+func sendNotificationToProvider(orderId int64, status int64) {
+	// Create the message to be sent.
+	data := map[string]string{
+		"message":  "Anda mendapatkan pesanan baru.",
+		"order_id": strconv.FormatInt(orderId, 10),
+	}
+
+	if status >= orderStatusRejected {
+		data = map[string]string{
+			"message":  "Pesanan dibatalkan.",
+			"order_id": strconv.FormatInt(orderId, 10),
+		}
+	}
+
+	pushToProvider(orderId, data)
+}
+
+// pushToCustomer send push data to customer device of the order
+func pushToCustomer(orderId int64, data map[string]string) {
 
 	var userNotification UserNotification
 	err := dbmap.SelectOne(&userNotification, `SELECT ov.user_id as account_id, ua.device_token
@@ -2295,14 +2725,6 @@ func sendNotificationToCustomer(orderId int64, status int64) {
 
 	if err == nil {
 
-		message := getMessageBasedStatusForCustomer(status)
-
-		// Create the message to be sent.
-		data := map[string]string{
-			"message":  message,
-			"order_id": strconv.FormatInt(orderId, 10),
-		}
-
 		ids := []string{
 			userNotification.DeviceToken,
 		}
@@ -2323,12 +2745,24 @@ func sendNotificationToCustomer(orderId int64, status int64) {
 	}
 }
 
-func sendNotificationToProvider(orderId int64, status int64) {
+// pushToProvider send push data to provider device of the order
+func pushToProvider(orderId int64, data map[string]string) {
+	var providerId int64
+	err := db.QueryRow(`SELECT provider_id FROM ordervendor WHERE id=$1`, orderId).Scan(&providerId)
+
+	if err == nil {
+		pushToProviderId(providerId, data)
+	} else {
+		log.Println("Send notif failed")
+	}
+}
+
+// pushToProviderId send push data to provider device
+func pushToProviderId(providerId int64, data map[string]string) {
 	var userNotification UserNotification
-	err := dbmap.SelectOne(&userNotification, `SELECT ov.provider_id as account_id,
+	err := dbmap.SelectOne(&userNotification, `SELECT pa.provider_id as account_id,
 			COALESCE(pa.device_token, '-') as device_token
-	 	FROM ordervendor ov
-	 	 JOIN provideraccount pa ON pa.provider_id = ov.provider_id WHERE ov.id=$1`, orderId)
+	 	FROM provideraccount pa WHERE pa.provider_id=$1`, providerId)
 
 	if err == nil {
 
@@ -2336,19 +2770,6 @@ func sendNotificationToProvider(orderId int64, status int64) {
 			return
 		}
 
-		// Create the message to be sent.
-		data := map[string]string{
-			"message":  "Anda mendapatkan pesanan baru.",
-			"order_id": strconv.FormatInt(orderId, 10),
-		}
-
-		if status == 7 {
-			data = map[string]string{
-				"message":  "Pesanan dibatalkan.",
-				"order_id": strconv.FormatInt(orderId, 10),
-			}
-		}
-
 		ids := []string{
 			userNotification.DeviceToken,
 		}
@@ -2387,33 +2808,60 @@ func getMessageBasedStatusForCustomer(status int64) string {
 		return `Pesanan telah selesai. Terima kasih telah menggunakan jasa Kami. Semoga pelayanan kami memuaskan Anda. Jika Anda berkenan, mohon berikan penilaian Anda ketika menggunakan layanan Kami.`
 	case 7:
 		return `Pesanan ditolak.`
+	case 8:
+		return `Pesanan dibatalkan.`
 	}
 
 	return ""
 }
 
 func UpdateOrderTracking(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
 	var orderVendorTracking OrderVendorTracking
 	c.Bind(&orderVendorTracking)
 
-	var recOrderVendorTracking OrderVendorTracking
-	err := dbmap.SelectOne(&recOrderVendorTracking, `SELECT id,
-		order_id FROM ordervendortracking
-		WHERE id=$1 AND order_id=$2`, orderVendorTracking.Id,
-		orderVendorTracking.OrderId)
+	var recOrderVendor OrderVendor
+	err := dbmap.SelectOne(&recOrderVendor, `SELECT id FROM ordervendor
+		WHERE id=$1 AND provider_id=$2`, orderVendorTracking.OrderId, providerId)
 
-	if err == nil {
-		if update := db.QueryRow(`UPDATE ordervendortracking
-			SET latitude=$1, longitude=$2 WHERE
-			id=$3 AND order_id=$4`, orderVendorTracking.CurrentLatitude,
-			orderVendorTracking.CurrentLongitude,
-			recOrderVendorTracking.Id, orderVendorTracking.OrderId); update != nil {
-			c.JSON(200, gin.H{"status": "Success update current vendor location"})
-		} else {
-			c.JSON(400, gin.H{"error": "Failed update tracking record"})
-		}
-	} else {
+	if err != nil {
 		c.JSON(400, gin.H{"error": "Record not found"})
+		return
+	}
+
+	if !isOrderActive(recOrderVendor.Id) {
+		c.JSON(400, gin.H{"error": "Order is not active"})
+		return
+	}
+
+	point := OrderVendorTrackingPoint{
+		OrderId:      recOrderVendor.Id,
+		ProviderId:   providerId,
+		Latitude:     orderVendorTracking.CurrentLatitude,
+		Longitude:    orderVendorTracking.CurrentLongitude,
+		RecordedDate: time.Now().Unix(),
+	}
+
+	if accepted, reason := filterTrackingPoint(&point); !accepted {
+		c.JSON(200, gin.H{"status": reason, "accepted": false})
+		return
+	}
+
+	if saveTrackingPoint(point) == nil {
+		refreshOrderEta(point.OrderId)
+
+		publishOrderEvent(point.OrderId, orderEventTracking, gin.H{
+			"order_id":      point.OrderId,
+			"latitude":      point.Latitude,
+			"longitude":     point.Longitude,
+			"recorded_date": point.RecordedDate,
+			"eta":           getOrderEta(point.OrderId),
+		})
+
+		c.JSON(200, gin.H{"status": "Success update current vendor location", "accepted": true})
+	} else {
+		c.JSON(400, gin.H{"error": "Failed update tracking record"})
 	}
 }
 
@@ -2608,41 +3056,59 @@ func createAuthToken(recAuthAccount UserAccount) AuthToken {
 }
 
 func PostSignUpEmail(c *gin.Context) {
-	var userAccount UserAccount
-	c.Bind(&userAccount)
-
-	if !isAccountExists(userAccount) {
-		joinDate := time.Now().Add(time.Hour * 24).Unix()
-
-		if insert := db.QueryRow(`INSERT INTO useraccount(email, password, auth_mode,
-		device_token, join_date) VALUES($1, $2, $3, $4, $5) RETURNING id`,
-			userAccount.Email, userAccount.Password, userAccount.AuthMode,
-			userAccount.DeviceToken, joinDate); insert != nil {
+	var signUp PostUserSignUp
+	c.Bind(&signUp)
 
-			loginWithRegisteredAccount(userAccount, c)
+	userAccount := signUp.UserAccount
 
-		}
+	if !isAccountExists(userAccount) {
+		signUpUserAccount(signUp, c)
 	} else {
 		c.JSON(400, gin.H{"error": "Account already exists"})
 	}
 }
 
-func PostAuthSocial(c *gin.Context) {
-	var userAccount UserAccount
-	c.Bind(&userAccount)
+// signUpUserAccount insert new account, referral code is optional but must exist when given
+func signUpUserAccount(signUp PostUserSignUp, c *gin.Context) {
+	userAccount := signUp.UserAccount
 
-	if !isAccountExists(userAccount) {
-		// sign up
-		joinDate := time.Now().Add(time.Hour * 24).Unix()
+	var referralCode ReferralCode
+	if signUp.ReferralCode != "" {
+		var err error
+		if referralCode, err = findReferralCode(strings.ToUpper(signUp.ReferralCode)); err != nil {
+			c.JSON(400, gin.H{"error": "Kode referral tidak ditemukan"})
+			return
+		}
+	}
+
+	joinDate := time.Now().Add(time.Hour * 24).Unix()
 
-		if insert := db.QueryRow(`INSERT INTO useraccount(email, password, auth_mode,
+	var userId int64
+	if err := db.QueryRow(`INSERT INTO useraccount(email, password, auth_mode,
 		device_token, join_date) VALUES($1, $2, $3, $4, $5) RETURNING id`,
-			userAccount.Email, userAccount.Password, userAccount.AuthMode,
-			userAccount.DeviceToken, joinDate); insert != nil {
+		userAccount.Email, userAccount.Password, userAccount.AuthMode,
+		userAccount.DeviceToken, joinDate).Scan(&userId); err != nil {
+		c.JSON(400, gin.H{"error": "Sign up failed"})
+		return
+	}
 
-			loginWithRegisteredAccount(userAccount, c)
+	if referralCode.Id != 0 {
+		recordReferral(referralCode, referralOwnerUser, userId, userAccount.Email,
+			userAccount.DeviceToken)
+	}
 
-		}
+	loginWithRegisteredAccount(userAccount, c)
+}
+
+func PostAuthSocial(c *gin.Context) {
+	var signUp PostUserSignUp
+	c.Bind(&signUp)
+
+	userAccount := signUp.UserAccount
+
+	if !isAccountExists(userAccount) {
+		// sign up
+		signUpUserAccount(signUp, c)
 	} else {
 
 		// sign in
@@ -2792,17 +3258,26 @@ func GetProviderOrder(c *gin.Context) {
 		CASE WHEN oouj.complete_date <> 0 THEN oouj.complete_date ELSE 0 END as complete_date,
 		up.phone_number,
 		ov.destination_desc,
-		ov.notes
+		ov.notes,
+		COALESCE(om.unread_count, 0) as unread_count,
+		COALESCE(crs.rating, 0)::float as customer_rating,
+		COALESCE(crs.count, 0) as customer_rating_count,
+		COALESCE(crs.no_show, 0) as customer_no_show,
+		COALESCE(crs.rude, 0) as customer_rude,
+		COALESCE(crs.wrong_address, 0) as customer_wrong_address
 		FROM ordervendor ov
 			JOIN userprofile up ON up.user_id = ov.user_id
 			JOIN providerdata pd ON pd.id = ov.provider_id
 			JOIN kategorijasa kj ON kj.id = pd.jasa_id
 			JOIN (SELECT order_id, SUM(service_price * qty) as total_price
-					FROM ordervendordetail WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
+					FROM ordervendorcurrentdetail WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
 				as otp ON otp.order_id = ov.id
 			JOIN (SELECT order_id, MAX(status) as status FROM ordervendorjourney WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
 				as ouj ON ouj.order_id = ov.id
-			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status=6 OR status=7) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status >= 6) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, COUNT(*) as unread_count FROM ordermessage WHERE sender_type=1 AND read_date=0 GROUP BY order_id)
+				as om ON om.order_id = ov.id
+			LEFT JOIN customerratingsummary crs ON crs.user_id = ov.user_id
 		WHERE ov.provider_id=$1 AND status < $2 ORDER BY order_date ASC`, providerId, query.LowerThan)
 
 		if err == nil {
@@ -2819,17 +3294,26 @@ func GetProviderOrder(c *gin.Context) {
 		CASE WHEN oouj.complete_date <> 0 THEN oouj.complete_date ELSE 0 END as complete_date,
 		up.phone_number,
 		ov.destination_desc,
-		ov.notes
+		ov.notes,
+		COALESCE(om.unread_count, 0) as unread_count,
+		COALESCE(crs.rating, 0)::float as customer_rating,
+		COALESCE(crs.count, 0) as customer_rating_count,
+		COALESCE(crs.no_show, 0) as customer_no_show,
+		COALESCE(crs.rude, 0) as customer_rude,
+		COALESCE(crs.wrong_address, 0) as customer_wrong_address
 		FROM ordervendor ov
 			JOIN userprofile up ON up.user_id = ov.user_id
 			JOIN providerdata pd ON pd.id = ov.provider_id
 			JOIN kategorijasa kj ON kj.id = pd.jasa_id
 			JOIN (SELECT order_id, SUM(service_price * qty) as total_price
-					FROM ordervendordetail WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
+					FROM ordervendorcurrentdetail WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
 				as otp ON otp.order_id = ov.id
 			JOIN (SELECT order_id, MAX(status) as status FROM ordervendorjourney WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
 				as ouj ON ouj.order_id = ov.id
-			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status=6 OR status=7) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status >= 6) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, COUNT(*) as unread_count FROM ordermessage WHERE sender_type=1 AND read_date=0 GROUP BY order_id)
+				as om ON om.order_id = ov.id
+			LEFT JOIN customerratingsummary crs ON crs.user_id = ov.user_id
 		WHERE ov.provider_id=$1 AND status > $2 ORDER BY order_date ASC`, providerId, query.GreaterThan)
 
 		if err == nil {
@@ -2850,17 +3334,26 @@ func GetProviderOrder(c *gin.Context) {
 		CASE WHEN oouj.complete_date <> 0 THEN oouj.complete_date ELSE 0 END as complete_date,
 		up.phone_number,
 		ov.destination_desc,
-		ov.notes
+		ov.notes,
+		COALESCE(om.unread_count, 0) as unread_count,
+		COALESCE(crs.rating, 0)::float as customer_rating,
+		COALESCE(crs.count, 0) as customer_rating_count,
+		COALESCE(crs.no_show, 0) as customer_no_show,
+		COALESCE(crs.rude, 0) as customer_rude,
+		COALESCE(crs.wrong_address, 0) as customer_wrong_address
 		FROM ordervendor ov
 			JOIN userprofile up ON up.user_id = ov.user_id
 			JOIN providerdata pd ON pd.id = ov.provider_id
 			JOIN kategorijasa kj ON kj.id = pd.jasa_id
 			JOIN (SELECT order_id, SUM(service_price * qty) as total_price
-					FROM ordervendordetail WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
+					FROM ordervendorcurrentdetail WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
 				as otp ON otp.order_id = ov.id
 			JOIN (SELECT order_id, MAX(status) as status FROM ordervendorjourney WHERE order_id IN (SELECT id FROM ordervendor WHERE provider_id=$1) GROUP BY order_id)
 				as ouj ON ouj.order_id = ov.id
-			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status=6 OR status=7) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status >= 6) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, COUNT(*) as unread_count FROM ordermessage WHERE sender_type=1 AND read_date=0 GROUP BY order_id)
+				as om ON om.order_id = ov.id
+			LEFT JOIN customerratingsummary crs ON crs.user_id = ov.user_id
 		WHERE ov.provider_id=$1 ORDER BY order_date ASC`, providerId)
 
 		if err == nil {
@@ -2887,33 +3380,43 @@ func GetProviderOrderDetail(c *gin.Context) {
 		otp.total_price as price,
 		ouj.status,
 		CASE WHEN oouj.complete_date <> 0 THEN oouj.complete_date ELSE 0 END as complete_date,
-		CASE WHEN ouj.status = 7 THEN true ELSE false END AS is_canceled,
-		CASE WHEN ouj.status = 7 THEN oc.canceled_by ELSE 0 END AS canceled_by,
-		CASE WHEN ouj.status = 7 THEN oc.message ELSE '' END AS message,
+		CASE WHEN ouj.status >= 7 THEN true ELSE false END AS is_canceled,
+		CASE WHEN ouj.status >= 7 THEN oc.canceled_by ELSE 0 END AS canceled_by,
+		CASE WHEN ouj.status >= 7 THEN oc.message ELSE '' END AS message,
 		up.phone_number,
 		ov.destination_desc,
-		ov.notes
+		ov.notes,
+		COALESCE(om.unread_count, 0) as unread_count,
+		COALESCE(crs.rating, 0)::float as customer_rating,
+		COALESCE(crs.count, 0) as customer_rating_count,
+		COALESCE(crs.no_show, 0) as customer_no_show,
+		COALESCE(crs.rude, 0) as customer_rude,
+		COALESCE(crs.wrong_address, 0) as customer_wrong_address
 		FROM ordervendor ov
 			JOIN userprofile up ON up.user_id = ov.user_id
 			JOIN providerdata pd ON pd.id = ov.provider_id
 			JOIN kategorijasa kj ON kj.id = pd.jasa_id
 			JOIN (SELECT order_id, SUM(service_price * qty) as total_price
-					FROM ordervendordetail GROUP BY order_id)
+					FROM ordervendorcurrentdetail GROUP BY order_id)
 				as otp ON otp.order_id = ov.id
 			JOIN (SELECT order_id, MAX(status) as status FROM ordervendorjourney GROUP BY order_id)
 				as ouj ON ouj.order_id = ov.id
-			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status=6 OR status=7) as oouj ON oouj.order_id = ov.id
+			LEFT JOIN (SELECT order_id, date as complete_date FROM ordervendorjourney WHERE status >= 6) as oouj ON oouj.order_id = ov.id
 			LEFT JOIN (SELECT order_id, canceled_by, message FROM ordercancel) as oc ON oc.order_id = ov.id
+			LEFT JOIN (SELECT order_id, COUNT(*) as unread_count FROM ordermessage WHERE sender_type=1 AND read_date=0 GROUP BY order_id)
+				as om ON om.order_id = ov.id
+			LEFT JOIN customerratingsummary crs ON crs.user_id = ov.user_id
 		WHERE ov.id=$1`, orderId)
 
 	var orderDetail []OrderDetailItem
 	_, errOrderDetailItem := dbmap.Select(&orderDetail,
 		`SELECT jasa_id, service_name, service_price, qty, modified_date
-		FROM ordervendordetail WHERE order_id=$1`, orderId)
+		FROM ordervendorcurrentdetail WHERE order_id=$1`, orderId)
 
 	if err == nil && errOrderDetailItem == nil {
 
-		c.JSON(200, gin.H{"order_info": orderItemList, "orders": orderDetail})
+		c.JSON(200, gin.H{"order_info": orderItemList, "orders": orderDetail,
+			"disputes": getOrderOpenDisputes(orderItemList.Id)})
 
 	} else {
 		c.JSON(400, gin.H{"error": "select failed"})
@@ -2921,71 +3424,56 @@ func GetProviderOrderDetail(c *gin.Context) {
 }
 
 func PostOrderCancel(c *gin.Context) {
-	var orderCancel OrderCancel
-	c.Bind(&orderCancel)
-
-	// check if order_id is valid
-	var checkValidOrder OrderVendor
-	errValid := dbmap.SelectOne(&checkValidOrder, `SELECT id FROM ordervendor WHERE id=$1`, orderCancel.OrderId)
-
-	if errValid != nil {
-		c.JSON(400, gin.H{"error": "Invalid order"})
-		return
-	}
-
-	// check if order_id was canceled or not
-	var checkCancelOrder OrderCancel
-	err := dbmap.SelectOne(&checkCancelOrder, "SELECT id FROM ordercancel WHERE order_id=$1", orderCancel.OrderId)
-
-	if err != nil {
-		if insert := db.QueryRow(`INSERT INTO ordercancel(journey_id, order_id, canceled_by, message)
-		 	VALUES($1, $2, $3, $4)`, orderCancel.JourneyId, orderCancel.OrderId,
-			orderCancel.CanceledBy, orderCancel.Message); insert != nil {
-			c.JSON(200, gin.H{"success": "Order is cancel"})
-		}
-	} else {
-		c.JSON(400, gin.H{"error": "This order was canceled"})
-	}
-}
-
-func handleCancelOrder(c *gin.Context, orderCancel *OrderCancel) {
-	// check if order_id was canceled or not
+	var postCancel PostCancelOrder
+	c.Bind(&postCancel)
 
+	handleCancelOrder(c, postCancel)
 }
 
 func PostPromo(c *gin.Context) {
-	var promo Promo
-	c.Bind(&promo)
+	promo, valid := bindPromo(c)
+	if !valid {
+		c.JSON(400, gin.H{"error": "Promo tidak valid"})
+		return
+	}
 
-	if insert := db.QueryRow(`INSERT INTO promo(title, promo_image, start_date, end_date, position, active, target)
+	err := db.QueryRow(`INSERT INTO promo(title, promo_image, start_date, end_date, position, active, target)
 		VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id`, promo.Title, promo.PromoImage, promo.StartDate, promo.EndDate,
-		promo.Position, promo.Active, promo.Target); insert != nil {
-		var id int64
-
-		err := insert.Scan(&id)
-
-		promo.Id = id
-
-		if err == nil {
-			c.JSON(200, promo)
-		}
-	} else {
+		promo.Position, promo.Active, promo.Target).Scan(&promo.Id)
+	if err != nil {
 		c.JSON(400, gin.H{"error": "insert failed"})
+		return
 	}
+
+	c.JSON(200, promo)
 }
 
+// GetUserPromo active promos within schedule, ordered by position and filtered by targeting
 func GetUserPromo(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
 	var promo []Promo
 
 	_, err := dbmap.Select(&promo, `SELECT id, title, promo_image, start_date,
 		end_date, position, active, target
-			FROM promo WHERE active=1`)
+			FROM promo WHERE active=1 AND start_date <= $1 AND (end_date = 0 OR end_date > $1)
+			ORDER BY position ASC, id DESC`, time.Now().Unix())
 
-	if err == nil {
-		c.JSON(200, gin.H{"data": promo})
-	} else {
+	if err != nil {
 		c.JSON(400, gin.H{"error": "Failed"})
+		return
 	}
+
+	audience := getPromoAudience(c, userId)
+
+	targeted := []PromoBanner{}
+	for _, item := range promo {
+		if parsePromoTarget(item.Target).Matches(audience) {
+			targeted = append(targeted, assignPromoCreative(item, userId))
+		}
+	}
+
+	c.JSON(200, gin.H{"data": targeted})
 }
 
 func PutProviderMaxDistance(c *gin.Context) {
@@ -2994,6 +3482,12 @@ func PutProviderMaxDistance(c *gin.Context) {
 	var providerAccount ProviderAccount
 	c.Bind(&providerAccount)
 
+	// 0 serves customers at any distance
+	if providerAccount.MaxDistance < 0 {
+		c.JSON(400, gin.H{"error": "Jarak maksimal tidak valid"})
+		return
+	}
+
 	if update := db.QueryRow(`UPDATE provideraccount SET max_distance=$1
 		WHERE provider_id=$2`, providerAccount.MaxDistance,
 		providerId); update != nil {
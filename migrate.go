@@ -0,0 +1,169 @@
+package main
+
+// ========================= MIGRATION
+
+// ensureColumn add column to existing table, CreateTablesIfNotExists never alter tables.
+// Column created by gorp on a fresh database gets the same default
+func ensureColumn(table string, column string, columnType string, def string) {
+	var count int64
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_name=$1 AND column_name=$2`, table, column).Scan(&count)
+	checkErr(err, "Check column failed")
+
+	if count == 0 {
+		_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + columnType +
+			` NOT NULL DEFAULT ` + def)
+	} else {
+		_, err = db.Exec(`ALTER TABLE ` + table + ` ALTER COLUMN ` + column + ` SET DEFAULT ` + def)
+	}
+
+	checkErr(err, "Migrate column "+table+"."+column+" failed")
+}
+
+// migrateSchema run after tables are created, every step must be idempotent
+func migrateSchema() {
+	// order amendment, line items are versioned per revision
+	ensureColumn("ordervendordetail", "revision", "bigint", "0")
+	ensureColumn("ordervendor", "current_revision", "bigint", "0")
+
+	_, err := db.Exec(`CREATE OR REPLACE VIEW ordervendorcurrentdetail AS
+		SELECT ovd.* FROM ordervendordetail ovd
+			JOIN ordervendor ov ON ov.id = ovd.order_id AND ovd.revision = ov.current_revision`)
+	checkErr(err, "Create view ordervendorcurrentdetail failed")
+
+	// cancel policy, structured reason and fee of cancellation
+	ensureColumn("ordercancel", "reason_id", "bigint", "0")
+	ensureColumn("ordercancel", "fee", "bigint", "0")
+	ensureColumn("ordercancel", "fee_charged_to", "smallint", "0")
+	ensureColumn("ordercancel", "created_date", "bigint", "0")
+	ensureColumn("ordervendor", "cancel_fee", "bigint", "0")
+	seedCancelReasons()
+
+	// status 7 used to mean any cancel, only provider reject of unconfirmed order stays 7
+	_, err = db.Exec(`UPDATE ordervendorjourney ovj SET status=8
+		WHERE ovj.status=7 AND (
+			EXISTS (SELECT 1 FROM ordercancel oc WHERE oc.order_id = ovj.order_id AND oc.canceled_by <> 2)
+			OR EXISTS (SELECT 1 FROM ordervendorjourney j
+				WHERE j.order_id = ovj.order_id AND j.status BETWEEN 1 AND 5))`)
+	checkErr(err, "Migrate canceled status failed")
+
+	// payment, webhook finds payment by charge of its gateway
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS payment_gateway_charge_idx
+		ON payment(gateway, charge_id) WHERE charge_id <> ''`)
+	checkErr(err, "Create payment charge index failed")
+
+	// voucher, discount applied at checkout
+	ensureColumn("ordervendor", "discount", "bigint", "0")
+	ensureColumn("ordervendor", "voucher_id", "bigint", "0")
+
+	// loyalty points redeemed at checkout
+	ensureColumn("ordervendor", "points_used", "bigint", "0")
+	ensureColumn("ordervendor", "points_discount", "bigint", "0")
+
+	// ledger, entries are append only, corrections are posted as new transactions
+	ensureColumn("ledgerentry", "user_id", "bigint", "0")
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS ledgerentry_account_provider_idx
+		ON ledgerentry(account, provider_id, created_date)`)
+	checkErr(err, "Create ledger index failed")
+
+	_, err = db.Exec(`CREATE OR REPLACE FUNCTION ledger_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'ledger is append only';
+		END;
+		$$ LANGUAGE plpgsql`)
+	checkErr(err, "Create ledger function failed")
+
+	for _, table := range []string{"ledgertransaction", "ledgerentry"} {
+		_, err = db.Exec(`DROP TRIGGER IF EXISTS ` + table + `_append_only ON ` + table)
+		checkErr(err, "Drop ledger trigger failed")
+
+		_, err = db.Exec(`CREATE TRIGGER ` + table + `_append_only BEFORE UPDATE OR DELETE ON ` +
+			table + ` FOR EACH ROW EXECUTE PROCEDURE ledger_append_only()`)
+		checkErr(err, "Create ledger trigger failed")
+	}
+
+	// promo stats, clicks are matched against orders of the same user
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS promoclick_promo_idx
+		ON promoclick(promo_id, creative_id, created_date)`)
+	checkErr(err, "Create promo click index failed")
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS promoclick_user_idx
+		ON promoclick(promo_id, user_id, created_date)`)
+	checkErr(err, "Create promo click user index failed")
+
+	// loyalty points, lots are redeemed and expired by expiry date
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS loyaltypoint_lot_idx
+		ON loyaltypoint(user_id, kind, expiry_date) WHERE remaining > 0`)
+	checkErr(err, "Create loyalty point index failed")
+
+	// ratings, one per complete order
+	ensureColumn("providerrating", "order_id", "bigint", "0")
+	ensureColumn("providerrating", "created_date", "bigint", "0")
+	ensureColumn("providerrating", "updated_date", "bigint", "0")
+
+	// old rating of a provider belongs to the last complete order of the user with that provider
+	_, err = db.Exec(`UPDATE providerrating pr SET order_id = (
+			SELECT MAX(ov.id) FROM ordervendor ov
+			WHERE ov.user_id = pr.user_id AND ov.provider_id = pr.provider_id
+				AND (SELECT MAX(status) FROM ordervendorjourney WHERE order_id = ov.id) = 6
+				AND NOT EXISTS (SELECT 1 FROM providerrating r WHERE r.order_id = ov.id))
+		WHERE pr.order_id = 0 AND EXISTS (
+			SELECT 1 FROM ordervendor ov
+			WHERE ov.user_id = pr.user_id AND ov.provider_id = pr.provider_id
+				AND (SELECT MAX(status) FROM ordervendorjourney WHERE order_id = ov.id) = 6
+				AND NOT EXISTS (SELECT 1 FROM providerrating r WHERE r.order_id = ov.id))`)
+	checkErr(err, "Migrate rating order failed")
+
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS providerrating_order_idx
+		ON providerrating(order_id) WHERE order_id <> 0`)
+	checkErr(err, "Create rating order index failed")
+
+	// review moderation, provider reply and visibility of a rating
+	ensureColumn("providerrating", "reply", "text", "''")
+	ensureColumn("providerrating", "reply_date", "bigint", "0")
+	ensureColumn("providerrating", "hidden", "smallint", "0")
+	ensureColumn("providerrating", "flagged", "smallint", "0")
+
+	// provider stats, filled once for providers existing before the projection
+	var statsCount int64
+	err = db.QueryRow(`SELECT COUNT(*) FROM provider_stats`).Scan(&statsCount)
+	checkErr(err, "Count provider stats failed")
+
+	if statsCount == 0 {
+		_, err = rebuildProviderStats()
+		checkErr(err, "Build provider stats failed")
+	}
+
+	// customer rating, aggregate shown to providers and read by the blocklist rules
+	_, err = db.Exec(`CREATE OR REPLACE VIEW customerratingsummary AS
+		SELECT user_id, AVG(rating)::float AS rating, COUNT(*) AS count,
+			COUNT(*) FILTER (WHERE 'no_show' = ANY(string_to_array(tags, ','))) AS no_show,
+			COUNT(*) FILTER (WHERE 'rude' = ANY(string_to_array(tags, ','))) AS rude,
+			COUNT(*) FILTER (WHERE 'wrong_address' = ANY(string_to_array(tags, ','))) AS wrong_address
+		FROM customerrating GROUP BY user_id`)
+	checkErr(err, "Create view customerratingsummary failed")
+
+	// spatial index, earth_box prefilter of provider search uses it before the exact earth_distance
+	_, err = db.Exec(`CREATE EXTENSION IF NOT EXISTS cube`)
+	checkErr(err, "Create extension cube failed")
+
+	_, err = db.Exec(`CREATE EXTENSION IF NOT EXISTS earthdistance`)
+	checkErr(err, "Create extension earthdistance failed")
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS providerlocation_earth_idx
+		ON providerlocation USING gist (ll_to_earth(latitude, longitude))`)
+	checkErr(err, "Create provider location index failed")
+
+	// one unresolved dispute per order, status 3 is resolved
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS orderdispute_open_idx
+		ON orderdispute(order_id) WHERE status <> 3`)
+	checkErr(err, "Create open dispute index failed")
+
+	// supplement charge of the amount due above the order payment, one unfailed per payment
+	ensureColumn("payment", "supplement_of", "bigint", "0")
+
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS payment_supplement_idx
+		ON payment(supplement_of) WHERE supplement_of <> 0 AND status <> 3`)
+	checkErr(err, "Create payment supplement index failed")
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= ORDER AMENDMENT
+
+/**
+Order amendment, line items proposed by provider during the job
+Id
+OrderId
+ProviderId
+BaseRevision	revision the proposal was made against
+Revision	revision of proposed ordervendordetail rows
+Status		0 = waiting customer, 1 = approved, 2 = rejected, 3 = superseded
+Note
+TotalPrice	total of proposed line items
+CreatedDate
+RespondedDate
+*/
+type OrderAmendment struct {
+	Id            int64  `db:"id" json:"id"`
+	OrderId       int64  `db:"order_id" json:"order_id"`
+	ProviderId    int64  `db:"provider_id" json:"provider_id"`
+	BaseRevision  int64  `db:"base_revision" json:"base_revision"`
+	Revision      int64  `db:"revision" json:"revision"`
+	Status        int64  `db:"status" json:"status"`
+	Note          string `db:"note" json:"note"`
+	TotalPrice    int64  `db:"total_price" json:"total_price"`
+	CreatedDate   int64  `db:"created_date" json:"created_date"`
+	RespondedDate int64  `db:"responded_date" json:"responded_date"`
+}
+
+type PostAmendment struct {
+	OrderId int64                   `json:"order_id"`
+	Note    string                  `json:"note"`
+	Items   []PostTransactionDetail `json:"items"`
+}
+
+type PostAmendmentResponse struct {
+	AmendmentId int64 `json:"amendment_id"`
+}
+
+type OrderAmendmentItem struct {
+	OrderAmendment
+	Items []OrderDetailItem `json:"items"`
+}
+
+const (
+	amendmentWaiting    = 0
+	amendmentApproved   = 1
+	amendmentRejected   = 2
+	amendmentSuperseded = 3
+)
+
+// isOrderAmendable provider arrived or working
+func isOrderAmendable(orderId int64) bool {
+	status, err := getOrderStatus(orderId)
+
+	return err == nil && (status == 3 || status == 4)
+}
+
+// PostProviderAmendment provider propose the complete new list of line items,
+// a waiting proposal of the same order is superseded
+func PostProviderAmendment(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var postAmendment PostAmendment
+	c.Bind(&postAmendment)
+
+	var orderVendor OrderVendor
+	err := dbmap.SelectOne(&orderVendor, `SELECT id, current_revision FROM ordervendor
+		WHERE id=$1 AND provider_id=$2`, postAmendment.OrderId, providerId)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	if !isOrderAmendable(orderVendor.Id) {
+		c.JSON(400, gin.H{"error": "Pesanan hanya dapat diubah saat penyedia jasa tiba atau sedang bekerja"})
+		return
+	}
+
+	if len(postAmendment.Items) == 0 {
+		c.JSON(400, gin.H{"error": "Daftar layanan tidak boleh kosong"})
+		return
+	}
+
+	var totalPrice int64
+	for _, item := range postAmendment.Items {
+		if item.Qty <= 0 || item.ServicePrice < 0 {
+			c.JSON(400, gin.H{"error": "Jumlah atau harga layanan tidak valid"})
+			return
+		}
+		totalPrice += item.ServicePrice * item.Qty
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+	defer tx.Rollback()
+
+	// serialize proposals of the same order
+	if _, err := tx.Exec(`SELECT id FROM ordervendor WHERE id=$1 FOR UPDATE`, orderVendor.Id); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	now := time.Now().Unix()
+
+	var revision int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(revision), 0) + 1 FROM ordervendordetail
+		WHERE order_id=$1`, orderVendor.Id).Scan(&revision); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	tx.Exec(`UPDATE orderamendment SET status=$1, responded_date=$2 WHERE order_id=$3 AND status=$4`,
+		amendmentSuperseded, now, orderVendor.Id, amendmentWaiting)
+
+	for _, item := range postAmendment.Items {
+		if _, err := tx.Exec(`INSERT INTO ordervendordetail(order_id, jasa_id, service_name,
+			service_price, qty, modified_date, revision)
+			VALUES($1, $2, $3, $4, $5, $6, $7)`, orderVendor.Id, item.JasaId, item.ServiceName,
+			item.ServicePrice, item.Qty, now, revision); err != nil {
+			c.JSON(400, gin.H{"error": "insert failed"})
+			return
+		}
+	}
+
+	var amendmentId int64
+	if err := tx.QueryRow(`INSERT INTO orderamendment(order_id, provider_id, base_revision, revision,
+		status, note, total_price, created_date, responded_date)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, 0) RETURNING id`, orderVendor.Id, providerId,
+		orderVendor.CurrentRevision, revision, amendmentWaiting, postAmendment.Note, totalPrice,
+		now).Scan(&amendmentId); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	publishOrderEvent(orderVendor.Id, orderEventAmendment, gin.H{
+		"order_id":     orderVendor.Id,
+		"amendment_id": amendmentId,
+		"status":       amendmentWaiting,
+	})
+
+	pushToCustomer(orderVendor.Id, map[string]string{
+		"message":      "Penyedia jasa mengajukan perubahan pesanan. Mohon periksa dan setujui.",
+		"type":         "amendment",
+		"order_id":     strconv.FormatInt(orderVendor.Id, 10),
+		"amendment_id": strconv.FormatInt(amendmentId, 10),
+	})
+
+	c.JSON(200, PostAmendmentResponse{AmendmentId: amendmentId})
+}
+
+// GetUserAmendments amendments of customer order
+func GetUserAmendments(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+	orderId, _ := strconv.ParseInt(c.Params.ByName("order_id"), 10, 64)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND user_id=$2`,
+		orderId, userId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	responseOrderAmendments(c, orderId)
+}
+
+// GetProviderAmendments amendments of provider order
+func GetProviderAmendments(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+	orderId, _ := strconv.ParseInt(c.Params.ByName("order_id"), 10, 64)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND provider_id=$2`,
+		orderId, providerId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	responseOrderAmendments(c, orderId)
+}
+
+func responseOrderAmendments(c *gin.Context, orderId int64) {
+	var amendments []OrderAmendment
+	_, err := dbmap.Select(&amendments, `SELECT * FROM orderamendment
+		WHERE order_id=$1 ORDER BY id DESC`, orderId)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	items := []OrderAmendmentItem{}
+	for _, amendment := range amendments {
+		var orderDetail []OrderDetailItem
+		_, errDetail := dbmap.Select(&orderDetail, `SELECT jasa_id, service_name, service_price,
+			qty, modified_date
+			FROM ordervendordetail WHERE order_id=$1 AND revision=$2`, orderId, amendment.Revision)
+
+		if errDetail != nil {
+			c.JSON(400, gin.H{"error": "select failed"})
+			return
+		}
+
+		items = append(items, OrderAmendmentItem{OrderAmendment: amendment, Items: orderDetail})
+	}
+
+	c.JSON(200, gin.H{"data": items})
+}
+
+// PostApproveAmendment customer approve proposal, its revision becomes the order details
+func PostApproveAmendment(c *gin.Context) {
+	respondAmendment(c, amendmentApproved)
+}
+
+// PostRejectAmendment customer reject proposal, order details stay unchanged
+func PostRejectAmendment(c *gin.Context) {
+	respondAmendment(c, amendmentRejected)
+}
+
+func respondAmendment(c *gin.Context, status int64) {
+	userId := getUserIdFromToken(c)
+
+	var response PostAmendmentResponse
+	c.Bind(&response)
+
+	var amendment OrderAmendment
+	err := dbmap.SelectOne(&amendment, `SELECT oa.* FROM orderamendment oa
+		JOIN ordervendor ov ON ov.id = oa.order_id
+		WHERE oa.id=$1 AND ov.user_id=$2`, response.AmendmentId, userId)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Perubahan pesanan tidak ditemukan"})
+		return
+	}
+
+	if status == amendmentApproved && !isOrderAmendable(amendment.OrderId) {
+		c.JSON(400, gin.H{"error": "Pesanan sudah tidak dapat diubah"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE orderamendment SET status=$1, responded_date=$2
+		WHERE id=$3 AND status=$4`, status, time.Now().Unix(), amendment.Id, amendmentWaiting)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(409, gin.H{"error": "Perubahan pesanan sudah ditanggapi"})
+		return
+	}
+
+	if status == amendmentApproved {
+		result, err = tx.Exec(`UPDATE ordervendor SET current_revision=$1
+			WHERE id=$2 AND current_revision=$3`, amendment.Revision, amendment.OrderId,
+			amendment.BaseRevision)
+
+		if err != nil {
+			c.JSON(400, gin.H{"error": "update failed"})
+			return
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			c.JSON(409, gin.H{"error": "Pesanan sudah berubah"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	publishOrderEvent(amendment.OrderId, orderEventAmendment, gin.H{
+		"order_id":     amendment.OrderId,
+		"amendment_id": amendment.Id,
+		"status":       status,
+	})
+
+	message := "Pelanggan menyetujui perubahan pesanan."
+	if status == amendmentRejected {
+		message = "Pelanggan menolak perubahan pesanan."
+	}
+
+	pushToProvider(amendment.OrderId, map[string]string{
+		"message":      message,
+		"type":         "amendment",
+		"order_id":     strconv.FormatInt(amendment.OrderId, 10),
+		"amendment_id": strconv.FormatInt(amendment.Id, 10),
+	})
+
+	c.JSON(200, gin.H{"status": "Success", "amendment_id": amendment.Id, "amendment_status": status})
+}
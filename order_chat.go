@@ -0,0 +1,265 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= ORDER CHAT
+
+/**
+Order message, chat thread between customer and provider of an order
+Id
+OrderId
+SenderType	1 = customer, 2 = provider
+SenderId	user_id or provider_id
+Body
+ImageUrl	image attachment
+CreatedDate
+DeliveredDate	0 = not yet fetched by the other party
+ReadDate	0 = not yet read by the other party
+*/
+type OrderMessage struct {
+	Id            int64  `db:"id" json:"id"`
+	OrderId       int64  `db:"order_id" json:"order_id"`
+	SenderType    int8   `db:"sender_type" json:"sender_type"`
+	SenderId      int64  `db:"sender_id" json:"sender_id"`
+	Body          string `db:"body" json:"body"`
+	ImageUrl      string `db:"image_url" json:"image_url"`
+	CreatedDate   int64  `db:"created_date" json:"created_date"`
+	DeliveredDate int64  `db:"delivered_date" json:"delivered_date"`
+	ReadDate      int64  `db:"read_date" json:"read_date"`
+}
+
+type PostOrderMessage struct {
+	OrderId  int64  `json:"order_id"`
+	Body     string `json:"body"`
+	ImageUrl string `json:"image_url"`
+}
+
+type PostOrderMessageRead struct {
+	OrderId   int64 `json:"order_id"`
+	MessageId int64 `json:"message_id"`
+}
+
+const (
+	messageFromCustomer = 1
+	messageFromProvider = 2
+)
+
+// isOrderChatLocked thread is read-only once order is complete or canceled
+func isOrderChatLocked(orderId int64) bool {
+	status, err := getOrderStatus(orderId)
+
+	return err != nil || status >= 6
+}
+
+// PostUserOrderMessage customer send message to provider of the order
+func PostUserOrderMessage(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	var postMessage PostOrderMessage
+	c.Bind(&postMessage)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor
+		WHERE id=$1 AND user_id=$2 AND provider_id <> 0`, postMessage.OrderId, userId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	sendOrderMessage(c, postMessage, messageFromCustomer, userId)
+}
+
+// PostProviderOrderMessage provider send message to customer of the order
+func PostProviderOrderMessage(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var postMessage PostOrderMessage
+	c.Bind(&postMessage)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND provider_id=$2`,
+		postMessage.OrderId, providerId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	sendOrderMessage(c, postMessage, messageFromProvider, providerId)
+}
+
+func sendOrderMessage(c *gin.Context, postMessage PostOrderMessage, senderType int8, senderId int64) {
+	if postMessage.Body == "" && postMessage.ImageUrl == "" {
+		c.JSON(400, gin.H{"error": "Pesan tidak boleh kosong"})
+		return
+	}
+
+	if isOrderChatLocked(postMessage.OrderId) {
+		c.JSON(403, gin.H{"error": "Percakapan sudah ditutup"})
+		return
+	}
+
+	message := OrderMessage{
+		OrderId:     postMessage.OrderId,
+		SenderType:  senderType,
+		SenderId:    senderId,
+		Body:        postMessage.Body,
+		ImageUrl:    postMessage.ImageUrl,
+		CreatedDate: time.Now().Unix(),
+	}
+
+	if err := db.QueryRow(`INSERT INTO ordermessage(order_id, sender_type, sender_id, body,
+		image_url, created_date, delivered_date, read_date)
+		VALUES($1, $2, $3, $4, $5, $6, 0, 0) RETURNING id`, message.OrderId, message.SenderType,
+		message.SenderId, message.Body, message.ImageUrl,
+		message.CreatedDate).Scan(&message.Id); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	publishOrderEvent(message.OrderId, orderEventMessage, message)
+
+	preview := message.Body
+	if preview == "" {
+		preview = "Mengirim gambar"
+	}
+
+	data := map[string]string{
+		"message":    preview,
+		"type":       "chat",
+		"order_id":   strconv.FormatInt(message.OrderId, 10),
+		"message_id": strconv.FormatInt(message.Id, 10),
+	}
+
+	if senderType == messageFromCustomer {
+		pushToProvider(message.OrderId, data)
+	} else {
+		pushToCustomer(message.OrderId, data)
+	}
+
+	c.JSON(200, gin.H{"data": message})
+}
+
+// GetUserOrderMessages thread of customer order, marks provider messages as delivered
+func GetUserOrderMessages(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+	orderId, _ := strconv.ParseInt(c.Params.ByName("order_id"), 10, 64)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND user_id=$2`,
+		orderId, userId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	markOrderMessagesDelivered(orderId, messageFromProvider)
+	responseOrderMessages(c, orderId)
+}
+
+// GetProviderOrderMessages thread of provider order, marks customer messages as delivered
+func GetProviderOrderMessages(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+	orderId, _ := strconv.ParseInt(c.Params.ByName("order_id"), 10, 64)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND provider_id=$2`,
+		orderId, providerId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	markOrderMessagesDelivered(orderId, messageFromCustomer)
+	responseOrderMessages(c, orderId)
+}
+
+// GetAdminOrderMessages thread of any order for dispute handling, receipts untouched
+func GetAdminOrderMessages(c *gin.Context) {
+	orderId, _ := strconv.ParseInt(c.Params.ByName("order_id"), 10, 64)
+
+	responseOrderMessages(c, orderId)
+}
+
+func responseOrderMessages(c *gin.Context, orderId int64) {
+	var messages []OrderMessage
+	_, err := dbmap.Select(&messages, `SELECT * FROM ordermessage
+		WHERE order_id=$1 ORDER BY id ASC`, orderId)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": messages, "locked": isOrderChatLocked(orderId)})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+func markOrderMessagesDelivered(orderId int64, senderType int8) {
+	db.Exec(`UPDATE ordermessage SET delivered_date=$1
+		WHERE order_id=$2 AND sender_type=$3 AND delivered_date=0`,
+		time.Now().Unix(), orderId, senderType)
+}
+
+// PostUserOrderMessageRead customer read provider messages up to message_id
+func PostUserOrderMessageRead(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	var postRead PostOrderMessageRead
+	c.Bind(&postRead)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND user_id=$2`,
+		postRead.OrderId, userId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	markOrderMessagesRead(c, postRead, messageFromProvider)
+}
+
+// PostProviderOrderMessageRead provider read customer messages up to message_id
+func PostProviderOrderMessageRead(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var postRead PostOrderMessageRead
+	c.Bind(&postRead)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND provider_id=$2`,
+		postRead.OrderId, providerId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	markOrderMessagesRead(c, postRead, messageFromCustomer)
+}
+
+func markOrderMessagesRead(c *gin.Context, postRead PostOrderMessageRead, senderType int8) {
+	now := time.Now().Unix()
+
+	result, err := db.Exec(`UPDATE ordermessage
+		SET read_date=$1, delivered_date=CASE WHEN delivered_date=0 THEN $1 ELSE delivered_date END
+		WHERE order_id=$2 AND sender_type=$3 AND id <= $4 AND read_date=0`,
+		now, postRead.OrderId, senderType, postRead.MessageId)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		publishOrderEvent(postRead.OrderId, orderEventMessageRead, gin.H{
+			"order_id":    postRead.OrderId,
+			"sender_type": senderType,
+			"message_id":  postRead.MessageId,
+			"read_date":   now,
+		})
+	}
+
+	c.JSON(200, gin.H{"status": "Success read messages"})
+}
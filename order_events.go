@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/manucorporat/sse"
+)
+
+// ========================= ORDER EVENTS
+
+/**
+Order event, change of order which is streamed to both parties
+Id
+OrderId
+EventType	journey, tracking, cancel, message, message_read, amendment, payment
+Data		json payload
+CreatedDate
+*/
+type OrderEvent struct {
+	Id          int64  `db:"id" json:"id"`
+	OrderId     int64  `db:"order_id" json:"order_id"`
+	EventType   string `db:"event_type" json:"event_type"`
+	Data        string `db:"data" json:"data"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+type OrderEventItem struct {
+	Id          int64           `json:"id"`
+	OrderId     int64           `json:"order_id"`
+	EventType   string          `json:"event_type"`
+	Data        json.RawMessage `json:"data"`
+	CreatedDate int64           `json:"created_date"`
+}
+
+const (
+	orderEventJourney     = "journey"
+	orderEventTracking    = "tracking"
+	orderEventCancel      = "cancel"
+	orderEventMessage     = "message"
+	orderEventMessageRead = "message_read"
+	orderEventAmendment   = "amendment"
+	orderEventPayment     = "payment"
+)
+
+// OrderEventHub deliver order events to subscribers connected to this instance
+type OrderEventHub struct {
+	sync.Mutex
+	subscribers map[int64]map[chan OrderEvent]bool
+}
+
+var orderEventHub = &OrderEventHub{subscribers: make(map[int64]map[chan OrderEvent]bool)}
+
+func (h *OrderEventHub) Subscribe(orderId int64) chan OrderEvent {
+	h.Lock()
+	defer h.Unlock()
+
+	ch := make(chan OrderEvent, 16)
+
+	if h.subscribers[orderId] == nil {
+		h.subscribers[orderId] = make(map[chan OrderEvent]bool)
+	}
+	h.subscribers[orderId][ch] = true
+
+	return ch
+}
+
+func (h *OrderEventHub) Unsubscribe(orderId int64, ch chan OrderEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.subscribers[orderId], ch)
+	if len(h.subscribers[orderId]) == 0 {
+		delete(h.subscribers, orderId)
+	}
+}
+
+// Broadcast never blocks, a full channel already has a wake up pending
+func (h *OrderEventHub) Broadcast(event OrderEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	for ch := range h.subscribers[event.OrderId] {
+		select {
+		case ch <- event:
+		default:
+			log.Println("Drop order event for slow subscriber", event.Id)
+		}
+	}
+}
+
+func (event OrderEvent) Item() OrderEventItem {
+	return OrderEventItem{
+		Id:          event.Id,
+		OrderId:     event.OrderId,
+		EventType:   event.EventType,
+		Data:        json.RawMessage(event.Data),
+		CreatedDate: event.CreatedDate,
+	}
+}
+
+// publishOrderEvent persist order event and fan it out to every instance through the event bus
+func publishOrderEvent(orderId int64, eventType string, data interface{}) {
+	topic := topicOrderStatus
+	switch eventType {
+	case orderEventTracking:
+		topic = topicTrackingUpdated
+	case orderEventMessage, orderEventMessageRead:
+		topic = topicOrderMessage
+	case orderEventPayment:
+		topic = topicPaymentStatus
+	}
+
+	publishOrderEventTopic(topic, orderId, eventType, data)
+}
+
+func publishOrderEventTopic(topic string, orderId int64, eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Println("Marshal order event failed", err)
+		return
+	}
+
+	event := OrderEvent{
+		OrderId:     orderId,
+		EventType:   eventType,
+		Data:        string(payload),
+		CreatedDate: time.Now().Unix(),
+	}
+
+	if err := db.QueryRow(`INSERT INTO orderevent(order_id, event_type, data, created_date)
+		VALUES($1, $2, $3, $4) RETURNING id`, event.OrderId, event.EventType, event.Data,
+		event.CreatedDate).Scan(&event.Id); err != nil {
+		log.Println("Insert order event failed", err)
+		return
+	}
+
+	publishEvent(topic, orderId, 0, event)
+}
+
+func publishOrderJourney(orderId int64, status int64) {
+	topic := topicOrderStatus
+	if status == 0 {
+		topic = topicOrderCreated
+	}
+
+	publishOrderEventTopic(topic, orderId, orderEventJourney, gin.H{
+		"order_id": orderId,
+		"status":   status,
+		"message":  getMessageBasedStatusForCustomer(status),
+	})
+}
+
+func publishOrderCancel(orderId int64, canceledBy int8, message string) {
+	publishOrderEvent(orderId, orderEventCancel, gin.H{
+		"order_id":    orderId,
+		"canceled_by": canceledBy,
+		"message":     message,
+	})
+}
+
+func getOrderEventsAfter(orderId int64, lastEventId int64) ([]OrderEvent, error) {
+	var events []OrderEvent
+	_, err := dbmap.Select(&events, `SELECT * FROM orderevent
+		WHERE order_id=$1 AND id > $2 ORDER BY id ASC`, orderId, lastEventId)
+
+	return events, err
+}
+
+// isOrderParty token belongs to customer or provider of the order, the route has no auth
+// middleware so expired customer tokens are rejected here
+func isOrderParty(c *gin.Context, orderId int64) bool {
+	var authToken AuthToken
+	if err := dbmap.SelectOne(&authToken, `SELECT id, user_id, expired_date FROM authtoken
+		WHERE auth_token=$1`, getTokenFromHeader(c)); err == nil {
+		if time.Now().Unix() >= authToken.ExpireDate {
+			removeExpiredToken(authToken.Id)
+			return false
+		}
+
+		count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND user_id=$2`,
+			orderId, authToken.UserId)
+		return err == nil && count > 0
+	}
+
+	if providerId := getProviderIdFromToken(c); providerId != -1 {
+		count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND provider_id=$2`,
+			orderId, providerId)
+		return err == nil && count > 0
+	}
+
+	return false
+}
+
+// GetOrderEvents stream order events, or long-poll when mode=poll
+func GetOrderEvents(c *gin.Context) {
+	orderId, _ := strconv.ParseInt(c.Params.ByName("order_id"), 10, 64)
+
+	if !isOrderParty(c, orderId) {
+		c.JSON(401, gin.H{"error": "Unauthorize request. Invalid auth token."})
+		return
+	}
+
+	lastEventId, _ := strconv.ParseInt(c.Request.Header.Get("Last-Event-ID"), 10, 64)
+	if lastEventId == 0 {
+		lastEventId, _ = strconv.ParseInt(c.Query("last_event_id"), 10, 64)
+	}
+
+	// subscribe before reading backlog so no event is missed in between,
+	// live event only wakes up the reader, events are always read from table
+	ch := orderEventHub.Subscribe(orderId)
+	defer orderEventHub.Unsubscribe(orderId, ch)
+
+	if c.Query("mode") == "poll" {
+		pollOrderEvents(c, orderId, ch, lastEventId)
+	} else {
+		streamOrderEvents(c, orderId, ch, lastEventId)
+	}
+}
+
+func pollOrderEvents(c *gin.Context, orderId int64, ch chan OrderEvent, lastEventId int64) {
+	events, err := getOrderEventsAfter(orderId, lastEventId)
+
+	if err == nil && len(events) == 0 {
+		select {
+		case <-ch:
+			events, err = getOrderEventsAfter(orderId, lastEventId)
+		case <-time.After(time.Duration(getEnvInt64("ORDER_EVENT_POLL_TIMEOUT", 25)) * time.Second):
+		case <-c.Writer.CloseNotify():
+			return
+		}
+	}
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	items := []OrderEventItem{}
+	for _, event := range events {
+		items = append(items, event.Item())
+		lastEventId = event.Id
+	}
+
+	c.JSON(200, gin.H{"data": items, "last_event_id": lastEventId})
+}
+
+func streamOrderEvents(c *gin.Context, orderId int64, ch chan OrderEvent, lastEventId int64) {
+	header := c.Writer.Header()
+	header.Set("Content-Type", sse.ContentType)
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(200)
+
+	heartbeat := time.NewTicker(time.Duration(getEnvInt64("ORDER_EVENT_HEARTBEAT", 15)) * time.Second)
+	defer heartbeat.Stop()
+
+	clientGone := c.Writer.CloseNotify()
+	pending := true
+
+	c.Stream(func(w io.Writer) bool {
+		if pending {
+			events, err := getOrderEventsAfter(orderId, lastEventId)
+			if err != nil {
+				return false
+			}
+
+			for _, event := range events {
+				writeOrderEvent(w, event)
+				lastEventId = event.Id
+			}
+			pending = false
+			return true
+		}
+
+		select {
+		case <-ch:
+			pending = true
+		case <-heartbeat.C:
+			io.WriteString(w, ": heartbeat\n\n")
+		case <-clientGone:
+			return false
+		}
+
+		return true
+	})
+}
+
+func writeOrderEvent(w io.Writer, event OrderEvent) {
+	sse.Encode(w, sse.Event{
+		Id:    strconv.FormatInt(event.Id, 10),
+		Event: event.EventType,
+		Data:  event.Data,
+	})
+}
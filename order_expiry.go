@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= ORDER EXPIRY
+
+/**
+Order expiry rule per kategori jasa
+Id
+JasaId
+ConfirmWindow	seconds an order may wait in status 0
+OfferNext	1 = offer next nearest online provider to customer
+*/
+type OrderExpiryRule struct {
+	Id            int64 `db:"id" json:"id"`
+	JasaId        int64 `db:"jasa_id" json:"jasa_id"`
+	ConfirmWindow int64 `db:"confirm_window" json:"confirm_window"`
+	OfferNext     int64 `db:"offer_next" json:"offer_next"`
+}
+
+type ExpiredOrder struct {
+	OrderId         int64   `db:"order_id"`
+	ProviderId      int64   `db:"provider_id"`
+	JasaId          int64   `db:"jasa_id"`
+	DestinationLat  float64 `db:"destination_lat"`
+	DestinationLong float64 `db:"destination_long"`
+	OfferNext       int64   `db:"offer_next"`
+}
+
+type SuggestedProvider struct {
+	Id       int64   `db:"id" json:"id"`
+	Nama     string  `db:"nama" json:"nama"`
+	Distance float64 `db:"distance" json:"distance"`
+}
+
+const expiredOrderMessage = "Pesanan dibatalkan otomatis karena tidak dikonfirmasi penyedia jasa."
+
+// PostOrderExpiryRule create or update confirmation window of a kategori jasa
+func PostOrderExpiryRule(c *gin.Context) {
+	var rule OrderExpiryRule
+	c.Bind(&rule)
+
+	if rule.ConfirmWindow <= 0 {
+		c.JSON(400, gin.H{"error": "confirm_window harus lebih dari 0"})
+		return
+	}
+
+	var recRule OrderExpiryRule
+	err := dbmap.SelectOne(&recRule, `SELECT * FROM orderexpiryrule WHERE jasa_id=$1`,
+		rule.JasaId)
+
+	if err == nil {
+		if _, errUpdate := db.Exec(`UPDATE orderexpiryrule SET confirm_window=$1, offer_next=$2
+			WHERE jasa_id=$3`, rule.ConfirmWindow, rule.OfferNext, rule.JasaId); errUpdate == nil {
+			rule.Id = recRule.Id
+			c.JSON(200, rule)
+		} else {
+			c.JSON(400, gin.H{"error": "update failed"})
+		}
+	} else {
+		if insert := db.QueryRow(`INSERT INTO orderexpiryrule(jasa_id, confirm_window, offer_next)
+			VALUES($1, $2, $3) RETURNING id`, rule.JasaId, rule.ConfirmWindow,
+			rule.OfferNext); insert.Scan(&rule.Id) == nil {
+			c.JSON(200, rule)
+		} else {
+			c.JSON(400, gin.H{"error": "insert failed"})
+		}
+	}
+}
+
+// GetOrderExpiryRules list configured confirmation windows
+func GetOrderExpiryRules(c *gin.Context) {
+	var rules []OrderExpiryRule
+	_, err := dbmap.Select(&rules, `SELECT * FROM orderexpiryrule ORDER BY jasa_id ASC`)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": rules, "default_confirm_window": defaultConfirmWindow()})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+func defaultConfirmWindow() int64 {
+	return getEnvInt64("ORDER_CONFIRM_WINDOW", 900)
+}
+
+// runOrderExpiryWorker periodically cancel orders which are never confirmed
+func runOrderExpiryWorker() {
+	interval := time.Duration(getEnvInt64("ORDER_EXPIRY_INTERVAL", 60)) * time.Second
+
+	for range time.Tick(interval) {
+		runLocked(workerLockOrderExpiry, expireUnconfirmedOrders)
+	}
+}
+
+func expireUnconfirmedOrders() {
+	var expiredOrders []ExpiredOrder
+	_, err := dbmap.Select(&expiredOrders,
+		`SELECT ov.id as order_id, ov.provider_id, pd.jasa_id,
+			ov.destination_lat, ov.destination_long,
+			COALESCE(oer.offer_next, 1) as offer_next
+		FROM ordervendor ov
+			JOIN providerdata pd ON pd.id = ov.provider_id
+			JOIN (SELECT order_id, MAX(status) as status, MAX(date) as date
+				FROM ordervendorjourney GROUP BY order_id) as ouj ON ouj.order_id = ov.id
+			LEFT JOIN orderexpiryrule oer ON oer.jasa_id = pd.jasa_id
+		WHERE ouj.status = 0
+			AND ouj.date + COALESCE(oer.confirm_window, $1) <= $2`,
+		defaultConfirmWindow(), time.Now().Unix())
+
+	if err != nil {
+		log.Println("Select expired order failed", err)
+		return
+	}
+
+	for _, expiredOrder := range expiredOrders {
+		expireOrder(expiredOrder)
+	}
+}
+
+func expireOrder(expiredOrder ExpiredOrder) {
+	order, err := getCancelOrderInfo(expiredOrder.OrderId)
+	if err != nil {
+		return
+	}
+
+	// fails when provider responded in the meantime
+	if _, err := cancelOrder(order, canceledBySystem, getCancelReasonId("system_confirm_timeout"),
+		expiredOrderMessage); err != nil {
+		return
+	}
+
+	log.Println("System cancel unconfirmed order", expiredOrder.OrderId)
+
+	orderId := strconv.FormatInt(expiredOrder.OrderId, 10)
+
+	pushToProvider(expiredOrder.OrderId, map[string]string{
+		"message":  "Pesanan dibatalkan karena melewati batas waktu konfirmasi.",
+		"order_id": orderId,
+	})
+
+	data := map[string]string{
+		"message":  expiredOrderMessage,
+		"order_id": orderId,
+	}
+
+	if expiredOrder.OfferNext == 1 {
+		if suggested, errSuggest := findNextNearestProvider(expiredOrder); errSuggest == nil {
+			data["message"] = expiredOrderMessage + " " + suggested.Nama + " siap melayani Anda."
+			data["suggested_provider_id"] = strconv.FormatInt(suggested.Id, 10)
+			data["suggested_provider_name"] = suggested.Nama
+		}
+	}
+
+	pushToCustomer(expiredOrder.OrderId, data)
+}
+
+// findNextNearestProvider nearest online provider with same jasa, except the expired one,
+// KNN order walks the GiST index from the destination instead of measuring every provider
+func findNextNearestProvider(expiredOrder ExpiredOrder) (SuggestedProvider, error) {
+	var suggested SuggestedProvider
+	err := dbmap.SelectOne(&suggested,
+		`SELECT pd.id, pd.nama,
+			earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) AS distance
+		FROM providerlocation pl
+			JOIN providerdata pd ON pd.id = pl.provider_id
+			JOIN provideraccount pa ON pa.provider_id = pd.id
+		WHERE pd.jasa_id=$3 AND pd.id <> $4
+			AND pa.status = 1 AND pa.approved = 1
+			AND (COALESCE(pa.max_distance, 0) = 0
+				OR earth_distance(ll_to_earth($1, $2), ll_to_earth(pl.latitude, pl.longitude)) <= pa.max_distance)
+		ORDER BY ll_to_earth(pl.latitude, pl.longitude) <-> ll_to_earth($1, $2)
+		LIMIT 1`, expiredOrder.DestinationLat, expiredOrder.DestinationLong,
+		expiredOrder.JasaId, expiredOrder.ProviderId)
+
+	return suggested, err
+}
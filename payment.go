@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= PAYMENT
+
+/**
+Payment of an order, the latest one is the active payment
+Id
+OrderId
+Method		0 = cash on completion, 1 = bank virtual account, 2 = e-wallet
+Gateway		name of gateway, cash for cash payment
+ChargeId	reference of charge in gateway
+Amount
+Status		0 = pending, 1 = authorized, 2 = captured, 3 = failed, 4 = refunded
+SupplementOf	payment this one charges the rest of, 0 for the order payment
+VaNumber
+CheckoutUrl
+FailureReason
+ExpiryDate
+CreatedDate
+UpdatedDate
+*/
+type Payment struct {
+	Id            int64  `db:"id" json:"id"`
+	OrderId       int64  `db:"order_id" json:"order_id"`
+	Method        int64  `db:"method" json:"method"`
+	Gateway       string `db:"gateway" json:"gateway"`
+	ChargeId      string `db:"charge_id" json:"charge_id"`
+	Amount        int64  `db:"amount" json:"amount"`
+	Status        int64  `db:"status" json:"status"`
+	SupplementOf  int64  `db:"supplement_of" json:"supplement_of"`
+	VaNumber      string `db:"va_number" json:"va_number"`
+	CheckoutUrl   string `db:"checkout_url" json:"checkout_url"`
+	FailureReason string `db:"failure_reason" json:"failure_reason"`
+	ExpiryDate    int64  `db:"expiry_date" json:"expiry_date"`
+	CreatedDate   int64  `db:"created_date" json:"created_date"`
+	UpdatedDate   int64  `db:"updated_date" json:"updated_date"`
+}
+
+/**
+Payment log, every transition of payment state machine
+Id
+PaymentId
+FromStatus
+ToStatus
+Source		gateway, webhook, cash, cancel
+Reference	webhook event id
+CreatedDate
+*/
+type PaymentLog struct {
+	Id          int64  `db:"id" json:"id"`
+	PaymentId   int64  `db:"payment_id" json:"payment_id"`
+	FromStatus  int64  `db:"from_status" json:"from_status"`
+	ToStatus    int64  `db:"to_status" json:"to_status"`
+	Source      string `db:"source" json:"source"`
+	Reference   string `db:"reference" json:"reference"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+type PostRetryPayment struct {
+	OrderId int64 `json:"order_id"`
+}
+
+const (
+	paymentMethodCash           = 0
+	paymentMethodVirtualAccount = 1
+	paymentMethodEWallet        = 2
+)
+
+const (
+	paymentPending    = 0
+	paymentAuthorized = 1
+	paymentCaptured   = 2
+	paymentFailed     = 3
+	paymentRefunded   = 4
+)
+
+// paymentTransitions allowed next statuses of each payment status
+var paymentTransitions = map[int64][]int64{
+	paymentPending:    {paymentAuthorized, paymentCaptured, paymentFailed},
+	paymentAuthorized: {paymentCaptured, paymentFailed, paymentRefunded},
+	paymentCaptured:   {paymentRefunded},
+}
+
+var paymentGatewayStatus = map[string]int64{
+	"pending":    paymentPending,
+	"authorized": paymentAuthorized,
+	"captured":   paymentCaptured,
+	"failed":     paymentFailed,
+	"expired":    paymentFailed,
+	"voided":     paymentFailed,
+}
+
+var paymentGatewayMethod = map[int64]string{
+	paymentMethodVirtualAccount: "virtual_account",
+	paymentMethodEWallet:        "ewallet",
+}
+
+func isPaymentMethod(method int) bool {
+	return method == paymentMethodCash || paymentGatewayMethod[int64(method)] != ""
+}
+
+func canTransitionPayment(fromStatus int64, toStatus int64) bool {
+	for _, status := range paymentTransitions[fromStatus] {
+		if status == toStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionPayment move payment through the state machine, guarded against concurrent change
+func transitionPayment(payment Payment, toStatus int64, source string, reference string) (Payment, error) {
+	if !canTransitionPayment(payment.Status, toStatus) {
+		return payment, errors.New("Status pembayaran tidak dapat diubah")
+	}
+
+	now := time.Now().Unix()
+	result, err := db.Exec(`UPDATE payment SET status=$1, updated_date=$2 WHERE id=$3 AND status=$4`,
+		toStatus, now, payment.Id, payment.Status)
+	if err != nil {
+		return payment, err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return payment, errors.New("Status pembayaran sudah berubah")
+	}
+
+	db.Exec(`INSERT INTO paymentlog(payment_id, from_status, to_status, source, reference, created_date)
+		VALUES($1, $2, $3, $4, $5, $6)`, payment.Id, payment.Status, toStatus, source, reference, now)
+
+	payment.Status = toStatus
+	payment.UpdatedDate = now
+
+	if toStatus == paymentCaptured && payment.Method != paymentMethodCash {
+		if err := postPaymentLedger(payment); err != nil {
+			log.Println("Post payment ledger failed", payment.Id, err)
+		}
+	}
+
+	publishOrderEvent(payment.OrderId, orderEventPayment, gin.H{
+		"order_id":   payment.OrderId,
+		"payment_id": payment.Id,
+		"status":     payment.Status,
+	})
+
+	return payment, nil
+}
+
+func getOrderPayment(orderId int64) (Payment, error) {
+	var payment Payment
+	err := dbmap.SelectOne(&payment, `SELECT * FROM payment WHERE order_id=$1 AND supplement_of=0
+		ORDER BY id DESC LIMIT 1`, orderId)
+	return payment, err
+}
+
+func getOrderTotal(orderId int64) (int64, error) {
+	return dbmap.SelectInt(`SELECT COALESCE(SUM(service_price * qty), 0)
+		FROM ordervendorcurrentdetail WHERE order_id=$1`, orderId)
+}
+
+// createOrderPayment open payment of order, non cash method is charged to the gateway
+func createOrderPayment(orderId int64, method int64) (Payment, error) {
+	amount, err := getOrderAmountDue(orderId)
+	if err != nil {
+		return Payment{}, err
+	}
+
+	return openPayment(orderId, method, amount, 0)
+}
+
+// openPayment insert payment of amount, supplementOf is the payment it charges the rest of
+func openPayment(orderId int64, method int64, amount int64, supplementOf int64) (Payment, error) {
+	now := time.Now().Unix()
+
+	payment := Payment{
+		OrderId:      orderId,
+		Method:       method,
+		Gateway:      "cash",
+		Amount:       amount,
+		Status:       paymentPending,
+		SupplementOf: supplementOf,
+		CreatedDate:  now,
+		UpdatedDate:  now,
+	}
+
+	if method != paymentMethodCash {
+		payment.Gateway = paymentGateway.Name()
+	}
+
+	if err := db.QueryRow(`INSERT INTO payment(order_id, method, gateway, charge_id, amount, status,
+		supplement_of, va_number, checkout_url, failure_reason, expiry_date, created_date, updated_date)
+		VALUES($1, $2, $3, '', $4, $5, $6, '', '', '', 0, $7, $8) RETURNING id`, payment.OrderId,
+		payment.Method, payment.Gateway, payment.Amount, payment.Status, payment.SupplementOf,
+		payment.CreatedDate, payment.UpdatedDate).Scan(&payment.Id); err != nil {
+		return payment, err
+	}
+
+	if method == paymentMethodCash {
+		return payment, nil
+	}
+
+	charge, err := paymentGateway.CreateCharge(ChargeRequest{
+		Reference: "order-" + strconv.FormatInt(orderId, 10) + "-" + strconv.FormatInt(payment.Id, 10),
+		Method:    paymentGatewayMethod[method],
+		Amount:    amount,
+	})
+
+	if err != nil {
+		log.Println("Create charge failed", orderId, err)
+		db.Exec(`UPDATE payment SET failure_reason=$1 WHERE id=$2`, err.Error(), payment.Id)
+		payment.FailureReason = err.Error()
+		return transitionPayment(payment, paymentFailed, "gateway", "")
+	}
+
+	payment.ChargeId = charge.ChargeId
+	payment.VaNumber = charge.VaNumber
+	payment.CheckoutUrl = charge.CheckoutUrl
+	payment.ExpiryDate = charge.ExpiryDate
+
+	db.Exec(`UPDATE payment SET charge_id=$1, va_number=$2, checkout_url=$3, expiry_date=$4
+		WHERE id=$5`, payment.ChargeId, payment.VaNumber, payment.CheckoutUrl, payment.ExpiryDate,
+		payment.Id)
+
+	if status, ok := paymentGatewayStatus[charge.Status]; ok && status != paymentPending {
+		return transitionPayment(payment, status, "gateway", "")
+	}
+
+	return payment, nil
+}
+
+// captureCharge capture authorized charge of payment for its amount
+func captureCharge(payment Payment) (Payment, error) {
+	charge, err := paymentGateway.Capture(payment.ChargeId, payment.Amount)
+	if err != nil {
+		return payment, err
+	}
+
+	if paymentGatewayStatus[charge.Status] != paymentCaptured {
+		return payment, errors.New("charge is " + charge.Status)
+	}
+
+	return transitionPayment(payment, paymentCaptured, "gateway", "")
+}
+
+// captureOrderPayment collect payment when order is complete, error when it is not captured.
+// The amount due is taken again since amendments may have changed it after the charge
+func captureOrderPayment(orderId int64) error {
+	payment, err := getOrderPayment(orderId)
+	if err != nil {
+		return err
+	}
+
+	amount, err := getOrderAmountDue(orderId)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case payment.Method == paymentMethodCash && payment.Status == paymentPending:
+		if amount != payment.Amount {
+			db.Exec(`UPDATE payment SET amount=$1 WHERE id=$2`, amount, payment.Id)
+			payment.Amount = amount
+		}
+
+		payment, err = transitionPayment(payment, paymentCaptured, "cash", "")
+	case payment.Method != paymentMethodCash && payment.Status == paymentAuthorized:
+		// partial capture when the order got cheaper, the gateway releases the rest
+		if amount < payment.Amount {
+			db.Exec(`UPDATE payment SET amount=$1 WHERE id=$2`, amount, payment.Id)
+			payment.Amount = amount
+		}
+
+		payment, err = captureCharge(payment)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if payment.Status != paymentCaptured {
+		return errors.New("Pembayaran belum diterima")
+	}
+
+	if payment.Method == paymentMethodCash {
+		return nil
+	}
+
+	return settleAmountDue(payment, amount)
+}
+
+// settleAmountDue charge the rest when captured payment is below amount due,
+// refund the difference when it is above
+func settleAmountDue(payment Payment, amount int64) error {
+	supplemented, err := dbmap.SelectInt(`SELECT COALESCE(SUM(amount), 0) FROM payment
+		WHERE supplement_of=$1 AND status<>$2`, payment.Id, paymentFailed)
+	if err != nil {
+		return err
+	}
+
+	paymentId := strconv.FormatInt(payment.Id, 10)
+
+	switch paid := payment.Amount + supplemented; {
+	case amount > paid:
+		if _, err := openPayment(payment.OrderId, payment.Method, amount-paid, payment.Id); err != nil {
+			log.Println("Create supplement payment failed", payment.OrderId, err)
+		}
+	case amount < payment.Amount && supplemented == 0:
+		refund, err := requestRefund(payment.OrderId, "adjust:"+paymentId, payment.Amount-amount, 0, 0)
+		if err != nil {
+			log.Println("Request adjustment refund failed", payment.OrderId, err)
+			break
+		}
+
+		go processRefund(refund.Id)
+	}
+
+	return nil
+}
+
+// voidOrderPayment close payment which was never paid when order is canceled
+func voidOrderPayment(orderId int64) {
+	payment, err := getOrderPayment(orderId)
+	if err != nil || payment.Status != paymentPending {
+		return
+	}
+
+	transitionPayment(payment, paymentFailed, "cancel", "")
+}
+
+// voidAuthorizedPayment release authorization of payment which is not going to be captured
+func voidAuthorizedPayment(payment Payment) (Payment, error) {
+	if _, err := paymentGateway.Void(payment.ChargeId); err != nil {
+		return payment, err
+	}
+
+	return transitionPayment(payment, paymentFailed, "cancel", "")
+}
+
+var errWebhookAmountMismatch = errors.New("amount mismatch")
+
+// checkPaymentWebhook false for a redelivered webhook of a status already applied, a webhook
+// of another amount than the payment is never applied
+func checkPaymentWebhook(payment Payment, webhook PaymentWebhook, status int64) (bool, error) {
+	if payment.Status == status {
+		return false, nil
+	}
+
+	if webhook.Amount != payment.Amount {
+		return false, errWebhookAmountMismatch
+	}
+
+	return true, nil
+}
+
+// PostPaymentWebhook asynchronous status of charge, signed by the gateway
+func PostPaymentWebhook(c *gin.Context) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil || !paymentGateway.VerifySignature(body, c.Request.Header.Get("X-Signature")) {
+		c.JSON(401, gin.H{"error": "invalid signature"})
+		return
+	}
+
+	var webhook PaymentWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		c.JSON(400, gin.H{"error": "invalid payload"})
+		return
+	}
+
+	status, ok := paymentGatewayStatus[webhook.Status]
+	if !ok {
+		c.JSON(400, gin.H{"error": "unknown status"})
+		return
+	}
+
+	var payment Payment
+	if err := dbmap.SelectOne(&payment, `SELECT * FROM payment WHERE gateway=$1 AND charge_id=$2`,
+		paymentGateway.Name(), webhook.ChargeId); err != nil {
+		c.JSON(404, gin.H{"error": "payment not found"})
+		return
+	}
+
+	apply, err := checkPaymentWebhook(payment, webhook, status)
+	if err != nil {
+		log.Println("Payment webhook amount mismatch", payment.Id, webhook.Amount, payment.Amount)
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !apply {
+		c.JSON(200, gin.H{"status": "OK"})
+		return
+	}
+
+	payment, err = transitionPayment(payment, status, "webhook", webhook.EventId)
+	if err != nil {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+
+	// supplement is opened after the order is complete, it is captured right away
+	if payment.SupplementOf != 0 && status == paymentAuthorized {
+		go captureCharge(payment)
+	} else if payment.SupplementOf == 0 && (status == paymentAuthorized || status == paymentCaptured) {
+		if orderStatus, err := getOrderStatus(payment.OrderId); err == nil &&
+			orderStatus == orderStatusComplete {
+			go settleOrderPayment(payment.OrderId)
+		}
+	}
+
+	c.JSON(200, gin.H{"status": "OK"})
+}
+
+// GetOrderPayment active payment of order for the customer
+func GetOrderPayment(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+	orderId := c.Params.ByName("order_id")
+
+	count, _ := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND user_id=$2`,
+		orderId, userId)
+	if count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	parsedOrderId, _ := strconv.ParseInt(orderId, 10, 64)
+	payment, err := getOrderPayment(parsedOrderId)
+
+	if err == nil {
+		// charges of the rest of the amount due, customer pays them like the order payment
+		supplements := []Payment{}
+		dbmap.Select(&supplements, `SELECT * FROM payment WHERE supplement_of=$1 ORDER BY id ASC`,
+			payment.Id)
+
+		c.JSON(200, gin.H{"data": payment, "supplements": supplements})
+	} else {
+		c.JSON(400, gin.H{"error": "Pembayaran tidak ditemukan"})
+	}
+}
+
+// PostRetryOrderPayment charge again after the previous payment failed
+func PostRetryOrderPayment(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	var postRetry PostRetryPayment
+	c.Bind(&postRetry)
+
+	var order OrderVendor
+	if err := dbmap.SelectOne(&order, `SELECT id, payment_method FROM ordervendor
+		WHERE id=$1 AND user_id=$2`, postRetry.OrderId, userId); err != nil {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	if status, err := getOrderStatus(order.Id); err != nil || status >= orderStatusComplete {
+		c.JSON(400, gin.H{"error": "Pesanan sudah selesai atau dibatalkan"})
+		return
+	}
+
+	if payment, err := getOrderPayment(order.Id); err == nil && payment.Status != paymentFailed {
+		c.JSON(409, gin.H{"error": "Pembayaran sedang diproses", "data": payment})
+		return
+	}
+
+	payment, err := createOrderPayment(order.Id, int64(order.PaymentMethod))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": payment})
+}
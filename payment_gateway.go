@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ========================= PAYMENT GATEWAY
+
+// PaymentGateway charge non cash payment of an order
+type PaymentGateway interface {
+	Name() string
+	CreateCharge(charge ChargeRequest) (ChargeResult, error)
+	Capture(chargeId string, amount int64) (ChargeResult, error)
+	Void(chargeId string) (ChargeResult, error)
+	Refund(chargeId string, idempotencyKey string, amount int64) (RefundResult, error)
+	VerifySignature(body []byte, signature string) bool
+}
+
+type ChargeRequest struct {
+	Reference string `json:"reference"`
+	Method    string `json:"method"`
+	Amount    int64  `json:"amount"`
+}
+
+/**
+Charge result of gateway
+ChargeId
+Status		pending, authorized, captured, voided or failed
+VaNumber	virtual account number customer transfer to
+CheckoutUrl	e-wallet page customer approve the payment on
+ExpiryDate
+*/
+type ChargeResult struct {
+	ChargeId    string `json:"id"`
+	Status      string `json:"status"`
+	VaNumber    string `json:"va_number"`
+	CheckoutUrl string `json:"checkout_url"`
+	ExpiryDate  int64  `json:"expiry_date"`
+}
+
+/**
+Refund result of gateway, the same idempotency key always returns the same refund
+RefundId
+Status		pending, succeeded or failed
+Amount
+*/
+type RefundResult struct {
+	RefundId string `json:"id"`
+	Status   string `json:"status"`
+	Amount   int64  `json:"amount"`
+}
+
+/**
+Payment webhook sent by gateway when a charge changes status
+EventId
+ChargeId
+Status
+Amount
+*/
+type PaymentWebhook struct {
+	EventId  string `json:"event_id"`
+	ChargeId string `json:"charge_id"`
+	Status   string `json:"status"`
+	Amount   int64  `json:"amount"`
+}
+
+var errPaymentGatewayDisabled = errors.New("Pembayaran non tunai belum tersedia")
+
+// disabledPaymentGateway used when PAYMENT_GATEWAY_URL is not configured
+type disabledPaymentGateway struct{}
+
+func (g disabledPaymentGateway) Name() string {
+	return "disabled"
+}
+
+func (g disabledPaymentGateway) CreateCharge(charge ChargeRequest) (ChargeResult, error) {
+	return ChargeResult{}, errPaymentGatewayDisabled
+}
+
+func (g disabledPaymentGateway) Capture(chargeId string, amount int64) (ChargeResult, error) {
+	return ChargeResult{}, errPaymentGatewayDisabled
+}
+
+func (g disabledPaymentGateway) Void(chargeId string) (ChargeResult, error) {
+	return ChargeResult{}, errPaymentGatewayDisabled
+}
+
+func (g disabledPaymentGateway) Refund(chargeId string, idempotencyKey string, amount int64) (RefundResult, error) {
+	return RefundResult{}, errPaymentGatewayDisabled
+}
+
+func (g disabledPaymentGateway) VerifySignature(body []byte, signature string) bool {
+	return false
+}
+
+// restPaymentGateway JSON over HTTP gateway, cmd/fakegateway speaks the same API
+type restPaymentGateway struct {
+	Label         string
+	BaseUrl       string
+	ApiKey        string
+	WebhookSecret string
+	Client        *http.Client
+}
+
+func (g restPaymentGateway) Name() string {
+	return g.Label
+}
+
+func (g restPaymentGateway) post(path string, idempotencyKey string, body interface{}, result interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", g.BaseUrl+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+g.ApiKey)
+	if idempotencyKey != "" {
+		request.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	response, err := g.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("payment gateway %s returned %d", path, response.StatusCode)
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func (g restPaymentGateway) CreateCharge(charge ChargeRequest) (ChargeResult, error) {
+	var result ChargeResult
+	err := g.post("/charges", charge.Reference, charge, &result)
+	return result, err
+}
+
+func (g restPaymentGateway) Capture(chargeId string, amount int64) (ChargeResult, error) {
+	var result ChargeResult
+	err := g.post("/charges/"+chargeId+"/capture", "", map[string]int64{"amount": amount}, &result)
+	return result, err
+}
+
+func (g restPaymentGateway) Void(chargeId string) (ChargeResult, error) {
+	var result ChargeResult
+	err := g.post("/charges/"+chargeId+"/void", "", map[string]int64{}, &result)
+	return result, err
+}
+
+func (g restPaymentGateway) Refund(chargeId string, idempotencyKey string, amount int64) (RefundResult, error) {
+	var result RefundResult
+	err := g.post("/charges/"+chargeId+"/refund", idempotencyKey, map[string]int64{"amount": amount},
+		&result)
+	return result, err
+}
+
+// VerifySignature hex HMAC-SHA256 of raw body with PAYMENT_WEBHOOK_SECRET
+func (g restPaymentGateway) VerifySignature(body []byte, signature string) bool {
+	if g.WebhookSecret == "" {
+		return false
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(g.WebhookSecret))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+var paymentGateway = newPaymentGateway()
+
+// newPaymentGateway REST gateway when PAYMENT_GATEWAY_URL is set, otherwise disabled
+func newPaymentGateway() PaymentGateway {
+	baseUrl := os.Getenv("PAYMENT_GATEWAY_URL")
+	if baseUrl == "" {
+		return disabledPaymentGateway{}
+	}
+
+	label := os.Getenv("PAYMENT_GATEWAY_NAME")
+	if label == "" {
+		label = "rest"
+	}
+
+	return restPaymentGateway{
+		Label:         label,
+		BaseUrl:       baseUrl,
+		ApiKey:        os.Getenv("PAYMENT_GATEWAY_KEY"),
+		WebhookSecret: os.Getenv("PAYMENT_WEBHOOK_SECRET"),
+		Client:        &http.Client{Timeout: 15 * time.Second},
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	body      []byte
+	signature string
+}
+
+// startFakeGateway build and run cmd/fakegateway posting its webhooks to webhookUrl
+func startFakeGateway(t *testing.T, webhookUrl string, secret string) (string, func()) {
+	if testing.Short() {
+		t.Skip("builds cmd/fakegateway")
+	}
+
+	dir, err := ioutil.TempDir("", "fakegateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary := filepath.Join(dir, "fakegateway")
+	if output, err := exec.Command("go", "build", "-o", binary, "./cmd/fakegateway").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		t.Skip("build cmd/fakegateway failed: ", err, string(output))
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	command := exec.Command(binary, "-addr", addr, "-public", "http://"+addr, "-webhook", webhookUrl,
+		"-secret", secret)
+	if err := command.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := func() {
+		command.Process.Kill()
+		command.Wait()
+		os.RemoveAll(dir)
+	}
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return "http://" + addr, stop
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	stop()
+	t.Fatal("fakegateway did not start on", addr)
+	return "", nil
+}
+
+func waitWebhook(t *testing.T, webhooks chan receivedWebhook) receivedWebhook {
+	select {
+	case webhook := <-webhooks:
+		return webhook
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook from fakegateway")
+		return receivedWebhook{}
+	}
+}
+
+func TestFakeGatewayWebhook(t *testing.T) {
+	webhooks := make(chan receivedWebhook, 4)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		webhooks <- receivedWebhook{body: body, signature: r.Header.Get("X-Signature")}
+	}))
+	defer receiver.Close()
+
+	baseUrl, stop := startFakeGateway(t, receiver.URL, "local")
+	defer stop()
+
+	gateway := restPaymentGateway{Label: "fake", BaseUrl: baseUrl, WebhookSecret: "local",
+		Client: &http.Client{Timeout: 5 * time.Second}}
+
+	charge, err := gateway.CreateCharge(ChargeRequest{Reference: "order:1", Method: "ewallet",
+		Amount: 50000})
+	if err != nil || charge.Status != "pending" {
+		t.Fatal("create charge", charge, err)
+	}
+
+	response, err := http.Get(baseUrl + "/pay/" + charge.ChargeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	authorized := waitWebhook(t, webhooks)
+
+	if !gateway.VerifySignature(authorized.body, authorized.signature) {
+		t.Error("signature of fakegateway rejected")
+	}
+
+	otherSecret := gateway
+	otherSecret.WebhookSecret = "other"
+	if otherSecret.VerifySignature(authorized.body, authorized.signature) {
+		t.Error("signature accepted with another secret")
+	}
+
+	tampered := append([]byte{}, authorized.body...)
+	tampered[len(tampered)-2] = '9'
+	if gateway.VerifySignature(tampered, authorized.signature) {
+		t.Error("signature accepted for a changed body")
+	}
+
+	var webhook PaymentWebhook
+	if err := json.Unmarshal(authorized.body, &webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	payment := Payment{Status: paymentPending, Amount: 50000}
+	if apply, err := checkPaymentWebhook(payment, webhook, paymentGatewayStatus[webhook.Status]); !apply || err != nil {
+		t.Errorf("authorized webhook not applied: %v, %v", apply, err)
+	}
+
+	// capture of only part of the authorization reports the captured amount
+	if _, err := gateway.Capture(charge.ChargeId, 20000); err != nil {
+		t.Fatal(err)
+	}
+
+	captured := waitWebhook(t, webhooks)
+	if err := json.Unmarshal(captured.body, &webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	payment.Status = paymentAuthorized
+	if _, err := checkPaymentWebhook(payment, webhook, paymentGatewayStatus[webhook.Status]); err != errWebhookAmountMismatch {
+		t.Errorf("captured 20000 of payment 50000: %v, want amount mismatch", err)
+	}
+
+	payment.Amount = 20000
+	if apply, err := checkPaymentWebhook(payment, webhook, paymentGatewayStatus[webhook.Status]); !apply || err != nil {
+		t.Errorf("captured webhook not applied: %v, %v", apply, err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCanTransitionPayment(t *testing.T) {
+	tests := []struct {
+		from    int64
+		to      int64
+		allowed bool
+	}{
+		{paymentPending, paymentAuthorized, true},
+		{paymentPending, paymentCaptured, true},
+		{paymentPending, paymentFailed, true},
+		{paymentPending, paymentRefunded, false},
+		{paymentAuthorized, paymentCaptured, true},
+		{paymentAuthorized, paymentFailed, true},
+		{paymentAuthorized, paymentRefunded, true},
+		{paymentAuthorized, paymentPending, false},
+		{paymentCaptured, paymentRefunded, true},
+		{paymentCaptured, paymentFailed, false},
+		{paymentCaptured, paymentAuthorized, false},
+		{paymentFailed, paymentCaptured, false},
+		{paymentRefunded, paymentCaptured, false},
+	}
+
+	for _, test := range tests {
+		if allowed := canTransitionPayment(test.from, test.to); allowed != test.allowed {
+			t.Errorf("canTransitionPayment(%d, %d) = %v, want %v", test.from, test.to, allowed,
+				test.allowed)
+		}
+	}
+}
+
+func TestCheckPaymentWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		payment Payment
+		webhook PaymentWebhook
+		apply   bool
+		err     error
+	}{
+		{"authorized", Payment{Status: paymentPending, Amount: 50000},
+			PaymentWebhook{Status: "authorized", Amount: 50000}, true, nil},
+		{"redelivered", Payment{Status: paymentAuthorized, Amount: 50000},
+			PaymentWebhook{Status: "authorized", Amount: 50000}, false, nil},
+		{"redelivered after capture of fee", Payment{Status: paymentCaptured, Amount: 10000},
+			PaymentWebhook{Status: "captured", Amount: 20000}, false, nil},
+		{"amount mismatch", Payment{Status: paymentPending, Amount: 50000},
+			PaymentWebhook{Status: "captured", Amount: 40000}, false, errWebhookAmountMismatch},
+	}
+
+	for _, test := range tests {
+		apply, err := checkPaymentWebhook(test.payment, test.webhook,
+			paymentGatewayStatus[test.webhook.Status])
+
+		if apply != test.apply || err != test.err {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, apply, err, test.apply, test.err)
+		}
+	}
+}
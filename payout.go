@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= PAYOUT
+
+/**
+Provider bank account, destination of payouts
+Id
+ProviderId
+BankCode
+BankName
+AccountNumber
+AccountName
+UpdatedDate
+*/
+type ProviderBankAccount struct {
+	Id            int64  `db:"id" json:"id"`
+	ProviderId    int64  `db:"provider_id" json:"provider_id"`
+	BankCode      string `db:"bank_code" json:"bank_code"`
+	BankName      string `db:"bank_name" json:"bank_name"`
+	AccountNumber string `db:"account_number" json:"account_number"`
+	AccountName   string `db:"account_name" json:"account_name"`
+	UpdatedDate   int64  `db:"updated_date" json:"updated_date"`
+}
+
+/**
+Payout batch, provider balances of a period transferred together
+Id
+PeriodEnd	ledger entries before this date are included
+Status		0 = generated, 1 = paid
+ProviderCount
+TotalAmount
+CreatedDate
+PaidDate
+*/
+type PayoutBatch struct {
+	Id            int64 `db:"id" json:"id"`
+	PeriodEnd     int64 `db:"period_end" json:"period_end"`
+	Status        int64 `db:"status" json:"status"`
+	ProviderCount int64 `db:"provider_count" json:"provider_count"`
+	TotalAmount   int64 `db:"total_amount" json:"total_amount"`
+	CreatedDate   int64 `db:"created_date" json:"created_date"`
+	PaidDate      int64 `db:"paid_date" json:"paid_date"`
+}
+
+/**
+Payout, transfer to one provider in a batch, bank account is copied at generation
+Id
+BatchId
+ProviderId
+Amount
+BankCode
+BankName
+AccountNumber
+AccountName
+CreatedDate
+*/
+type Payout struct {
+	Id            int64  `db:"id" json:"id"`
+	BatchId       int64  `db:"batch_id" json:"batch_id"`
+	ProviderId    int64  `db:"provider_id" json:"provider_id"`
+	Amount        int64  `db:"amount" json:"amount"`
+	BankCode      string `db:"bank_code" json:"bank_code"`
+	BankName      string `db:"bank_name" json:"bank_name"`
+	AccountNumber string `db:"account_number" json:"account_number"`
+	AccountName   string `db:"account_name" json:"account_name"`
+	CreatedDate   int64  `db:"created_date" json:"created_date"`
+}
+
+type PostPayoutBatch struct {
+	BatchId   int64 `json:"batch_id"`
+	PeriodEnd int64 `json:"period_end"`
+}
+
+const (
+	payoutGenerated = 0
+	payoutPaid      = 1
+)
+
+// lock key of payout generation, one batch is generated at a time
+const payoutLockKey = 38001
+
+// PostProviderBankAccount provider set bank account for payouts
+func PostProviderBankAccount(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var account ProviderBankAccount
+	c.Bind(&account)
+
+	if account.BankName == "" || account.AccountNumber == "" || account.AccountName == "" {
+		c.JSON(400, gin.H{"error": "Data rekening harus diisi"})
+		return
+	}
+
+	account.ProviderId = providerId
+	account.UpdatedDate = time.Now().Unix()
+
+	if err := db.QueryRow(`INSERT INTO providerbankaccount(provider_id, bank_code, bank_name,
+			account_number, account_name, updated_date)
+		VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (provider_id) DO UPDATE SET bank_code=$2, bank_name=$3, account_number=$4,
+			account_name=$5, updated_date=$6
+		RETURNING id`, account.ProviderId, account.BankCode, account.BankName,
+		account.AccountNumber, account.AccountName, account.UpdatedDate).Scan(&account.Id); err == nil {
+		c.JSON(200, gin.H{"data": account})
+	} else {
+		c.JSON(400, gin.H{"error": "insert failed"})
+	}
+}
+
+// GetProviderBankAccount bank account of provider
+func GetProviderBankAccount(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var account ProviderBankAccount
+	if err := dbmap.SelectOne(&account, `SELECT * FROM providerbankaccount WHERE provider_id=$1`,
+		providerId); err == nil {
+		c.JSON(200, gin.H{"data": account})
+	} else {
+		c.JSON(400, gin.H{"error": "Rekening belum diisi"})
+	}
+}
+
+// GetProviderPayouts payouts received by provider
+func GetProviderPayouts(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var payouts []Payout
+	_, err := dbmap.Select(&payouts, `SELECT * FROM payout WHERE provider_id=$1 ORDER BY id DESC`,
+		providerId)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": payouts})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// PostGeneratePayoutBatch pay out positive provider balances up to period_end
+func PostGeneratePayoutBatch(c *gin.Context) {
+	var postBatch PostPayoutBatch
+	c.Bind(&postBatch)
+
+	now := time.Now().Unix()
+	if postBatch.PeriodEnd <= 0 || postBatch.PeriodEnd > now {
+		postBatch.PeriodEnd = now
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "generate failed"})
+		return
+	}
+	defer tx.Rollback()
+
+	tx.Exec(`SELECT pg_advisory_xact_lock($1)`, payoutLockKey)
+
+	// payouts of previous batch are debited at its created date, an earlier period would skip them
+	var lastCreated int64
+	tx.QueryRow(`SELECT COALESCE(MAX(created_date), 0) FROM payoutbatch`).Scan(&lastCreated)
+	if postBatch.PeriodEnd <= lastCreated {
+		c.JSON(400, gin.H{"error": "period_end harus setelah batch sebelumnya"})
+		return
+	}
+
+	rows, err := tx.Query(`SELECT le.provider_id, SUM(le.credit - le.debit) as amount,
+			pba.bank_code, pba.bank_name, pba.account_number, pba.account_name
+		FROM ledgerentry le
+			JOIN providerbankaccount pba ON pba.provider_id = le.provider_id
+		WHERE le.account=$1 AND le.created_date < $2
+		GROUP BY le.provider_id, pba.bank_code, pba.bank_name, pba.account_number, pba.account_name
+		HAVING SUM(le.credit - le.debit) >= $3`, ledgerProviderBalance, postBatch.PeriodEnd,
+		getEnvInt64("PAYOUT_MIN_AMOUNT", 50000))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	var payouts []Payout
+	for rows.Next() {
+		var payout Payout
+		if err := rows.Scan(&payout.ProviderId, &payout.Amount, &payout.BankCode, &payout.BankName,
+			&payout.AccountNumber, &payout.AccountName); err != nil {
+			rows.Close()
+			c.JSON(400, gin.H{"error": "select failed"})
+			return
+		}
+		payouts = append(payouts, payout)
+	}
+	rows.Close()
+
+	batch := PayoutBatch{
+		PeriodEnd:     postBatch.PeriodEnd,
+		Status:        payoutGenerated,
+		ProviderCount: int64(len(payouts)),
+		CreatedDate:   now,
+	}
+	for _, payout := range payouts {
+		batch.TotalAmount += payout.Amount
+	}
+
+	if err := tx.QueryRow(`INSERT INTO payoutbatch(period_end, status, provider_count, total_amount,
+			created_date, paid_date)
+		VALUES($1, $2, $3, $4, $5, 0) RETURNING id`, batch.PeriodEnd, batch.Status,
+		batch.ProviderCount, batch.TotalAmount, batch.CreatedDate).Scan(&batch.Id); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	for i := range payouts {
+		payout := &payouts[i]
+		payout.BatchId = batch.Id
+		payout.CreatedDate = now
+
+		if err := tx.QueryRow(`INSERT INTO payout(batch_id, provider_id, amount, bank_code, bank_name,
+				account_number, account_name, created_date)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`, payout.BatchId, payout.ProviderId,
+			payout.Amount, payout.BankCode, payout.BankName, payout.AccountNumber, payout.AccountName,
+			payout.CreatedDate).Scan(&payout.Id); err != nil {
+			c.JSON(400, gin.H{"error": "insert failed"})
+			return
+		}
+
+		if _, err := postLedgerTransactionTx(tx, "payout", 0,
+			"payout:"+strconv.FormatInt(payout.Id, 10),
+			"Pencairan saldo #"+strconv.FormatInt(batch.Id, 10), []LedgerLine{
+				{Account: ledgerProviderBalance, ProviderId: payout.ProviderId, Debit: payout.Amount},
+				{Account: ledgerPayoutClearing, ProviderId: payout.ProviderId, Credit: payout.Amount},
+			}); err != nil {
+			c.JSON(400, gin.H{"error": "ledger failed"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(400, gin.H{"error": "generate failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": batch, "payouts": payouts})
+}
+
+// PostPayoutBatchPaid mark batch transferred by the bank
+func PostPayoutBatchPaid(c *gin.Context) {
+	var postBatch PostPayoutBatch
+	c.Bind(&postBatch)
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE payoutbatch SET status=$1, paid_date=$2 WHERE id=$3 AND status=$4`,
+		payoutPaid, time.Now().Unix(), postBatch.BatchId, payoutGenerated)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(409, gin.H{"error": "Batch tidak ditemukan atau sudah dibayar"})
+		return
+	}
+
+	var payouts []Payout
+	if _, err := dbmap.Select(&payouts, `SELECT * FROM payout WHERE batch_id=$1`,
+		postBatch.BatchId); err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	for _, payout := range payouts {
+		if _, err := postLedgerTransactionTx(tx, "payout_paid", 0,
+			"payout_paid:"+strconv.FormatInt(payout.Id, 10),
+			"Transfer pencairan saldo #"+strconv.FormatInt(payout.BatchId, 10), []LedgerLine{
+				{Account: ledgerPayoutClearing, ProviderId: payout.ProviderId, Debit: payout.Amount},
+				{Account: ledgerPlatformBank, Credit: payout.Amount},
+			}); err != nil {
+			c.JSON(400, gin.H{"error": "ledger failed"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
+
+// GetPayoutBatches list payout batches
+func GetPayoutBatches(c *gin.Context) {
+	var batches []PayoutBatch
+	_, err := dbmap.Select(&batches, `SELECT * FROM payoutbatch ORDER BY id DESC`)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": batches})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// GetPayoutBatchExport bank transfer CSV of a batch
+func GetPayoutBatchExport(c *gin.Context) {
+	parsedBatchId, err := strconv.ParseInt(c.Params.ByName("batch_id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid batch"})
+		return
+	}
+	batchId := strconv.FormatInt(parsedBatchId, 10)
+
+	var payouts []Payout
+	if _, err := dbmap.Select(&payouts, `SELECT * FROM payout WHERE batch_id=$1 ORDER BY id ASC`,
+		parsedBatchId); err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write([]string{"bank_code", "bank_name", "account_number", "account_name", "amount",
+		"reference"})
+
+	for _, payout := range payouts {
+		writer.Write([]string{
+			payout.BankCode,
+			payout.BankName,
+			payout.AccountNumber,
+			payout.AccountName,
+			strconv.FormatInt(payout.Amount, 10),
+			"PANGGILIN-" + batchId + "-" + strconv.FormatInt(payout.Id, 10),
+		})
+	}
+	writer.Flush()
+
+	c.Header("Content-Disposition", `attachment; filename="payout-`+batchId+`.csv"`)
+	c.Data(200, "text/csv; charset=utf-8", buffer.Bytes())
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= PROMO TARGETING
+
+/**
+Promo targeting, parsed from and serialized into promo.target
+Cities		city of user profile, case insensitive
+JasaIds		user has ordered one of these kategori jasa before
+UserType	new = no complete order yet, returning = at least one complete order
+MinAppVersion	inclusive
+MaxAppVersion	inclusive
+
+promo.target format is "city=Jakarta,Bandung;jasa=1,3;user=new;app_min=2.1.0;app_max=3.0.0",
+empty target is shown to everybody. Rules of different keys must all match.
+*/
+type PromoTargeting struct {
+	Cities        []string `json:"cities"`
+	JasaIds       []int64  `json:"jasa_ids"`
+	UserType      string   `json:"user_type"`
+	MinAppVersion string   `json:"min_app_version"`
+	MaxAppVersion string   `json:"max_app_version"`
+}
+
+/* What is known about the user requesting promos */
+type PromoAudience struct {
+	City       string
+	JasaIds    map[int64]bool
+	Returning  bool
+	AppVersion string
+}
+
+type PostPromoData struct {
+	Promo
+	Targeting *PromoTargeting `json:"targeting"`
+}
+
+type PostPromoId struct {
+	Id int64 `json:"id"`
+}
+
+type PromoItem struct {
+	Promo
+	Targeting PromoTargeting `json:"targeting"`
+	Live      bool           `json:"live"`
+}
+
+const (
+	promoUserNew       = "new"
+	promoUserReturning = "returning"
+)
+
+func parsePromoTarget(target string) PromoTargeting {
+	var targeting PromoTargeting
+
+	for _, rule := range strings.Split(target, ";") {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			// free-form target of old promos does not restrict anybody
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		switch key {
+		case "city":
+			for _, city := range strings.Split(value, ",") {
+				if city = strings.TrimSpace(city); city != "" {
+					targeting.Cities = append(targeting.Cities, city)
+				}
+			}
+		case "jasa":
+			for _, jasa := range strings.Split(value, ",") {
+				if jasaId, err := strconv.ParseInt(strings.TrimSpace(jasa), 10, 64); err == nil {
+					targeting.JasaIds = append(targeting.JasaIds, jasaId)
+				}
+			}
+		case "user":
+			targeting.UserType = value
+		case "app_min":
+			targeting.MinAppVersion = value
+		case "app_max":
+			targeting.MaxAppVersion = value
+		}
+	}
+
+	return targeting
+}
+
+func (t PromoTargeting) String() string {
+	var rules []string
+
+	if len(t.Cities) > 0 {
+		rules = append(rules, "city="+strings.Join(t.Cities, ","))
+	}
+
+	if len(t.JasaIds) > 0 {
+		var jasaIds []string
+		for _, jasaId := range t.JasaIds {
+			jasaIds = append(jasaIds, strconv.FormatInt(jasaId, 10))
+		}
+		rules = append(rules, "jasa="+strings.Join(jasaIds, ","))
+	}
+
+	if t.UserType != "" {
+		rules = append(rules, "user="+t.UserType)
+	}
+
+	if t.MinAppVersion != "" {
+		rules = append(rules, "app_min="+t.MinAppVersion)
+	}
+
+	if t.MaxAppVersion != "" {
+		rules = append(rules, "app_max="+t.MaxAppVersion)
+	}
+
+	return strings.Join(rules, ";")
+}
+
+func (t PromoTargeting) Valid() bool {
+	return t.UserType == "" || t.UserType == promoUserNew || t.UserType == promoUserReturning
+}
+
+func (t PromoTargeting) Matches(audience PromoAudience) bool {
+	if len(t.Cities) > 0 {
+		matched := false
+		for _, city := range t.Cities {
+			if strings.EqualFold(city, strings.TrimSpace(audience.City)) {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(t.JasaIds) > 0 {
+		matched := false
+		for _, jasaId := range t.JasaIds {
+			if audience.JasaIds[jasaId] {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if (t.UserType == promoUserNew && audience.Returning) ||
+		(t.UserType == promoUserReturning && !audience.Returning) {
+		return false
+	}
+
+	if t.MinAppVersion != "" && compareVersion(audience.AppVersion, t.MinAppVersion) < 0 {
+		return false
+	}
+
+	if t.MaxAppVersion != "" && compareVersion(audience.AppVersion, t.MaxAppVersion) > 0 {
+		return false
+	}
+
+	return true
+}
+
+// compareVersion compare dotted numeric versions, missing parts count as 0
+func compareVersion(a string, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var numberA, numberB int64
+		if i < len(partsA) {
+			numberA, _ = strconv.ParseInt(strings.TrimSpace(partsA[i]), 10, 64)
+		}
+		if i < len(partsB) {
+			numberB, _ = strconv.ParseInt(strings.TrimSpace(partsB[i]), 10, 64)
+		}
+
+		if numberA < numberB {
+			return -1
+		} else if numberA > numberB {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// getPromoAudience app version comes from X-App-Version header or app_version query
+func getPromoAudience(c *gin.Context, userId int64) PromoAudience {
+	audience := PromoAudience{JasaIds: make(map[int64]bool)}
+
+	audience.AppVersion = c.Request.Header.Get("X-App-Version")
+	if audience.AppVersion == "" {
+		audience.AppVersion = c.Query("app_version")
+	}
+
+	audience.City, _ = dbmap.SelectStr(`SELECT COALESCE(city, '') FROM userprofile WHERE user_id=$1`,
+		userId)
+
+	var jasaIds []int64
+	dbmap.Select(&jasaIds, `SELECT DISTINCT pd.jasa_id FROM ordervendor ov
+		JOIN providerdata pd ON pd.id = ov.provider_id
+		WHERE ov.user_id=$1`, userId)
+	for _, jasaId := range jasaIds {
+		audience.JasaIds[jasaId] = true
+	}
+
+	completed, _ := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendorjourney ovj
+		JOIN ordervendor ov ON ov.id = ovj.order_id
+		WHERE ov.user_id=$1 AND ovj.status=$2`, userId, orderStatusComplete)
+	audience.Returning = completed > 0
+
+	return audience
+}
+
+func isPromoLive(promo Promo, now int64) bool {
+	return promo.Active == 1 && promo.StartDate <= now && (promo.EndDate == 0 || promo.EndDate > now)
+}
+
+// bindPromo read promo from request, structured targeting replaces target string
+func bindPromo(c *gin.Context) (Promo, bool) {
+	var postPromo PostPromoData
+	c.Bind(&postPromo)
+
+	promo := postPromo.Promo
+	targeting := parsePromoTarget(promo.Target)
+	if postPromo.Targeting != nil {
+		targeting = *postPromo.Targeting
+		promo.Target = targeting.String()
+	}
+
+	if promo.Title == "" || promo.PromoImage == "" || !targeting.Valid() ||
+		(promo.EndDate != 0 && promo.EndDate <= promo.StartDate) {
+		return promo, false
+	}
+
+	return promo, true
+}
+
+// PostUpdatePromo admin update every field of a promo
+func PostUpdatePromo(c *gin.Context) {
+	promo, valid := bindPromo(c)
+	if !valid {
+		c.JSON(400, gin.H{"error": "Promo tidak valid"})
+		return
+	}
+
+	result, err := db.Exec(`UPDATE promo SET title=$1, promo_image=$2, start_date=$3, end_date=$4,
+		position=$5, active=$6, target=$7 WHERE id=$8`, promo.Title, promo.PromoImage,
+		promo.StartDate, promo.EndDate, promo.Position, promo.Active, promo.Target, promo.Id)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(400, gin.H{"error": "Promo tidak ditemukan"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": promo})
+}
+
+// PostDeactivatePromo admin hide promo without deleting it
+func PostDeactivatePromo(c *gin.Context) {
+	var postPromo PostPromoId
+	c.Bind(&postPromo)
+
+	result, err := db.Exec(`UPDATE promo SET active=0 WHERE id=$1`, postPromo.Id)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(400, gin.H{"error": "Promo tidak ditemukan"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
+
+// PostDeletePromo admin delete promo
+func PostDeletePromo(c *gin.Context) {
+	var postPromo PostPromoId
+	c.Bind(&postPromo)
+
+	result, err := db.Exec(`DELETE FROM promo WHERE id=$1`, postPromo.Id)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "delete failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(400, gin.H{"error": "Promo tidak ditemukan"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
+
+// GetAdminPromos every promo with its targeting and whether it is live now
+func GetAdminPromos(c *gin.Context) {
+	var promos []Promo
+	_, err := dbmap.Select(&promos, `SELECT * FROM promo ORDER BY position ASC, id DESC`)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	now := time.Now().Unix()
+	items := []PromoItem{}
+	for _, promo := range promos {
+		items = append(items, PromoItem{
+			Promo:     promo,
+			Targeting: parsePromoTarget(promo.Target),
+			Live:      isPromoLive(promo, now),
+		})
+	}
+
+	c.JSON(200, gin.H{"data": items})
+}
+
+// GetAdminPromo one promo with its targeting
+func GetAdminPromo(c *gin.Context) {
+	var promo Promo
+	if err := dbmap.SelectOne(&promo, `SELECT * FROM promo WHERE id=$1`,
+		c.Params.ByName("promo_id")); err != nil {
+		c.JSON(400, gin.H{"error": "Promo tidak ditemukan"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": PromoItem{
+		Promo:     promo,
+		Targeting: parsePromoTarget(promo.Target),
+		Live:      isPromoLive(promo, time.Now().Unix()),
+	}})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= PROMO STATS
+
+/**
+Promo creative, variant of a promo banner
+Id
+PromoId
+Name		variant label shown in results
+Title
+PromoImage
+Weight		share of traffic relative to other active creatives of the promo
+Active		1 = shown, 0 = paused
+CreatedDate
+
+A promo without active creative shows its own title and image as creative 0
+*/
+type PromoCreative struct {
+	Id          int64  `db:"id" json:"id"`
+	PromoId     int64  `db:"promo_id" json:"promo_id"`
+	Name        string `db:"name" json:"name"`
+	Title       string `db:"title" json:"title"`
+	PromoImage  string `db:"promo_image" json:"promo_image"`
+	Weight      int64  `db:"weight" json:"weight"`
+	Active      int8   `db:"active" json:"active"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Promo stat, impressions and clicks of a creative per day
+Day		YYYYMMDD in Asia/Jakarta
+*/
+type PromoStat struct {
+	Id          int64  `db:"id" json:"id"`
+	PromoId     int64  `db:"promo_id" json:"promo_id"`
+	CreativeId  int64  `db:"creative_id" json:"creative_id"`
+	Day         string `db:"day" json:"day"`
+	Impressions int64  `db:"impressions" json:"impressions"`
+	Clicks      int64  `db:"clicks" json:"clicks"`
+}
+
+/**
+Promo click, kept per user to attribute orders placed after the click
+*/
+type PromoClick struct {
+	Id          int64 `db:"id" json:"id"`
+	PromoId     int64 `db:"promo_id" json:"promo_id"`
+	CreativeId  int64 `db:"creative_id" json:"creative_id"`
+	UserId      int64 `db:"user_id" json:"user_id"`
+	CreatedDate int64 `db:"created_date" json:"created_date"`
+}
+
+type PromoBanner struct {
+	Promo
+	CreativeId int64 `json:"creative_id"`
+}
+
+type PostPromoBeacon struct {
+	PromoId    int64 `json:"promo_id"`
+	CreativeId int64 `json:"creative_id"`
+}
+
+/**
+Promo variant result
+Ctr		clicks / impressions
+CtrLow, CtrHigh	95% Wilson interval of Ctr
+ConversionRate	orders attributed to their latest click / clicks
+*/
+type PromoVariantResult struct {
+	CreativeId         int64       `db:"creative_id" json:"creative_id"`
+	Name               string      `db:"name" json:"name"`
+	Impressions        int64       `db:"impressions" json:"impressions"`
+	Clicks             int64       `db:"clicks" json:"clicks"`
+	Conversions        int64       `db:"conversions" json:"conversions"`
+	Ctr                float64     `db:"-" json:"ctr"`
+	CtrLow             float64     `db:"-" json:"ctr_low"`
+	CtrHigh            float64     `db:"-" json:"ctr_high"`
+	ConversionRate     float64     `db:"-" json:"conversion_rate"`
+	ConversionRateLow  float64     `db:"-" json:"conversion_rate_low"`
+	ConversionRateHigh float64     `db:"-" json:"conversion_rate_high"`
+	Daily              []PromoStat `db:"-" json:"daily"`
+}
+
+const promoStatConfidenceZ = 1.96
+
+var promoConversionHours = getEnvInt64("PROMO_CONVERSION_HOURS", 24)
+
+func promoStatDay(date time.Time) string {
+	return date.In(receiptLocation).Format("20060102")
+}
+
+// assignPromoCreative pick creative by weight, the same user always gets the same creative
+func assignPromoCreative(promo Promo, userId int64) PromoBanner {
+	banner := PromoBanner{Promo: promo}
+
+	var creatives []PromoCreative
+	dbmap.Select(&creatives, `SELECT * FROM promocreative
+		WHERE promo_id=$1 AND active=1 AND weight > 0 ORDER BY id`, promo.Id)
+
+	var totalWeight int64
+	for _, creative := range creatives {
+		totalWeight += creative.Weight
+	}
+
+	if totalWeight == 0 {
+		return banner
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(strconv.FormatInt(promo.Id, 10) + ":" + strconv.FormatInt(userId, 10)))
+	bucket := int64(hash.Sum64() % uint64(totalWeight))
+
+	for _, creative := range creatives {
+		if bucket < creative.Weight {
+			banner.CreativeId = creative.Id
+			if creative.Title != "" {
+				banner.Title = creative.Title
+			}
+			if creative.PromoImage != "" {
+				banner.PromoImage = creative.PromoImage
+			}
+			break
+		}
+		bucket -= creative.Weight
+	}
+
+	return banner
+}
+
+// wilsonInterval 95% confidence interval of successes / total
+func wilsonInterval(successes int64, total int64) (float64, float64) {
+	if total == 0 {
+		return 0, 0
+	}
+
+	n := float64(total)
+	p := float64(successes) / n
+	z := promoStatConfidenceZ
+
+	denominator := 1 + z*z/n
+	center := (p + z*z/(2*n)) / denominator
+	margin := z * math.Sqrt(p*(1-p)/n+z*z/(4*n*n)) / denominator
+
+	return math.Max(0, center-margin), math.Min(1, center+margin)
+}
+
+func bindPromoBeacon(c *gin.Context) (PostPromoBeacon, bool) {
+	var beacon PostPromoBeacon
+	c.Bind(&beacon)
+
+	var count int64
+	var err error
+	if beacon.CreativeId == 0 {
+		count, err = dbmap.SelectInt(`SELECT COUNT(*) FROM promo WHERE id=$1`, beacon.PromoId)
+	} else {
+		count, err = dbmap.SelectInt(`SELECT COUNT(*) FROM promocreative WHERE id=$1 AND promo_id=$2`,
+			beacon.CreativeId, beacon.PromoId)
+	}
+
+	return beacon, err == nil && count > 0
+}
+
+func countPromoStat(beacon PostPromoBeacon, impressions int64, clicks int64) error {
+	_, err := db.Exec(`INSERT INTO promostat(promo_id, creative_id, day, impressions, clicks)
+		VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (promo_id, creative_id, day) DO UPDATE
+		SET impressions = promostat.impressions + $4, clicks = promostat.clicks + $5`,
+		beacon.PromoId, beacon.CreativeId, promoStatDay(time.Now()), impressions, clicks)
+	return err
+}
+
+// PostPromoImpression beacon sent by app when banner is shown
+func PostPromoImpression(c *gin.Context) {
+	beacon, valid := bindPromoBeacon(c)
+	if !valid {
+		c.JSON(400, gin.H{"error": "Promo tidak ditemukan"})
+		return
+	}
+
+	if err := countPromoStat(beacon, 1, 0); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
+
+// PostPromoClick beacon sent by app when banner is tapped
+func PostPromoClick(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	beacon, valid := bindPromoBeacon(c)
+	if !valid {
+		c.JSON(400, gin.H{"error": "Promo tidak ditemukan"})
+		return
+	}
+
+	if err := countPromoStat(beacon, 0, 1); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	click := PromoClick{
+		PromoId:     beacon.PromoId,
+		CreativeId:  beacon.CreativeId,
+		UserId:      userId,
+		CreatedDate: time.Now().Unix(),
+	}
+	if err := dbmap.Insert(&click); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
+
+// PostPromoCreative admin add creative, or update it when id is set
+func PostPromoCreative(c *gin.Context) {
+	var creative PromoCreative
+	c.Bind(&creative)
+
+	if creative.PromoId == 0 || creative.Name == "" || creative.Weight < 0 {
+		c.JSON(400, gin.H{"error": "Creative tidak valid"})
+		return
+	}
+
+	if count, _ := dbmap.SelectInt(`SELECT COUNT(*) FROM promo WHERE id=$1`, creative.PromoId); count == 0 {
+		c.JSON(400, gin.H{"error": "Promo tidak ditemukan"})
+		return
+	}
+
+	if creative.Id == 0 {
+		creative.CreatedDate = time.Now().Unix()
+		if err := dbmap.Insert(&creative); err != nil {
+			c.JSON(400, gin.H{"error": "insert failed"})
+			return
+		}
+	} else {
+		result, err := db.Exec(`UPDATE promocreative SET name=$1, title=$2, promo_image=$3, weight=$4,
+			active=$5 WHERE id=$6 AND promo_id=$7`, creative.Name, creative.Title, creative.PromoImage,
+			creative.Weight, creative.Active, creative.Id, creative.PromoId)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "update failed"})
+			return
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			c.JSON(400, gin.H{"error": "Creative tidak ditemukan"})
+			return
+		}
+	}
+
+	c.JSON(200, gin.H{"data": creative})
+}
+
+// GetPromoCreatives admin creatives of a promo
+func GetPromoCreatives(c *gin.Context) {
+	var creatives []PromoCreative
+	_, err := dbmap.Select(&creatives, `SELECT * FROM promocreative WHERE promo_id=$1 ORDER BY id`,
+		c.Params.ByName("promo_id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": creatives})
+}
+
+// GetPromoResults admin CTR and conversions per creative,
+// optional from and to unix date, hours = conversion window after click
+func GetPromoResults(c *gin.Context) {
+	promoId, _ := strconv.ParseInt(c.Params.ByName("promo_id"), 10, 64)
+
+	hours, _ := strconv.ParseInt(c.Query("hours"), 10, 64)
+	if hours <= 0 {
+		hours = promoConversionHours
+	}
+
+	from, _ := strconv.ParseInt(c.Query("from"), 10, 64)
+	to, _ := strconv.ParseInt(c.Query("to"), 10, 64)
+	if to == 0 {
+		to = time.Now().Unix()
+	}
+	fromDay := promoStatDay(time.Unix(from, 0))
+	toDay := promoStatDay(time.Unix(to, 0))
+
+	// an order converts only the latest click of the user before it
+	var variants []PromoVariantResult
+	_, err := dbmap.Select(&variants, `SELECT v.creative_id, COALESCE(pc.name, 'default') AS name,
+		v.impressions, v.clicks,
+		(SELECT COUNT(*) FROM ordervendor ov
+			JOIN LATERAL (SELECT k.creative_id, k.created_date FROM promoclick k
+				WHERE k.promo_id = $1 AND k.user_id = ov.user_id
+					AND k.created_date <= ov.order_date AND k.created_date > ov.order_date - $6
+				ORDER BY k.created_date DESC, k.id DESC LIMIT 1) lk ON true
+			WHERE ov.order_date BETWEEN $4 AND $5 + $6
+				AND lk.creative_id = v.creative_id AND lk.created_date BETWEEN $4 AND $5) AS conversions
+		FROM (SELECT creative_id, SUM(impressions) AS impressions, SUM(clicks) AS clicks
+			FROM promostat WHERE promo_id = $1 AND day BETWEEN $2 AND $3
+			GROUP BY creative_id) v
+		LEFT JOIN promocreative pc ON pc.id = v.creative_id
+		ORDER BY v.creative_id`, promoId, fromDay, toDay, from, to, hours*3600)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	for i := range variants {
+		variant := &variants[i]
+		if variant.Conversions > variant.Clicks {
+			// clicks are counted per day, conversions per click time
+			variant.Conversions = variant.Clicks
+		}
+
+		if variant.Impressions > 0 {
+			variant.Ctr = float64(variant.Clicks) / float64(variant.Impressions)
+		}
+		variant.CtrLow, variant.CtrHigh = wilsonInterval(variant.Clicks, variant.Impressions)
+
+		if variant.Clicks > 0 {
+			variant.ConversionRate = float64(variant.Conversions) / float64(variant.Clicks)
+		}
+		variant.ConversionRateLow, variant.ConversionRateHigh = wilsonInterval(variant.Conversions,
+			variant.Clicks)
+
+		dbmap.Select(&variant.Daily, `SELECT * FROM promostat
+			WHERE promo_id=$1 AND creative_id=$2 AND day BETWEEN $3 AND $4 ORDER BY day`,
+			promoId, variant.CreativeId, fromDay, toDay)
+	}
+
+	c.JSON(200, gin.H{"data": gin.H{
+		"promo_id":         promoId,
+		"conversion_hours": hours,
+		"variants":         variants,
+	}})
+}
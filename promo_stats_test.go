@@ -0,0 +1,29 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWilsonInterval(t *testing.T) {
+	tests := []struct {
+		successes int64
+		total     int64
+		low       float64
+		high      float64
+	}{
+		{0, 0, 0, 0},
+		{0, 10, 0, 0.2775},
+		{5, 10, 0.2366, 0.7634},
+		{10, 10, 0.7225, 1},
+		{50, 1000, 0.0381, 0.0653},
+	}
+
+	for _, test := range tests {
+		low, high := wilsonInterval(test.successes, test.total)
+		if math.Abs(low-test.low) > 0.0001 || math.Abs(high-test.high) > 0.0001 {
+			t.Errorf("wilsonInterval(%d, %d) = %.4f, %.4f, want %.4f, %.4f", test.successes, test.total,
+				low, high, test.low, test.high)
+		}
+	}
+}
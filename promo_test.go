@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareVersion(t *testing.T) {
+	tests := []struct {
+		a      string
+		b      string
+		result int
+	}{
+		{"1.2.0", "1.2.0", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.10.0", "1.9.9", 1},
+		{"1.9", "1.10", -1},
+		{"2", "1.99.99", 1},
+		{" 1.3 ", "1.3", 0},
+		{"", "0.0.1", -1},
+	}
+
+	for _, test := range tests {
+		if result := compareVersion(test.a, test.b); result != test.result {
+			t.Errorf("compareVersion(%q, %q) = %d, want %d", test.a, test.b, result, test.result)
+		}
+	}
+}
+
+func TestParsePromoTarget(t *testing.T) {
+	tests := []struct {
+		target    string
+		targeting PromoTargeting
+	}{
+		{"", PromoTargeting{}},
+		{"Semua pengguna Jakarta", PromoTargeting{}},
+		{"city=Jakarta, Bandung ,", PromoTargeting{Cities: []string{"Jakarta", "Bandung"}}},
+		{"jasa=1,x,3", PromoTargeting{JasaIds: []int64{1, 3}}},
+		{"user=new; app_min=1.2.0 ;app_max=2.0", PromoTargeting{UserType: promoUserNew,
+			MinAppVersion: "1.2.0", MaxAppVersion: "2.0"}},
+		{"city=Depok;jasa=4;unknown=1", PromoTargeting{Cities: []string{"Depok"}, JasaIds: []int64{4}}},
+	}
+
+	for _, test := range tests {
+		if targeting := parsePromoTarget(test.target); !reflect.DeepEqual(targeting, test.targeting) {
+			t.Errorf("parsePromoTarget(%q) = %+v, want %+v", test.target, targeting, test.targeting)
+		}
+	}
+}
+
+func TestPromoTargetingString(t *testing.T) {
+	target := "city=Jakarta,Bandung;jasa=1,3;user=returning;app_min=1.2.0"
+	if parsed := parsePromoTarget(target).String(); parsed != target {
+		t.Errorf("parsePromoTarget(%q).String() = %q", target, parsed)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= PROVIDER STATS
+
+/**
+Provider stats, projection read by provider search instead of aggregating on every request
+ProviderId
+Rating			average of visible order ratings
+ReviewCount
+Rating1 .. Rating5	histogram of order ratings
+MinPrice, MaxPrice	of price list
+CompletedJobs
+CanceledJobs		orders canceled by the provider
+CancellationRate	canceled / (completed + canceled)
+LastActive		last order journey or online status change
+UpdatedDate
+
+Kept current by the handlers changing ratings or prices and by the event bus consumer
+refreshProviderStatsEvent for orders and online status, rebuilt from scratch by admin
+*/
+type ProviderStats struct {
+	ProviderId       int64   `db:"provider_id" json:"provider_id"`
+	Rating           float64 `db:"rating" json:"rating"`
+	ReviewCount      int64   `db:"review_count" json:"review_count"`
+	Rating1          int64   `db:"rating_1" json:"rating_1"`
+	Rating2          int64   `db:"rating_2" json:"rating_2"`
+	Rating3          int64   `db:"rating_3" json:"rating_3"`
+	Rating4          int64   `db:"rating_4" json:"rating_4"`
+	Rating5          int64   `db:"rating_5" json:"rating_5"`
+	MinPrice         int64   `db:"min_price" json:"min_price"`
+	MaxPrice         int64   `db:"max_price" json:"max_price"`
+	CompletedJobs    int64   `db:"completed_jobs" json:"completed_jobs"`
+	CanceledJobs     int64   `db:"canceled_jobs" json:"canceled_jobs"`
+	CancellationRate float64 `db:"cancellation_rate" json:"cancellation_rate"`
+	LastActive       int64   `db:"last_active" json:"last_active"`
+	UpdatedDate      int64   `db:"updated_date" json:"updated_date"`
+}
+
+// providerStatsQuery stats of providers matching the condition on pd, $1 is the update date
+const providerStatsQuery = `
+	SELECT pd.id AS provider_id,
+		COALESCE(r.rating, 0)::float AS rating,
+		COALESCE(r.review_count, 0) AS review_count,
+		COALESCE(r.rating_1, 0) AS rating_1,
+		COALESCE(r.rating_2, 0) AS rating_2,
+		COALESCE(r.rating_3, 0) AS rating_3,
+		COALESCE(r.rating_4, 0) AS rating_4,
+		COALESCE(r.rating_5, 0) AS rating_5,
+		COALESCE(p.min_price, 0) AS min_price,
+		COALESCE(p.max_price, 0) AS max_price,
+		COALESCE(j.completed_jobs, 0) AS completed_jobs,
+		COALESCE(j.canceled_jobs, 0) AS canceled_jobs,
+		CASE WHEN COALESCE(j.completed_jobs, 0) + COALESCE(j.canceled_jobs, 0) = 0 THEN 0
+			ELSE j.canceled_jobs::float / (j.completed_jobs + j.canceled_jobs) END AS cancellation_rate,
+		GREATEST(COALESCE(j.last_journey, 0), COALESCE(e.last_status, 0)) AS last_active,
+		$1::bigint AS updated_date
+	FROM providerdata pd
+		LEFT JOIN LATERAL (
+			SELECT AVG(user_rating) AS rating, COUNT(*) AS review_count,
+				COUNT(*) FILTER (WHERE user_rating = 1) AS rating_1,
+				COUNT(*) FILTER (WHERE user_rating = 2) AS rating_2,
+				COUNT(*) FILTER (WHERE user_rating = 3) AS rating_3,
+				COUNT(*) FILTER (WHERE user_rating = 4) AS rating_4,
+				COUNT(*) FILTER (WHERE user_rating = 5) AS rating_5
+			FROM providerrating WHERE provider_id = pd.id AND order_id <> 0 AND hidden=0) r ON true
+		LEFT JOIN LATERAL (
+			SELECT MIN(service_price) AS min_price, MAX(service_price) AS max_price
+			FROM providerpricelist WHERE provider_id = pd.id) p ON true
+		LEFT JOIN LATERAL (
+			SELECT COUNT(*) FILTER (WHERE oj.status = 6) AS completed_jobs,
+				COUNT(*) FILTER (WHERE EXISTS (SELECT 1 FROM ordercancel oc
+					WHERE oc.order_id = oj.order_id AND oc.canceled_by = 2)) AS canceled_jobs,
+				MAX(oj.last_date) AS last_journey
+			FROM (SELECT ovj.order_id, MAX(ovj.status) AS status, MAX(ovj.date) AS last_date
+				FROM ordervendor ov JOIN ordervendorjourney ovj ON ovj.order_id = ov.id
+				WHERE ov.provider_id = pd.id GROUP BY ovj.order_id) oj) j ON true
+		LEFT JOIN LATERAL (
+			SELECT MAX(created_date) AS last_status FROM busevent
+			WHERE provider_id = pd.id AND topic IN ('provider_online', 'provider_offline')) e ON true`
+
+const providerStatsColumns = `provider_id, rating, review_count, rating_1, rating_2, rating_3,
+	rating_4, rating_5, min_price, max_price, completed_jobs, canceled_jobs, cancellation_rate,
+	last_active, updated_date`
+
+// providerStatsUpsert update existing row, last_active never moves back
+const providerStatsUpsert = `
+	ON CONFLICT (provider_id) DO UPDATE SET rating=EXCLUDED.rating,
+		review_count=EXCLUDED.review_count, rating_1=EXCLUDED.rating_1,
+		rating_2=EXCLUDED.rating_2, rating_3=EXCLUDED.rating_3, rating_4=EXCLUDED.rating_4,
+		rating_5=EXCLUDED.rating_5, min_price=EXCLUDED.min_price, max_price=EXCLUDED.max_price,
+		completed_jobs=EXCLUDED.completed_jobs, canceled_jobs=EXCLUDED.canceled_jobs,
+		cancellation_rate=EXCLUDED.cancellation_rate,
+		last_active=GREATEST(provider_stats.last_active, EXCLUDED.last_active),
+		updated_date=EXCLUDED.updated_date`
+
+// refreshProviderStats recompute stats of one provider in a single statement,
+// last active never moves back after bus events are pruned
+func refreshProviderStats(providerId int64) error {
+	_, err := db.Exec(`INSERT INTO provider_stats(`+providerStatsColumns+`)`+providerStatsQuery+`
+		WHERE pd.id = $2`+providerStatsUpsert, time.Now().Unix(), providerId)
+	return err
+}
+
+// rebuildProviderStats recompute every row in place, rows of removed providers are deleted,
+// readers see the old rows until commit
+func rebuildProviderStats() (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM provider_stats ps
+		WHERE NOT EXISTS (SELECT 1 FROM providerdata pd WHERE pd.id = ps.provider_id)`); err != nil {
+		return 0, err
+	}
+
+	// WHERE keeps ON CONFLICT from being parsed as a join condition
+	result, err := tx.Exec(`INSERT INTO provider_stats(`+providerStatsColumns+`)`+providerStatsQuery+`
+		WHERE true`+providerStatsUpsert, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	count, _ := result.RowsAffected()
+	return count, tx.Commit()
+}
+
+// syncProviderStats refresh stats after a change of the provider, failure only delays the
+// stats until the next change or rebuild
+func syncProviderStats(providerId int64) {
+	if err := refreshProviderStats(providerId); err != nil {
+		log.Println("Refresh provider stats failed", providerId, err)
+	}
+}
+
+// refreshProviderStatsEvent bus consumer, order events carry the order, status events the provider
+func refreshProviderStatsEvent(event BusEvent) {
+	providerId := event.ProviderId
+	if providerId == 0 && event.OrderId != 0 {
+		providerId, _ = dbmap.SelectInt(`SELECT provider_id FROM ordervendor WHERE id=$1`, event.OrderId)
+	}
+
+	if providerId != 0 {
+		syncProviderStats(providerId)
+	}
+}
+
+// GetProviderStats stats of a provider
+func GetProviderStats(c *gin.Context) {
+	var stats ProviderStats
+	if err := dbmap.SelectOne(&stats, `SELECT * FROM provider_stats WHERE provider_id=$1`,
+		c.Params.ByName("provider_id")); err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": stats})
+}
+
+// PostRebuildProviderStats admin recompute stats of every provider
+func PostRebuildProviderStats(c *gin.Context) {
+	count, err := rebuildProviderStats()
+	if err != nil {
+		log.Println("Rebuild provider stats failed", err)
+		c.JSON(400, gin.H{"error": "rebuild failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success", "count": count})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= RATING
+
+/**
+Rating photo, optional photos of an order rating
+Id
+RatingId
+ImageUrl
+CreatedDate
+*/
+type RatingPhoto struct {
+	Id          int64  `db:"id" json:"id"`
+	RatingId    int64  `db:"rating_id" json:"rating_id"`
+	ImageUrl    string `db:"image_url" json:"image_url"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Post order rating
+OrderId		complete order of the user
+UserRating	1 - 5
+Review
+Photos		image urls, on edit nil keeps the current photos
+*/
+type PostOrderRating struct {
+	OrderId    int64     `json:"order_id"`
+	UserRating int64     `json:"user_rating"`
+	Review     string    `json:"review"`
+	Photos     *[]string `json:"photos"`
+}
+
+type RatingItem struct {
+	ProviderRating
+	Photos []RatingPhoto `json:"photos"`
+}
+
+type RatingSummary struct {
+	Rating float64 `db:"rating" json:"rating"`
+	Count  int64   `db:"count" json:"count"`
+}
+
+var ratingEditWindow = getEnvInt64("RATING_EDIT_WINDOW", 7*24*3600)
+
+func isRatingValue(rating int64) bool {
+	return rating >= 1 && rating <= 5
+}
+
+func insertRatingPhotos(ratingId int64, photos []string) {
+	for _, photo := range photos {
+		if photo == "" {
+			continue
+		}
+
+		db.Exec(`INSERT INTO ratingphoto(rating_id, image_url, created_date) VALUES($1, $2, $3)`,
+			ratingId, photo, time.Now().Unix())
+	}
+}
+
+// getRatingItems attach photos to ratings
+func getRatingItems(ratings []ProviderRating) []RatingItem {
+	items := []RatingItem{}
+	for _, rating := range ratings {
+		item := RatingItem{ProviderRating: rating, Photos: []RatingPhoto{}}
+		dbmap.Select(&item.Photos, `SELECT * FROM ratingphoto WHERE rating_id=$1 ORDER BY id`, rating.Id)
+		items = append(items, item)
+	}
+	return items
+}
+
+// getProviderRatingSummary average and count of visible order ratings of a provider, same
+// ratings as the list
+func getProviderRatingSummary(providerId int64) RatingSummary {
+	var summary RatingSummary
+	dbmap.SelectOne(&summary, `SELECT COALESCE(AVG(user_rating), 0)::float AS rating, COUNT(*) AS count
+		FROM providerrating WHERE provider_id=$1 AND order_id <> 0 AND hidden=0`, providerId)
+	return summary
+}
+
+// PostAddedRating customer rate a complete order, once per order
+func PostAddedRating(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	var postRating PostOrderRating
+	c.Bind(&postRating)
+
+	if !isRatingValue(postRating.UserRating) {
+		c.JSON(400, gin.H{"error": "Rating harus antara 1 sampai 5"})
+		return
+	}
+
+	var order OrderVendor
+	if err := dbmap.SelectOne(&order, `SELECT * FROM ordervendor WHERE id=$1 AND user_id=$2`,
+		postRating.OrderId, userId); err != nil {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	if status, err := getOrderStatus(order.Id); err != nil || status != orderStatusComplete {
+		c.JSON(400, gin.H{"error": "Hanya pesanan yang selesai dapat diberi rating"})
+		return
+	}
+
+	now := time.Now().Unix()
+	rating := ProviderRating{
+		ProviderId:  order.ProviderId,
+		UserId:      userId,
+		UserRating:  postRating.UserRating,
+		Review:      postRating.Review,
+		OrderId:     order.Id,
+		CreatedDate: now,
+		UpdatedDate: now,
+	}
+
+	// unique order_id, a second rating of the same order fails here
+	err := db.QueryRow(`INSERT INTO providerrating(provider_id, user_id, user_rating, review, order_id,
+		created_date, updated_date) VALUES($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT DO NOTHING RETURNING id`, rating.ProviderId, rating.UserId, rating.UserRating,
+		rating.Review, rating.OrderId, rating.CreatedDate, rating.UpdatedDate).Scan(&rating.Id)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Only can give rating once"})
+		return
+	}
+
+	if postRating.Photos != nil {
+		insertRatingPhotos(rating.Id, *postRating.Photos)
+	}
+
+	moderateReview(rating.Id, rating.Review)
+	syncProviderStats(rating.ProviderId)
+
+	c.JSON(200, gin.H{"status": "Success give rating", "data": getRatingItems([]ProviderRating{rating})[0]})
+}
+
+// UpdateProviderRating customer edit rating of an order within the edit window
+func UpdateProviderRating(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	var postRating PostOrderRating
+	c.Bind(&postRating)
+
+	if !isRatingValue(postRating.UserRating) {
+		c.JSON(400, gin.H{"error": "Rating harus antara 1 sampai 5"})
+		return
+	}
+
+	var rating ProviderRating
+	if err := dbmap.SelectOne(&rating, `SELECT * FROM providerrating WHERE order_id=$1 AND user_id=$2`,
+		postRating.OrderId, userId); err != nil || postRating.OrderId == 0 {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	now := time.Now().Unix()
+	if now > rating.CreatedDate+ratingEditWindow {
+		c.JSON(400, gin.H{"error": "Rating sudah tidak dapat diubah"})
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE providerrating SET user_rating=$1, review=$2, updated_date=$3
+		WHERE id=$4`, postRating.UserRating, postRating.Review, now, rating.Id); err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if postRating.Photos != nil {
+		db.Exec(`DELETE FROM ratingphoto WHERE rating_id=$1`, rating.Id)
+		insertRatingPhotos(rating.Id, *postRating.Photos)
+	}
+
+	moderateReview(rating.Id, postRating.Review)
+	syncProviderStats(rating.ProviderId)
+
+	rating.UserRating = postRating.UserRating
+	rating.Review = postRating.Review
+	rating.UpdatedDate = now
+
+	c.JSON(200, gin.H{"status": "update success", "data": getRatingItems([]ProviderRating{rating})[0]})
+}
+
+func getProviderRatings(c *gin.Context, providerId int64) {
+	var providerRating []ProviderRating
+	_, err := dbmap.Select(&providerRating, `SELECT * FROM providerrating
+		WHERE provider_id=$1 AND order_id <> 0 AND hidden=0 ORDER BY id DESC`, providerId)
+
+	if err == nil {
+		summary := getProviderRatingSummary(providerId)
+		c.JSON(200, gin.H{"data": getRatingItems(providerRating), "rating": summary.Rating,
+			"count": summary.Count})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// GetProviderRating order ratings of a provider
+func GetProviderRating(c *gin.Context) {
+	providerId, _ := strconv.ParseInt(c.Params.ByName("provider_id"), 10, 64)
+
+	getProviderRatings(c, providerId)
+}
+
+// GetProviderRatingProvider order ratings of the provider itself
+func GetProviderRatingProvider(c *gin.Context) {
+	getProviderRatings(c, getProviderIdFromToken(c))
+}
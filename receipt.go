@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= RECEIPT
+
+/**
+Order receipt, issued once when order is complete
+Id
+OrderId
+Number		sequential per month, PGL/YYYYMM/000001
+Period		YYYYMM
+Subtotal	total of approved line items
+Discount
+Total
+PaymentMethod
+IssuedDate
+EmailedDate	0 = not emailed yet
+*/
+type OrderReceipt struct {
+	Id            int64  `db:"id" json:"id"`
+	OrderId       int64  `db:"order_id" json:"order_id"`
+	Number        string `db:"number" json:"number"`
+	Period        string `db:"period" json:"period"`
+	Subtotal      int64  `db:"subtotal" json:"subtotal"`
+	Discount      int64  `db:"discount" json:"discount"`
+	Total         int64  `db:"total" json:"total"`
+	PaymentMethod int64  `db:"payment_method" json:"payment_method"`
+	IssuedDate    int64  `db:"issued_date" json:"issued_date"`
+	EmailedDate   int64  `db:"emailed_date" json:"emailed_date"`
+}
+
+/**
+Receipt sequence, last receipt number of a month
+Period		YYYYMM
+LastNumber
+*/
+type ReceiptSequence struct {
+	Period     string `db:"period" json:"period"`
+	LastNumber int64  `db:"last_number" json:"last_number"`
+}
+
+type ReceiptParty struct {
+	Name        string `db:"name"`
+	Address     string `db:"address"`
+	PhoneNumber string `db:"phone_number"`
+	Email       string `db:"email"`
+	JasaName    string `db:"jasa_name"`
+}
+
+type ReceiptItem struct {
+	ServiceName  string `db:"service_name"`
+	ServicePrice int64  `db:"service_price"`
+	Qty          int64  `db:"qty"`
+}
+
+type ReceiptJourney struct {
+	Status int64 `db:"status"`
+	Date   int64 `db:"date"`
+}
+
+type PostReceiptEmail struct {
+	OrderId int64 `json:"order_id"`
+}
+
+type ReceiptData struct {
+	Receipt  OrderReceipt
+	Order    OrderVendor
+	Provider ReceiptParty
+	Customer ReceiptParty
+	Items    []ReceiptItem
+	Journey  []ReceiptJourney
+}
+
+const receiptTimeLayout = "02 Jan 2006 15:04"
+
+var receiptLocation = loadReceiptLocation()
+
+func loadReceiptLocation() *time.Location {
+	location, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		return time.FixedZone("WIB", 7*60*60)
+	}
+	return location
+}
+
+// issueOrderReceipt number and store receipt of a complete order,
+// issuing again returns the existing receipt
+func issueOrderReceipt(orderId int64) (OrderReceipt, error) {
+	var receipt OrderReceipt
+	if err := dbmap.SelectOne(&receipt, `SELECT * FROM orderreceipt WHERE order_id=$1`, orderId); err == nil {
+		return receipt, nil
+	}
+
+	status, err := getOrderStatus(orderId)
+	if err != nil {
+		return receipt, err
+	}
+	if status != 6 {
+		return receipt, fmt.Errorf("order %d is not complete", orderId)
+	}
+
+	var order OrderVendor
+	if err := dbmap.SelectOne(&order, `SELECT id, payment_method FROM ordervendor WHERE id=$1`,
+		orderId); err != nil {
+		return receipt, err
+	}
+
+	subtotal, discount, err := getOrderCharge(orderId)
+	if err != nil {
+		return receipt, err
+	}
+
+	now := time.Now()
+	period := now.In(receiptLocation).Format("200601")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return receipt, err
+	}
+	defer tx.Rollback()
+
+	var number int64
+	if err := tx.QueryRow(`INSERT INTO receiptsequence(period, last_number) VALUES($1, 1)
+		ON CONFLICT (period) DO UPDATE SET last_number = receiptsequence.last_number + 1
+		RETURNING last_number`, period).Scan(&number); err != nil {
+		return receipt, err
+	}
+
+	receipt = OrderReceipt{
+		OrderId:       orderId,
+		Number:        fmt.Sprintf("PGL/%s/%06d", period, number),
+		Period:        period,
+		Subtotal:      subtotal,
+		Discount:      discount,
+		Total:         subtotal - discount,
+		PaymentMethod: int64(order.PaymentMethod),
+		IssuedDate:    now.Unix(),
+	}
+
+	// order_id is unique, a concurrent issue of the same order rolls back its number
+	errInsert := tx.QueryRow(`INSERT INTO orderreceipt(order_id, number, period, subtotal, discount,
+		total, payment_method, issued_date, emailed_date)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, 0) RETURNING id`, receipt.OrderId, receipt.Number,
+		receipt.Period, receipt.Subtotal, receipt.Discount, receipt.Total, receipt.PaymentMethod,
+		receipt.IssuedDate).Scan(&receipt.Id)
+
+	if errInsert == nil {
+		errInsert = tx.Commit()
+	}
+
+	if errInsert != nil {
+		tx.Rollback()
+		if err := dbmap.SelectOne(&receipt, `SELECT * FROM orderreceipt WHERE order_id=$1`,
+			orderId); err != nil {
+			return receipt, errInsert
+		}
+		return receipt, nil
+	}
+
+	log.Println("Issued receipt", receipt.Number, "for order", orderId)
+
+	return receipt, nil
+}
+
+// sendReceiptOnComplete issue receipt of a complete order and email it once
+func sendReceiptOnComplete(orderId int64) {
+	receipt, err := issueOrderReceipt(orderId)
+	if err != nil {
+		log.Println("Issue receipt failed", orderId, err)
+		return
+	}
+
+	if receipt.EmailedDate == 0 {
+		if err := emailOrderReceipt(receipt); err != nil && err != errReceiptSenderDisabled {
+			log.Println("Email receipt failed", receipt.Number, err)
+		}
+	}
+}
+
+func loadReceiptData(receipt OrderReceipt) (ReceiptData, error) {
+	data := ReceiptData{Receipt: receipt}
+
+	if err := dbmap.SelectOne(&data.Order, `SELECT * FROM ordervendor WHERE id=$1`,
+		receipt.OrderId); err != nil {
+		return data, err
+	}
+
+	if err := dbmap.SelectOne(&data.Provider, `SELECT pd.nama as name, pd.alamat as address,
+			pd.phone_number, pd.email, kj.jenis as jasa_name
+		FROM providerdata pd
+			JOIN kategorijasa kj ON kj.id = pd.jasa_id
+		WHERE pd.id=$1`, data.Order.ProviderId); err != nil {
+		return data, err
+	}
+
+	if err := dbmap.SelectOne(&data.Customer, `SELECT COALESCE(up.full_name, '') as name,
+			COALESCE(up.address, '') as address, COALESCE(up.phone_number, '') as phone_number,
+			ua.email, '' as jasa_name
+		FROM useraccount ua
+			LEFT JOIN userprofile up ON up.user_id = ua.id
+		WHERE ua.id=$1`, data.Order.UserId); err != nil {
+		return data, err
+	}
+
+	if _, err := dbmap.Select(&data.Items, `SELECT service_name, service_price, qty
+		FROM ordervendorcurrentdetail WHERE order_id=$1 ORDER BY id ASC`,
+		receipt.OrderId); err != nil {
+		return data, err
+	}
+
+	_, err := dbmap.Select(&data.Journey, `SELECT status, MIN(date) as date FROM ordervendorjourney
+		WHERE order_id=$1 GROUP BY status ORDER BY status ASC`, receipt.OrderId)
+
+	return data, err
+}
+
+func formatRupiah(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	digits := strconv.FormatInt(amount, 10)
+	var buffer bytes.Buffer
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			buffer.WriteByte('.')
+		}
+		buffer.WriteRune(digit)
+	}
+
+	return sign + "Rp " + buffer.String()
+}
+
+func formatReceiptDate(date int64) string {
+	return time.Unix(date, 0).In(receiptLocation).Format(receiptTimeLayout)
+}
+
+func paymentMethodName(paymentMethod int64) string {
+	switch paymentMethod {
+	case paymentMethodCash:
+		return "Tunai"
+	case paymentMethodVirtualAccount:
+		return "Transfer virtual account"
+	case paymentMethodEWallet:
+		return "Dompet digital"
+	}
+	return "Non tunai"
+}
+
+func journeyStatusName(status int64) string {
+	switch status {
+	case 0:
+		return "Pesanan dibuat"
+	case 1:
+		return "Dikonfirmasi"
+	case 2:
+		return "Menuju lokasi"
+	case 3:
+		return "Tiba di lokasi"
+	case 4:
+		return "Mulai bekerja"
+	case 5:
+		return "Pekerjaan selesai"
+	case 6:
+		return "Pesanan selesai"
+	}
+	return strconv.FormatInt(status, 10)
+}
+
+var receiptTemplate = template.Must(template.New("receipt").Funcs(template.FuncMap{
+	"rupiah":  formatRupiah,
+	"date":    formatReceiptDate,
+	"payment": paymentMethodName,
+	"journey": journeyStatusName,
+	"lineTotal": func(item ReceiptItem) int64 {
+		return item.ServicePrice * item.Qty
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Kuitansi {{.Receipt.Number}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 14px; color: #333; max-width: 640px; margin: 24px auto; }
+table { width: 100%; border-collapse: collapse; margin: 12px 0; }
+th, td { padding: 6px 4px; text-align: left; border-bottom: 1px solid #eee; }
+.amount { text-align: right; }
+.total td { font-weight: bold; border-bottom: none; }
+</style>
+</head>
+<body>
+<h2>Kuitansi Panggilin</h2>
+<p>No. {{.Receipt.Number}}<br>Tanggal {{date .Receipt.IssuedDate}}<br>Pesanan #{{.Order.Id}}</p>
+<table>
+<tr><th>Penyedia jasa</th><th>Pelanggan</th></tr>
+<tr>
+<td>{{.Provider.Name}}<br>{{.Provider.JasaName}}<br>{{.Provider.Address}}<br>{{.Provider.PhoneNumber}}</td>
+<td>{{.Customer.Name}}<br>{{.Order.Destination}}<br>{{.Customer.PhoneNumber}}</td>
+</tr>
+</table>
+<table>
+<tr><th>Layanan</th><th class="amount">Harga</th><th class="amount">Jumlah</th><th class="amount">Total</th></tr>
+{{range .Items}}<tr><td>{{.ServiceName}}</td><td class="amount">{{rupiah .ServicePrice}}</td><td class="amount">{{.Qty}}</td><td class="amount">{{rupiah (lineTotal .)}}</td></tr>
+{{end}}<tr><td colspan="3">Subtotal</td><td class="amount">{{rupiah .Receipt.Subtotal}}</td></tr>
+<tr><td colspan="3">Diskon</td><td class="amount">{{rupiah .Receipt.Discount}}</td></tr>
+<tr class="total"><td colspan="3">Total</td><td class="amount">{{rupiah .Receipt.Total}}</td></tr>
+</table>
+<p>Metode pembayaran: {{payment .Receipt.PaymentMethod}}</p>
+<table>
+<tr><th>Perjalanan pesanan</th><th class="amount">Waktu</th></tr>
+{{range .Journey}}<tr><td>{{journey .Status}}</td><td class="amount">{{date .Date}}</td></tr>
+{{end}}</table>
+<p>Terima kasih telah menggunakan Panggilin.</p>
+</body>
+</html>
+`))
+
+func renderReceiptHTML(data ReceiptData) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := receiptTemplate.Execute(&buffer, data)
+
+	return buffer.Bytes(), err
+}
+
+func renderReceiptPDF(data ReceiptData) []byte {
+	doc := newPdfDocument()
+
+	doc.Text(16, "Kuitansi Panggilin")
+	doc.Space()
+	doc.Text(10, "No. "+data.Receipt.Number)
+	doc.Text(10, "Tanggal "+formatReceiptDate(data.Receipt.IssuedDate))
+	doc.Text(10, "Pesanan #"+strconv.FormatInt(data.Order.Id, 10))
+	doc.Space()
+
+	doc.Text(11, "Penyedia jasa")
+	doc.Text(10, data.Provider.Name+" - "+data.Provider.JasaName)
+	doc.Text(10, data.Provider.Address)
+	doc.Text(10, data.Provider.PhoneNumber)
+	doc.Space()
+
+	doc.Text(11, "Pelanggan")
+	doc.Text(10, data.Customer.Name)
+	doc.Text(10, data.Order.Destination)
+	doc.Text(10, data.Customer.PhoneNumber)
+	doc.Space()
+
+	doc.Row(11, "Layanan", "Harga", "Jumlah", "Total")
+	for _, item := range data.Items {
+		doc.Row(10, item.ServiceName, formatRupiah(item.ServicePrice),
+			strconv.FormatInt(item.Qty, 10), formatRupiah(item.ServicePrice*item.Qty))
+	}
+	doc.Space()
+	doc.Row(10, "Subtotal", "", "", formatRupiah(data.Receipt.Subtotal))
+	doc.Row(10, "Diskon", "", "", formatRupiah(data.Receipt.Discount))
+	doc.Row(11, "Total", "", "", formatRupiah(data.Receipt.Total))
+	doc.Space()
+
+	doc.Text(10, "Metode pembayaran: "+paymentMethodName(data.Receipt.PaymentMethod))
+	doc.Space()
+
+	doc.Text(11, "Perjalanan pesanan")
+	for _, journey := range data.Journey {
+		doc.Row(10, journeyStatusName(journey.Status), "", "", formatReceiptDate(journey.Date))
+	}
+	doc.Space()
+	doc.Text(10, "Terima kasih telah menggunakan Panggilin.")
+
+	return doc.Bytes()
+}
+
+// emailOrderReceipt send receipt to customer email through receiptSender
+func emailOrderReceipt(receipt OrderReceipt) error {
+	data, err := loadReceiptData(receipt)
+	if err != nil {
+		return err
+	}
+
+	if data.Customer.Email == "" {
+		return fmt.Errorf("customer of order %d has no email", receipt.OrderId)
+	}
+
+	html, err := renderReceiptHTML(data)
+	if err != nil {
+		return err
+	}
+
+	err = receiptSender.Send(data.Customer.Email, "Kuitansi Panggilin "+receipt.Number, html,
+		renderReceiptPDF(data), receiptFileName(receipt))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE orderreceipt SET emailed_date=$1 WHERE id=$2`, time.Now().Unix(),
+		receipt.Id)
+
+	return err
+}
+
+func receiptFileName(receipt OrderReceipt) string {
+	return "kuitansi-" + receipt.Period + "-" + strconv.FormatInt(receipt.Id, 10) + ".pdf"
+}
+
+// GetUserOrderReceipt receipt of customer order, format=pdf to download PDF
+func GetUserOrderReceipt(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+	orderId, _ := strconv.ParseInt(c.Params.ByName("order_id"), 10, 64)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND user_id=$2`,
+		orderId, userId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	responseOrderReceipt(c, orderId)
+}
+
+// GetProviderOrderReceipt receipt of provider order, format=pdf to download PDF
+func GetProviderOrderReceipt(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+	orderId, _ := strconv.ParseInt(c.Params.ByName("order_id"), 10, 64)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND provider_id=$2`,
+		orderId, providerId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	responseOrderReceipt(c, orderId)
+}
+
+func responseOrderReceipt(c *gin.Context, orderId int64) {
+	receipt, err := issueOrderReceipt(orderId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Kuitansi hanya tersedia untuk pesanan yang telah selesai"})
+		return
+	}
+
+	data, err := loadReceiptData(receipt)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	if c.Query("format") == "pdf" {
+		c.Header("Content-Disposition", `attachment; filename="`+receiptFileName(receipt)+`"`)
+		c.Data(200, "application/pdf", renderReceiptPDF(data))
+		return
+	}
+
+	html, err := renderReceiptHTML(data)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "render failed"})
+		return
+	}
+
+	c.Data(200, "text/html; charset=utf-8", html)
+}
+
+// PostEmailOrderReceipt send receipt of customer order to customer email again
+func PostEmailOrderReceipt(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	var postReceipt PostReceiptEmail
+	c.Bind(&postReceipt)
+
+	count, err := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND user_id=$2`,
+		postReceipt.OrderId, userId)
+
+	if err != nil || count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	receipt, err := issueOrderReceipt(postReceipt.OrderId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Kuitansi hanya tersedia untuk pesanan yang telah selesai"})
+		return
+	}
+
+	if err := emailOrderReceipt(receipt); err == errReceiptSenderDisabled {
+		c.JSON(400, gin.H{"error": "Pengiriman kuitansi lewat email belum tersedia"})
+		return
+	} else if err != nil {
+		log.Println("Email receipt failed", receipt.Number, err)
+		c.JSON(400, gin.H{"error": "Gagal mengirim kuitansi"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Kuitansi telah dikirim", "number": receipt.Number})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ========================= PDF
+
+// pdfDocument minimal A4 PDF writer, text only with built-in Helvetica
+type pdfDocument struct {
+	pages [][]string
+	y     float64
+}
+
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+	pdfMargin     = 50.0
+)
+
+// columns of Row, x position of each cell, last one is right aligned amount
+var pdfColumns = []float64{pdfMargin, 300, 400, 545}
+
+func newPdfDocument() *pdfDocument {
+	doc := &pdfDocument{}
+	doc.newPage()
+	return doc
+}
+
+func (doc *pdfDocument) newPage() {
+	doc.pages = append(doc.pages, []string{})
+	doc.y = pdfPageHeight - pdfMargin
+}
+
+func (doc *pdfDocument) nextLine(size float64) {
+	doc.y -= size * 1.5
+	if doc.y < pdfMargin {
+		doc.newPage()
+		doc.y -= size * 1.5
+	}
+}
+
+func (doc *pdfDocument) draw(size float64, x float64, text string) {
+	page := len(doc.pages) - 1
+	doc.pages[page] = append(doc.pages[page],
+		fmt.Sprintf("BT /F1 %.0f Tf %.2f %.2f Td (%s) Tj ET", size, x, doc.y, pdfEscape(text)))
+}
+
+// Text one line of text
+func (doc *pdfDocument) Text(size float64, text string) {
+	doc.nextLine(size)
+	doc.draw(size, pdfMargin, text)
+}
+
+// Row one line of table, the last cell is right aligned
+func (doc *pdfDocument) Row(size float64, cells ...string) {
+	doc.nextLine(size)
+
+	for i, cell := range cells {
+		if cell == "" || i >= len(pdfColumns) {
+			continue
+		}
+
+		x := pdfColumns[i]
+		if i == len(pdfColumns)-1 {
+			// Helvetica averages about half of font size per glyph
+			x -= float64(len(cell)) * size * 0.5
+		}
+		doc.draw(size, x, cell)
+	}
+}
+
+// Space empty line
+func (doc *pdfDocument) Space() {
+	doc.nextLine(6)
+}
+
+// Bytes render pages into PDF file
+func (doc *pdfDocument) Bytes() []byte {
+	var buffer bytes.Buffer
+	var offsets []int
+
+	writeObject := func(body string) {
+		offsets = append(offsets, buffer.Len())
+		fmt.Fprintf(&buffer, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buffer.WriteString("%PDF-1.4\n")
+
+	// 1 catalog, 2 pages, 3 font, then page and content pairs
+	var kids []string
+	for i := range doc.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+i*2))
+	}
+
+	writeObject("<< /Type /Catalog /Pages 2 0 R >>")
+	writeObject(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>",
+		strings.Join(kids, " "), len(doc.pages)))
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range doc.pages {
+		content := strings.Join(page, "\n")
+
+		writeObject(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] "+
+			"/Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 5+i*2))
+		writeObject(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+
+	xref := buffer.Len()
+	fmt.Fprintf(&buffer, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buffer, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buffer, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(offsets)+1, xref)
+
+	return buffer.Bytes()
+}
+
+// pdfEscape escape string literal, characters outside Latin-1 are replaced
+func pdfEscape(text string) string {
+	var buffer bytes.Buffer
+
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			buffer.WriteByte('\\')
+			buffer.WriteRune(r)
+		case r == '\n' || r == '\r' || r == '\t':
+			buffer.WriteByte(' ')
+		case r < 32 || r > 255:
+			buffer.WriteByte('?')
+		case r > 127:
+			fmt.Fprintf(&buffer, "\\%03o", r)
+		default:
+			buffer.WriteRune(r)
+		}
+	}
+
+	return buffer.String()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPdfEscape(t *testing.T) {
+	tests := []struct {
+		text    string
+		escaped string
+	}{
+		{"Cuci AC", "Cuci AC"},
+		{"Servis (2 unit)", `Servis \(2 unit\)`},
+		{`C:\jalan`, `C:\\jalan`},
+		{"Jl. Sudirman\nNo. 1", "Jl. Sudirman No. 1"},
+		{"Café", `Caf\351`},
+		{"Rp 10.000 ✓", "Rp 10.000 ?"},
+		{"a\x00b", "a?b"},
+	}
+
+	for _, test := range tests {
+		if escaped := pdfEscape(test.text); escaped != test.escaped {
+			t.Errorf("pdfEscape(%q) = %q, want %q", test.text, escaped, test.escaped)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"time"
+)
+
+// ========================= RECEIPT SENDER
+
+// ReceiptSender deliver receipt email with PDF attachment
+type ReceiptSender interface {
+	Send(to string, subject string, html []byte, pdf []byte, fileName string) error
+}
+
+var errReceiptSenderDisabled = errors.New("receipt email is disabled, SMTP_HOST is not configured")
+
+// logReceiptSender only log, used when SMTP is not configured, nothing is sent
+type logReceiptSender struct{}
+
+func (s logReceiptSender) Send(to string, subject string, html []byte, pdf []byte, fileName string) error {
+	log.Println("Receipt email not sent, SMTP_HOST is not configured:", to, subject)
+	return errReceiptSenderDisabled
+}
+
+// smtpReceiptSender send multipart email through SMTP with plain auth
+type smtpReceiptSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s smtpReceiptSender) Send(to string, subject string, html []byte, pdf []byte, fileName string) error {
+	boundary := fmt.Sprintf("pengine-%d", time.Now().UnixNano())
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", s.From)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	message.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", boundary)
+
+	fmt.Fprintf(&message, "--%s\r\n", boundary)
+	message.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n")
+	message.Write(html)
+	message.WriteString("\r\n")
+
+	fmt.Fprintf(&message, "--%s\r\n", boundary)
+	message.WriteString("Content-Type: application/pdf\r\n")
+	message.WriteString("Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(&message, "Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", fileName)
+
+	encoded := base64.StdEncoding.EncodeToString(pdf)
+	for len(encoded) > 76 {
+		message.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	message.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&message, "--%s--\r\n", boundary)
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	return smtp.SendMail(s.Host+":"+s.Port, auth, s.From, []string{to}, message.Bytes())
+}
+
+var receiptSender = newReceiptSender()
+
+// newReceiptSender SMTP sender when SMTP_HOST is set, otherwise log only
+func newReceiptSender() ReceiptSender {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return logReceiptSender{}
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	from := os.Getenv("RECEIPT_EMAIL_FROM")
+	if from == "" {
+		from = "no-reply@panggilin.com"
+	}
+
+	return smtpReceiptSender{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}
+}
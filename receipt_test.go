@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFormatRupiah(t *testing.T) {
+	tests := []struct {
+		amount int64
+		text   string
+	}{
+		{0, "Rp 0"},
+		{500, "Rp 500"},
+		{1000, "Rp 1.000"},
+		{25000, "Rp 25.000"},
+		{1250000, "Rp 1.250.000"},
+		{-15000, "-Rp 15.000"},
+	}
+
+	for _, test := range tests {
+		if text := formatRupiah(test.amount); text != test.text {
+			t.Errorf("formatRupiah(%d) = %q, want %q", test.amount, text, test.text)
+		}
+	}
+}
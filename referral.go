@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= REFERRAL
+
+/**
+Referral code, one per account
+Id
+OwnerType	1 = user, 2 = provider
+OwnerId		useraccount id or provider id
+Code		unique
+CreatedDate
+*/
+type ReferralCode struct {
+	Id          int64  `db:"id" json:"id"`
+	OwnerType   int8   `db:"owner_type" json:"owner_type"`
+	OwnerId     int64  `db:"owner_id" json:"owner_id"`
+	Code        string `db:"code" json:"code"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Referral, account signed up with referral code of another account
+Id
+ReferrerType, ReferrerId	owner of the code
+RefereeType, RefereeId		new account, referred once only
+Code
+DeviceToken	device of referee at sign up
+Status		0 = pending first order, 1 = rewarded, 2 = rejected
+RejectReason	self_referral, shared_device, cap_reached, blocked
+ReferrerReward
+RefereeReward
+CreatedDate
+RewardedDate
+*/
+type Referral struct {
+	Id             int64  `db:"id" json:"id"`
+	ReferrerType   int8   `db:"referrer_type" json:"referrer_type"`
+	ReferrerId     int64  `db:"referrer_id" json:"-"`
+	RefereeType    int8   `db:"referee_type" json:"referee_type"`
+	RefereeId      int64  `db:"referee_id" json:"-"`
+	Code           string `db:"code" json:"code"`
+	DeviceToken    string `db:"device_token" json:"-"`
+	Status         int8   `db:"status" json:"status"`
+	RejectReason   string `db:"reject_reason" json:"reject_reason"`
+	ReferrerReward int64  `db:"referrer_reward" json:"referrer_reward"`
+	RefereeReward  int64  `db:"referee_reward" json:"referee_reward"`
+	CreatedDate    int64  `db:"created_date" json:"created_date"`
+	RewardedDate   int64  `db:"rewarded_date" json:"rewarded_date"`
+}
+
+type PostUserSignUp struct {
+	UserAccount
+	ReferralCode string `json:"referral_code"`
+}
+
+type PostProviderSignUp struct {
+	ProviderData
+	ReferralCode string `json:"referral_code"`
+	DeviceToken  string `json:"device_token"`
+}
+
+type ReferralSummary struct {
+	Pending  int64 `db:"pending" json:"pending"`
+	Rewarded int64 `db:"rewarded" json:"rewarded"`
+	Rejected int64 `db:"rejected" json:"rejected"`
+	Earned   int64 `db:"earned" json:"earned"`
+}
+
+const (
+	referralOwnerUser     = 1
+	referralOwnerProvider = 2
+)
+
+const (
+	referralStatusPending  = 0
+	referralStatusRewarded = 1
+	referralStatusRejected = 2
+)
+
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var (
+	referralReferrerReward = getEnvInt64("REFERRAL_REFERRER_REWARD", 20000)
+	referralRefereeReward  = getEnvInt64("REFERRAL_REFEREE_REWARD", 10000)
+	// rewarded referrals per referrer, pending ones count too
+	referralMaxRewards = getEnvInt64("REFERRAL_MAX_REWARDS", 20)
+)
+
+var errReferralCodeNotFound = errors.New("referral code not found")
+
+func newReferralCode() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	code := make([]byte, len(random))
+	for i, b := range random {
+		code[i] = referralCodeAlphabet[int(b)%len(referralCodeAlphabet)]
+	}
+
+	return string(code), nil
+}
+
+// getReferralCode code of the account, created on first use
+func getReferralCode(ownerType int8, ownerId int64) (string, error) {
+	code, err := dbmap.SelectStr(`SELECT code FROM referralcode WHERE owner_type=$1 AND owner_id=$2`,
+		ownerType, ownerId)
+	if err != nil || code != "" {
+		return code, err
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		if code, err = newReferralCode(); err != nil {
+			return "", err
+		}
+
+		// another request may create the code of the same account, or the code is taken
+		result, err := db.Exec(`INSERT INTO referralcode(owner_type, owner_id, code, created_date)
+			VALUES($1, $2, $3, $4) ON CONFLICT DO NOTHING`, ownerType, ownerId, code, time.Now().Unix())
+		if err != nil {
+			return "", err
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 1 {
+			return code, nil
+		}
+
+		existing, err := dbmap.SelectStr(`SELECT code FROM referralcode
+			WHERE owner_type=$1 AND owner_id=$2`, ownerType, ownerId)
+		if err != nil || existing != "" {
+			return existing, err
+		}
+	}
+
+	return "", errors.New("referral code exhausted")
+}
+
+func findReferralCode(code string) (ReferralCode, error) {
+	var referralCode ReferralCode
+	err := dbmap.SelectOne(&referralCode, `SELECT * FROM referralcode WHERE code=$1`, code)
+	if err != nil {
+		return referralCode, errReferralCodeNotFound
+	}
+	return referralCode, nil
+}
+
+// getReferralAccount email and device token of a referral party
+func getReferralAccount(ownerType int8, ownerId int64) (string, string) {
+	var account UserAccount
+	if ownerType == referralOwnerUser {
+		dbmap.SelectOne(&account, `SELECT email, device_token FROM useraccount WHERE id=$1`, ownerId)
+	} else {
+		dbmap.SelectOne(&account, `SELECT email, device_token FROM provideraccount
+			WHERE provider_id=$1`, ownerId)
+	}
+	return account.Email, account.DeviceToken
+}
+
+// recordReferral store referral of a new account, fraud guards reject it right away
+func recordReferral(referralCode ReferralCode, refereeType int8, refereeId int64, email string,
+	deviceToken string) {
+	referral := Referral{
+		ReferrerType: referralCode.OwnerType,
+		ReferrerId:   referralCode.OwnerId,
+		RefereeType:  refereeType,
+		RefereeId:    refereeId,
+		Code:         referralCode.Code,
+		DeviceToken:  deviceToken,
+		Status:       referralStatusPending,
+		CreatedDate:  time.Now().Unix(),
+	}
+
+	referrerEmail, referrerDevice := getReferralAccount(referralCode.OwnerType, referralCode.OwnerId)
+
+	var sharedDevice int64
+	if deviceToken != "" {
+		sharedDevice, _ = dbmap.SelectInt(`SELECT COUNT(*) FROM referral WHERE device_token=$1`,
+			deviceToken)
+	}
+
+	counted, _ := dbmap.SelectInt(`SELECT COUNT(*) FROM referral
+		WHERE referrer_type=$1 AND referrer_id=$2 AND status IN ($3, $4)`, referral.ReferrerType,
+		referral.ReferrerId, referralStatusPending, referralStatusRewarded)
+
+	switch {
+	case (referral.ReferrerType == refereeType && referral.ReferrerId == refereeId) ||
+		(email != "" && referrerEmail == email):
+		referral.Status = referralStatusRejected
+		referral.RejectReason = "self_referral"
+	case deviceToken != "" && (referrerDevice == deviceToken || sharedDevice > 0):
+		referral.Status = referralStatusRejected
+		referral.RejectReason = "shared_device"
+	case counted >= referralMaxRewards:
+		referral.Status = referralStatusRejected
+		referral.RejectReason = "cap_reached"
+	}
+
+	if err := dbmap.Insert(&referral); err != nil {
+		log.Println("Insert referral failed", referralCode.Code, refereeType, refereeId, err)
+	}
+}
+
+func referralLedgerLine(ownerType int8, ownerId int64, amount int64) LedgerLine {
+	if ownerType == referralOwnerProvider {
+		return LedgerLine{Account: ledgerProviderBalance, ProviderId: ownerId, Credit: amount}
+	}
+	return LedgerLine{Account: ledgerCustomerWallet, UserId: ownerId, Credit: amount}
+}
+
+// rewardReferral credit referrer and referee once referee completes the first order or job
+func rewardReferral(refereeType int8, refereeId int64) error {
+	var referral Referral
+	err := dbmap.SelectOne(&referral, `SELECT * FROM referral
+		WHERE referee_type=$1 AND referee_id=$2 AND status=$3`, refereeType, refereeId,
+		referralStatusPending)
+	if err != nil {
+		// not referred, or already rewarded
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// cap is checked again while no other reward of the referrer is granted
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1, $2)`, 43000+int64(referral.ReferrerType),
+		referral.ReferrerId); err != nil {
+		return err
+	}
+
+	var rewarded int64
+	if err = tx.QueryRow(`SELECT COUNT(*) FROM referral
+		WHERE referrer_type=$1 AND referrer_id=$2 AND status=$3`, referral.ReferrerType,
+		referral.ReferrerId, referralStatusRewarded).Scan(&rewarded); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+
+	// customers blocked by provider ratings earn no referral reward
+	rejectReason := ""
+	switch {
+	case (referral.ReferrerType == referralOwnerUser && isCustomerBlocked(referral.ReferrerId)) ||
+		(referral.RefereeType == referralOwnerUser && isCustomerBlocked(referral.RefereeId)):
+		rejectReason = "blocked"
+	case rewarded >= referralMaxRewards:
+		rejectReason = "cap_reached"
+	}
+
+	if rejectReason != "" {
+		if _, err = tx.Exec(`UPDATE referral SET status=$1, reject_reason=$2
+			WHERE id=$3 AND status=$4`, referralStatusRejected, rejectReason, referral.Id,
+			referralStatusPending); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	result, err := tx.Exec(`UPDATE referral SET status=$1, referrer_reward=$2, referee_reward=$3,
+		rewarded_date=$4 WHERE id=$5 AND status=$6`, referralStatusRewarded, referralReferrerReward,
+		referralRefereeReward, now, referral.Id, referralStatusPending)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil
+	}
+
+	lines := []LedgerLine{
+		{Account: ledgerReferralExpense, Debit: referralReferrerReward + referralRefereeReward},
+		referralLedgerLine(referral.ReferrerType, referral.ReferrerId, referralReferrerReward),
+		referralLedgerLine(referral.RefereeType, referral.RefereeId, referralRefereeReward),
+	}
+
+	if _, err = postLedgerTransactionTx(tx, "referral", 0, "referral:"+strconv.FormatInt(referral.Id, 10),
+		"Referral "+referral.Code, lines); err != nil && err != errLedgerPosted {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rewardOrderReferrals first complete order of customer and first complete job of provider
+func rewardOrderReferrals(orderId int64) {
+	var order OrderVendor
+	if err := dbmap.SelectOne(&order, `SELECT * FROM ordervendor WHERE id=$1`, orderId); err != nil {
+		return
+	}
+
+	if err := rewardReferral(referralOwnerUser, order.UserId); err != nil {
+		log.Println("Reward user referral failed", orderId, err)
+	}
+
+	if err := rewardReferral(referralOwnerProvider, order.ProviderId); err != nil {
+		log.Println("Reward provider referral failed", orderId, err)
+	}
+}
+
+func getReferralDashboard(c *gin.Context, ownerType int8, ownerId int64) {
+	code, err := getReferralCode(ownerType, ownerId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	var summary ReferralSummary
+	err = dbmap.SelectOne(&summary, `SELECT
+			COUNT(*) FILTER (WHERE status=$3) AS pending,
+			COUNT(*) FILTER (WHERE status=$4) AS rewarded,
+			COUNT(*) FILTER (WHERE status=$5) AS rejected,
+			COALESCE(SUM(referrer_reward), 0) AS earned
+		FROM referral WHERE referrer_type=$1 AND referrer_id=$2`, ownerType, ownerId,
+		referralStatusPending, referralStatusRewarded, referralStatusRejected)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	var referrals []Referral
+	dbmap.Select(&referrals, `SELECT * FROM referral
+		WHERE referrer_type=$1 AND referrer_id=$2 ORDER BY id DESC`, ownerType, ownerId)
+
+	remaining := referralMaxRewards - summary.Pending - summary.Rewarded
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	c.JSON(200, gin.H{"data": gin.H{
+		"code":            code,
+		"referrer_reward": referralReferrerReward,
+		"referee_reward":  referralRefereeReward,
+		"max_rewards":     referralMaxRewards,
+		"remaining":       remaining,
+		"summary":         summary,
+		"referrals":       referrals,
+	}})
+}
+
+// GetUserReferral referral code and progress of customer
+func GetUserReferral(c *gin.Context) {
+	getReferralDashboard(c, referralOwnerUser, getUserIdFromToken(c))
+}
+
+// GetProviderReferral referral code and progress of provider
+func GetProviderReferral(c *gin.Context) {
+	getReferralDashboard(c, referralOwnerProvider, getProviderIdFromToken(c))
+}
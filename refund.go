@@ -0,0 +1,503 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= REFUND
+
+/**
+Refund of an order payment, from a cancellation or a dispute outcome
+Id
+OrderId
+PaymentId
+CancelId	ordercancel which caused the refund
+DisputeId	orderdispute which caused the refund
+Amount
+Method		1 = through payment gateway, 2 = credit to customer wallet
+Status		0 = pending, 1 = succeeded, 2 = failed
+IdempotencyKey	unique per cause, also sent to the gateway
+GatewayRefundId
+Attempts
+NextAttemptDate
+LastError
+CreatedDate
+UpdatedDate
+CompletedDate
+*/
+type Refund struct {
+	Id              int64  `db:"id" json:"id"`
+	OrderId         int64  `db:"order_id" json:"order_id"`
+	PaymentId       int64  `db:"payment_id" json:"payment_id"`
+	CancelId        int64  `db:"cancel_id" json:"cancel_id"`
+	DisputeId       int64  `db:"dispute_id" json:"dispute_id"`
+	Amount          int64  `db:"amount" json:"amount"`
+	Method          int64  `db:"method" json:"method"`
+	Status          int64  `db:"status" json:"status"`
+	IdempotencyKey  string `db:"idempotency_key" json:"-"`
+	GatewayRefundId string `db:"gateway_refund_id" json:"gateway_refund_id"`
+	Attempts        int64  `db:"attempts" json:"attempts"`
+	NextAttemptDate int64  `db:"next_attempt_date" json:"next_attempt_date"`
+	LastError       string `db:"last_error" json:"last_error"`
+	CreatedDate     int64  `db:"created_date" json:"created_date"`
+	UpdatedDate     int64  `db:"updated_date" json:"updated_date"`
+	CompletedDate   int64  `db:"completed_date" json:"completed_date"`
+}
+
+type PostRetryRefund struct {
+	RefundId int64 `json:"refund_id"`
+}
+
+type RefundOrder struct {
+	UserId     int64 `db:"user_id"`
+	ProviderId int64 `db:"provider_id"`
+}
+
+const (
+	refundMethodGateway = 1
+	refundMethodWallet  = 2
+)
+
+const (
+	refundPending   = 0
+	refundSucceeded = 1
+	refundFailed    = 2
+)
+
+// a claimed refund is not picked again by other instances before this many seconds
+const refundClaimLease = 300
+
+// requestRefund record refund once per idempotency key, the existing one is returned again
+func requestRefund(orderId int64, idempotencyKey string, amount int64, cancelId int64,
+	disputeId int64) (Refund, error) {
+	var refund Refund
+
+	if amount <= 0 {
+		return refund, errors.New("Jumlah pengembalian dana tidak valid")
+	}
+
+	method := int64(refundMethodWallet)
+	limit, err := getOrderAmountDue(orderId)
+	if err != nil {
+		return refund, err
+	}
+
+	payment, err := getOrderPayment(orderId)
+	if err == nil && payment.Method != paymentMethodCash && payment.ChargeId != "" &&
+		(payment.Status == paymentAuthorized || payment.Status == paymentCaptured) {
+		method = refundMethodGateway
+		limit = payment.Amount
+	}
+
+	refunded, _ := dbmap.SelectInt(`SELECT COALESCE(SUM(amount), 0) FROM refund
+		WHERE order_id=$1 AND status<>$2 AND idempotency_key<>$3`, orderId, refundFailed,
+		idempotencyKey)
+	if refunded+amount > limit {
+		amount = limit - refunded
+		if amount <= 0 {
+			return refund, errors.New("Dana pesanan sudah dikembalikan seluruhnya")
+		}
+	}
+
+	now := time.Now().Unix()
+	err = dbmap.SelectOne(&refund, `INSERT INTO refund(order_id, payment_id, cancel_id, dispute_id,
+			amount, method, status, idempotency_key, gateway_refund_id, attempts, next_attempt_date,
+			last_error, created_date, updated_date, completed_date)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, '', 0, $9, '', $9, $9, 0)
+		ON CONFLICT (idempotency_key) DO NOTHING RETURNING *`, orderId, payment.Id, cancelId,
+		disputeId, amount, method, refundPending, idempotencyKey, now)
+
+	if err == sql.ErrNoRows {
+		err = dbmap.SelectOne(&refund, `SELECT * FROM refund WHERE idempotency_key=$1`,
+			idempotencyKey)
+	}
+
+	return refund, err
+}
+
+// settleCanceledPayment void unpaid payment, capture only the fee charged to customer from an
+// authorized one, refund a captured one minus that fee
+func settleCanceledPayment(canceled CanceledOrder) {
+	if canceled.FeeChargedTo == canceledByProvider && canceled.Fee > 0 {
+		providerId, _ := dbmap.SelectInt(`SELECT provider_id FROM ordervendor WHERE id=$1`,
+			canceled.OrderId)
+		if err := postCancelFeeLedger(canceled, LedgerLine{Account: ledgerProviderBalance,
+			ProviderId: providerId, Debit: canceled.Fee}); err != nil {
+			log.Println("Post provider cancel fee failed", canceled.OrderId, err)
+		}
+	}
+
+	payment, err := getOrderPayment(canceled.OrderId)
+	if err != nil {
+		return
+	}
+
+	retained := int64(0)
+	if canceled.FeeChargedTo == canceledByUser && payment.Method != paymentMethodCash {
+		retained = canceled.Fee
+		if retained > payment.Amount {
+			retained = payment.Amount
+		}
+	}
+
+	switch payment.Status {
+	case paymentPending:
+		voidOrderPayment(canceled.OrderId)
+	case paymentAuthorized:
+		if retained == 0 {
+			if _, err := voidAuthorizedPayment(payment); err != nil {
+				log.Println("Void canceled payment failed", canceled.OrderId, err)
+			}
+			return
+		}
+
+		// only the fee is captured, the gateway releases the rest of the authorization
+		db.Exec(`UPDATE payment SET amount=$1 WHERE id=$2`, retained, payment.Id)
+		payment.Amount = retained
+
+		if _, err := captureCharge(payment); err != nil {
+			log.Println("Capture cancel fee failed", canceled.OrderId, err)
+			return
+		}
+
+		postRetainedCancelFee(canceled, retained)
+	case paymentCaptured:
+		amount := payment.Amount
+		if retained > 0 {
+			// the fee never leaves the gateway, it is kept from the captured payment
+			if err := postPaymentLedger(payment); err != nil {
+				log.Println("Post payment ledger failed", payment.Id, err)
+			} else {
+				postRetainedCancelFee(canceled, retained)
+			}
+
+			amount -= retained
+		}
+
+		if amount <= 0 {
+			return
+		}
+
+		refund, err := requestRefund(canceled.OrderId, "cancel:"+strconv.FormatInt(canceled.CancelId, 10),
+			amount, canceled.CancelId, 0)
+		if err != nil {
+			log.Println("Request cancel refund failed", canceled.OrderId, err)
+			return
+		}
+
+		go processRefund(refund.Id)
+	}
+}
+
+// postRetainedCancelFee post fee kept from captured payment of customer
+func postRetainedCancelFee(canceled CanceledOrder, retained int64) {
+	if err := postCancelFeeLedger(canceled, LedgerLine{Account: ledgerCustomerClearing,
+		Debit: retained}); err != nil {
+		log.Println("Post retained cancel fee failed", canceled.OrderId, err)
+	}
+}
+
+// postCancelFeeLedger post fee of cancellation as revenue, debit is the side paying it
+func postCancelFeeLedger(canceled CanceledOrder, debit LedgerLine) error {
+	_, err := postLedgerTransaction("cancel_fee", canceled.OrderId,
+		"cancel_fee:"+strconv.FormatInt(canceled.CancelId, 10),
+		"Biaya pembatalan pesanan #"+strconv.FormatInt(canceled.OrderId, 10), []LedgerLine{
+			debit,
+			{Account: ledgerCancelFeeRevenue, Credit: debit.Debit},
+		})
+	if err == errLedgerPosted {
+		return nil
+	}
+	return err
+}
+
+// claimRefund take pending refund which is due, so only one instance executes an attempt
+func claimRefund(refundId int64) (Refund, error) {
+	var refund Refund
+	now := time.Now().Unix()
+
+	err := dbmap.SelectOne(&refund, `UPDATE refund SET attempts=attempts + 1, next_attempt_date=$1,
+			updated_date=$2
+		WHERE id=$3 AND status=$4 AND next_attempt_date <= $2 RETURNING *`, now+refundClaimLease,
+		now, refundId, refundPending)
+
+	return refund, err
+}
+
+// processRefund execute one attempt, failed attempt is retried with backoff by the worker
+func processRefund(refundId int64) {
+	refund, err := claimRefund(refundId)
+	if err != nil {
+		return
+	}
+
+	if refund.Method == refundMethodWallet {
+		completeRefund(refund, "")
+		return
+	}
+
+	var payment Payment
+	if err := dbmap.SelectOne(&payment, `SELECT * FROM payment WHERE id=$1`,
+		refund.PaymentId); err != nil {
+		retryRefund(refund, err)
+		return
+	}
+
+	// the same idempotency key makes a retry after a lost response safe
+	result, err := paymentGateway.Refund(payment.ChargeId, refund.IdempotencyKey, refund.Amount)
+	if err != nil {
+		retryRefund(refund, err)
+		return
+	}
+
+	switch result.Status {
+	case "succeeded":
+		completeRefund(refund, result.RefundId)
+	case "failed":
+		retryRefund(refund, errors.New("refund failed by gateway"))
+	default:
+		retryRefund(refund, errors.New("refund is "+result.Status))
+	}
+}
+
+// retryRefund schedule next attempt with exponential backoff, fail after REFUND_MAX_ATTEMPTS
+func retryRefund(refund Refund, cause error) {
+	log.Println("Refund attempt failed", refund.Id, refund.Attempts, cause)
+
+	now := time.Now().Unix()
+
+	if refund.Attempts >= getEnvInt64("REFUND_MAX_ATTEMPTS", 8) {
+		db.Exec(`UPDATE refund SET status=$1, last_error=$2, updated_date=$3 WHERE id=$4 AND status=$5`,
+			refundFailed, cause.Error(), now, refund.Id, refundPending)
+		return
+	}
+
+	backoff := int64(60) << uint(refund.Attempts-1)
+	db.Exec(`UPDATE refund SET next_attempt_date=$1, last_error=$2, updated_date=$3
+		WHERE id=$4 AND status=$5`, now+backoff, cause.Error(), now, refund.Id, refundPending)
+}
+
+// completeRefund mark refund succeeded, post reversal to ledger and notify customer
+func completeRefund(refund Refund, gatewayRefundId string) {
+	now := time.Now().Unix()
+
+	result, err := db.Exec(`UPDATE refund SET status=$1, gateway_refund_id=$2, last_error='',
+			updated_date=$3, completed_date=$3
+		WHERE id=$4 AND status=$5`, refundSucceeded, gatewayRefundId, now, refund.Id, refundPending)
+	if err != nil {
+		log.Println("Complete refund failed", refund.Id, err)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return
+	}
+
+	if err := postRefundLedger(refund); err != nil {
+		log.Println("Post refund ledger failed", refund.Id, err)
+	}
+
+	clawbackRefundPoints(refund)
+
+	if refund.Method == refundMethodGateway {
+		var payment Payment
+		if err := dbmap.SelectOne(&payment, `SELECT * FROM payment WHERE id=$1`,
+			refund.PaymentId); err == nil {
+			refunded, _ := dbmap.SelectInt(`SELECT COALESCE(SUM(amount), 0) FROM refund
+				WHERE payment_id=$1 AND status=$2`, payment.Id, refundSucceeded)
+
+			if refunded >= payment.Amount {
+				transitionPayment(payment, paymentRefunded, "refund", strconv.FormatInt(refund.Id, 10))
+			}
+		}
+	}
+
+	message := "Dana sebesar " + formatRupiah(refund.Amount) + " telah dikembalikan."
+	if refund.Method == refundMethodWallet {
+		message = "Saldo Panggilin Anda bertambah " + formatRupiah(refund.Amount) + "."
+	}
+
+	pushToCustomer(refund.OrderId, map[string]string{
+		"message":   message,
+		"type":      "refund",
+		"order_id":  strconv.FormatInt(refund.OrderId, 10),
+		"refund_id": strconv.FormatInt(refund.Id, 10),
+	})
+}
+
+// postRefundLedger reverse commission and provider earning in proportion of refund.
+// Money the order never earned, of a canceled order or paid above the amount due,
+// goes back out of customer clearing, its captured inflow is posted first
+func postRefundLedger(refund Refund) error {
+	var order RefundOrder
+	if err := dbmap.SelectOne(&order, `SELECT user_id, provider_id FROM ordervendor WHERE id=$1`,
+		refund.OrderId); err != nil {
+		return err
+	}
+
+	orderReference := "order:" + strconv.FormatInt(refund.OrderId, 10)
+
+	commission, _ := dbmap.SelectInt(`SELECT COALESCE(SUM(le.credit), 0) FROM ledgerentry le
+			JOIN ledgertransaction lt ON lt.id = le.transaction_id
+		WHERE lt.reference=$1 AND le.account=$2`, orderReference, ledgerCommissionRevenue)
+	earning, _ := dbmap.SelectInt(`SELECT COALESCE(SUM(le.credit), 0) FROM ledgerentry le
+			JOIN ledgertransaction lt ON lt.id = le.transaction_id
+		WHERE lt.reference=$1 AND le.account=$2`, orderReference, ledgerProviderBalance)
+
+	// adjustment refund has neither cancel nor dispute, it returns an overpayment
+	earned := refund.CancelId != 0 || refund.DisputeId != 0
+
+	var lines []LedgerLine
+	if total := commission + earning; total > 0 && earned {
+		commissionPart := refund.Amount * commission / total
+		lines = append(lines,
+			LedgerLine{Account: ledgerCommissionRevenue, Debit: commissionPart},
+			LedgerLine{Account: ledgerProviderBalance, ProviderId: order.ProviderId,
+				Debit: refund.Amount - commissionPart})
+	} else if refund.Method == refundMethodWallet {
+		// platform gives the credit itself
+		lines = append(lines, LedgerLine{Account: ledgerCommissionRevenue, Debit: refund.Amount})
+	} else {
+		var payment Payment
+		if err := dbmap.SelectOne(&payment, `SELECT * FROM payment WHERE id=$1`,
+			refund.PaymentId); err != nil {
+			return err
+		}
+
+		if err := postPaymentLedger(payment); err != nil {
+			return err
+		}
+
+		lines = append(lines, LedgerLine{Account: ledgerCustomerClearing, Debit: refund.Amount})
+	}
+
+	if refund.Method == refundMethodWallet {
+		lines = append(lines, LedgerLine{Account: ledgerCustomerWallet, UserId: order.UserId,
+			Credit: refund.Amount})
+	} else {
+		lines = append(lines, LedgerLine{Account: ledgerGatewayClearing, Credit: refund.Amount})
+	}
+
+	_, err := postLedgerTransaction("refund", refund.OrderId,
+		"refund:"+strconv.FormatInt(refund.Id, 10),
+		"Pengembalian dana pesanan #"+strconv.FormatInt(refund.OrderId, 10), lines)
+	if err == errLedgerPosted {
+		return nil
+	}
+	return err
+}
+
+// runRefundWorker retry pending refunds which are due
+func runRefundWorker() {
+	for range time.Tick(time.Minute) {
+		runLocked(workerLockRefund, processDueRefunds)
+	}
+}
+
+func processDueRefunds() {
+	var refundIds []int64
+	_, err := dbmap.Select(&refundIds, `SELECT id FROM refund
+		WHERE status=$1 AND next_attempt_date <= $2 ORDER BY id ASC LIMIT 50`, refundPending,
+		time.Now().Unix())
+
+	if err != nil {
+		log.Println("Select due refunds failed", err)
+		return
+	}
+
+	for _, refundId := range refundIds {
+		processRefund(refundId)
+	}
+}
+
+// GetOrderRefunds refunds of an order for the customer
+func GetOrderRefunds(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+	orderId := c.Params.ByName("order_id")
+
+	count, _ := dbmap.SelectInt(`SELECT COUNT(*) FROM ordervendor WHERE id=$1 AND user_id=$2`,
+		orderId, userId)
+	if count == 0 {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	var refunds []Refund
+	_, err := dbmap.Select(&refunds, `SELECT * FROM refund WHERE order_id=$1 ORDER BY id DESC`,
+		orderId)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": refunds})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// GetUserWallet in-app balance of customer with its ledger lines
+func GetUserWallet(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	balance, _ := dbmap.SelectInt(`SELECT COALESCE(SUM(credit - debit), 0) FROM ledgerentry
+		WHERE account=$1 AND user_id=$2`, ledgerCustomerWallet, userId)
+
+	var lines []StatementLine
+	_, err := dbmap.Select(&lines, `SELECT le.id, lt.kind, lt.order_id, lt.description,
+			le.debit, le.credit, le.created_date
+		FROM ledgerentry le
+			JOIN ledgertransaction lt ON lt.id = le.transaction_id
+		WHERE le.account=$1 AND le.user_id=$2
+		ORDER BY le.id DESC`, ledgerCustomerWallet, userId)
+
+	if err == nil {
+		c.JSON(200, gin.H{"balance": balance, "data": lines})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// GetAdminRefunds list refunds, status=-1 for all
+func GetAdminRefunds(c *gin.Context) {
+	status, err := strconv.ParseInt(c.Query("status"), 10, 64)
+	if err != nil {
+		status = -1
+	}
+
+	var refunds []Refund
+	_, err = dbmap.Select(&refunds, `SELECT * FROM refund WHERE ($1 < 0 OR status=$1)
+		ORDER BY id DESC`, status)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": refunds})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
+
+// PostAdminRetryRefund give failed refund a new round of attempts
+func PostAdminRetryRefund(c *gin.Context) {
+	var postRetry PostRetryRefund
+	c.Bind(&postRetry)
+
+	result, err := db.Exec(`UPDATE refund SET status=$1, attempts=0, next_attempt_date=0,
+			updated_date=$2
+		WHERE id=$3 AND status=$4`, refundPending, time.Now().Unix(), postRetry.RefundId, refundFailed)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(409, gin.H{"error": "Refund tidak ditemukan atau tidak gagal"})
+		return
+	}
+
+	go processRefund(postRetry.RefundId)
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
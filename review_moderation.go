@@ -0,0 +1,372 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= REVIEW MODERATION
+
+/**
+Rating report, abusive review reported by customer or provider
+Id
+RatingId
+ReporterType	1 = customer, 2 = provider
+ReporterId
+Reason
+Status		0 = open, 1 = resolved
+CreatedDate
+*/
+type RatingReport struct {
+	Id           int64  `db:"id" json:"id"`
+	RatingId     int64  `db:"rating_id" json:"rating_id"`
+	ReporterType int8   `db:"reporter_type" json:"reporter_type"`
+	ReporterId   int64  `db:"reporter_id" json:"reporter_id"`
+	Reason       string `db:"reason" json:"reason"`
+	Status       int8   `db:"status" json:"status"`
+	CreatedDate  int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Moderation word, review containing one of the words is hidden until an admin reviews it
+Id
+Word		lower case
+CreatedDate
+*/
+type ModerationWord struct {
+	Id          int64  `db:"id" json:"id"`
+	Word        string `db:"word" json:"word"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Moderation log
+Id
+RatingId
+Actor		1 = customer, 2 = provider, 3 = system, 4 = admin
+Action		auto_hide, report, hide, unhide, dismiss
+Note
+CreatedDate
+*/
+type ModerationLog struct {
+	Id          int64  `db:"id" json:"id"`
+	RatingId    int64  `db:"rating_id" json:"rating_id"`
+	Actor       int8   `db:"actor" json:"actor"`
+	Action      string `db:"action" json:"action"`
+	Note        string `db:"note" json:"note"`
+	CreatedDate int64  `db:"created_date" json:"created_date"`
+}
+
+type PostRatingReply struct {
+	RatingId int64  `json:"rating_id"`
+	Reply    string `json:"reply"`
+}
+
+type PostRatingReport struct {
+	RatingId int64  `json:"rating_id"`
+	Reason   string `json:"reason"`
+}
+
+/**
+Post rating moderation
+RatingId
+Action		hide, unhide, dismiss = keep visibility and close reports
+Note
+*/
+type PostRatingModeration struct {
+	RatingId int64  `json:"rating_id"`
+	Action   string `json:"action"`
+	Note     string `json:"note"`
+}
+
+type ModerationItem struct {
+	RatingItem
+	Reports []RatingReport `json:"reports"`
+}
+
+const (
+	moderationActorCustomer = 1
+	moderationActorProvider = 2
+	moderationActorSystem   = 3
+	moderationActorAdmin    = 4
+)
+
+const (
+	ratingReportOpen     = 0
+	ratingReportResolved = 1
+)
+
+func logModeration(ratingId int64, actor int8, action string, note string) {
+	db.Exec(`INSERT INTO moderationlog(rating_id, actor, action, note, created_date)
+		VALUES($1, $2, $3, $4, $5)`, ratingId, actor, action, note, time.Now().Unix())
+}
+
+// findModerationWords words of the word list used in text, matched per whole word
+func findModerationWords(text string) []string {
+	var words []string
+	dbmap.Select(&words, `SELECT word FROM moderationword`)
+
+	listed := make(map[string]bool)
+	for _, word := range words {
+		listed[strings.ToLower(word)] = true
+	}
+
+	tokens := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	var found []string
+	for _, token := range tokens {
+		if listed[token] {
+			found = append(found, token)
+		}
+	}
+
+	return found
+}
+
+// moderateReview hide review containing listed words and queue it for an admin
+func moderateReview(ratingId int64, review string) {
+	found := findModerationWords(review)
+	if len(found) == 0 {
+		return
+	}
+
+	result, err := db.Exec(`UPDATE providerrating SET hidden=1, flagged=1 WHERE id=$1`, ratingId)
+	if err != nil {
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		logModeration(ratingId, moderationActorSystem, "auto_hide", strings.Join(found, ", "))
+	}
+}
+
+// PostProviderRatingReply provider reply once to a review of its order
+func PostProviderRatingReply(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+
+	var postReply PostRatingReply
+	c.Bind(&postReply)
+
+	postReply.Reply = strings.TrimSpace(postReply.Reply)
+	if postReply.Reply == "" {
+		c.JSON(400, gin.H{"error": "Balasan tidak boleh kosong"})
+		return
+	}
+
+	if len(findModerationWords(postReply.Reply)) > 0 {
+		c.JSON(400, gin.H{"error": "Balasan mengandung kata yang tidak diperbolehkan"})
+		return
+	}
+
+	now := time.Now().Unix()
+	result, err := db.Exec(`UPDATE providerrating SET reply=$1, reply_date=$2
+		WHERE id=$3 AND provider_id=$4 AND reply=''`, postReply.Reply, now, postReply.RatingId, providerId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(400, gin.H{"error": "Review tidak ditemukan atau sudah dibalas"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success reply", "reply": postReply.Reply, "reply_date": now})
+}
+
+func reportRating(c *gin.Context, reporterType int8, reporterId int64) {
+	var postReport PostRatingReport
+	c.Bind(&postReport)
+
+	if strings.TrimSpace(postReport.Reason) == "" {
+		c.JSON(400, gin.H{"error": "Alasan laporan harus diisi"})
+		return
+	}
+
+	var rating ProviderRating
+	if err := dbmap.SelectOne(&rating, `SELECT * FROM providerrating WHERE id=$1`,
+		postReport.RatingId); err != nil {
+		c.JSON(400, gin.H{"error": "Review tidak ditemukan"})
+		return
+	}
+
+	// the same reporter counts once per review
+	result, err := db.Exec(`INSERT INTO ratingreport(rating_id, reporter_type, reporter_id, reason,
+		status, created_date) VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`, rating.Id,
+		reporterType, reporterId, postReport.Reason, ratingReportOpen, time.Now().Unix())
+	if err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		db.Exec(`UPDATE providerrating SET flagged=1 WHERE id=$1`, rating.Id)
+		logModeration(rating.Id, reporterType, "report", postReport.Reason)
+	}
+
+	c.JSON(200, gin.H{"status": "Laporan diterima"})
+}
+
+// PostUserRatingReport customer report abusive review
+func PostUserRatingReport(c *gin.Context) {
+	reportRating(c, moderationActorCustomer, getUserIdFromToken(c))
+}
+
+// PostProviderRatingReport provider report abusive review
+func PostProviderRatingReport(c *gin.Context) {
+	reportRating(c, moderationActorProvider, getProviderIdFromToken(c))
+}
+
+// GetAdminModerationQueue reviews reported or hidden by the word list, oldest first
+func GetAdminModerationQueue(c *gin.Context) {
+	var ratings []ProviderRating
+	_, err := dbmap.Select(&ratings, `SELECT * FROM providerrating WHERE flagged=1 ORDER BY id ASC`)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	items := []ModerationItem{}
+	for _, item := range getRatingItems(ratings) {
+		moderationItem := ModerationItem{RatingItem: item, Reports: []RatingReport{}}
+		dbmap.Select(&moderationItem.Reports, `SELECT * FROM ratingreport
+			WHERE rating_id=$1 AND status=$2 ORDER BY id`, item.Id, ratingReportOpen)
+		items = append(items, moderationItem)
+	}
+
+	c.JSON(200, gin.H{"data": items})
+}
+
+// PostAdminModerateRating hide or show a review and close its reports, review is never deleted
+func PostAdminModerateRating(c *gin.Context) {
+	var postModeration PostRatingModeration
+	c.Bind(&postModeration)
+
+	var query string
+	switch postModeration.Action {
+	case "hide":
+		query = `UPDATE providerrating SET hidden=1, flagged=0 WHERE id=$1`
+	case "unhide":
+		query = `UPDATE providerrating SET hidden=0, flagged=0 WHERE id=$1`
+	case "dismiss":
+		query = `UPDATE providerrating SET flagged=0 WHERE id=$1`
+	default:
+		c.JSON(400, gin.H{"error": "Aksi tidak valid"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, postModeration.RatingId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(400, gin.H{"error": "Review tidak ditemukan"})
+		return
+	}
+
+	if _, err := tx.Exec(`UPDATE ratingreport SET status=$1 WHERE rating_id=$2 AND status=$3`,
+		ratingReportResolved, postModeration.RatingId, ratingReportOpen); err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	if _, err := tx.Exec(`INSERT INTO moderationlog(rating_id, actor, action, note, created_date)
+		VALUES($1, $2, $3, $4, $5)`, postModeration.RatingId, moderationActorAdmin,
+		postModeration.Action, postModeration.Note, time.Now().Unix()); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(400, gin.H{"error": "update failed"})
+		return
+	}
+
+	// hidden reviews are left out of the provider rating
+	if providerId, err := dbmap.SelectInt(`SELECT provider_id FROM providerrating WHERE id=$1`,
+		postModeration.RatingId); err == nil && providerId != 0 {
+		syncProviderStats(providerId)
+	}
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
+
+// GetAdminModerationLog moderation history of a review
+func GetAdminModerationLog(c *gin.Context) {
+	var logs []ModerationLog
+	_, err := dbmap.Select(&logs, `SELECT * FROM moderationlog WHERE rating_id=$1 ORDER BY id ASC`,
+		c.Params.ByName("rating_id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": logs})
+}
+
+// PostModerationWord admin add word to the word list
+func PostModerationWord(c *gin.Context) {
+	var word ModerationWord
+	c.Bind(&word)
+
+	word.Word = strings.ToLower(strings.TrimSpace(word.Word))
+	if word.Word == "" || strings.IndexFunc(word.Word, unicode.IsSpace) >= 0 {
+		c.JSON(400, gin.H{"error": "Kata tidak valid"})
+		return
+	}
+
+	word.CreatedDate = time.Now().Unix()
+	if err := db.QueryRow(`INSERT INTO moderationword(word, created_date) VALUES($1, $2)
+		ON CONFLICT (word) DO UPDATE SET word=$1 RETURNING id, created_date`, word.Word,
+		word.CreatedDate).Scan(&word.Id, &word.CreatedDate); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": word})
+}
+
+// PostDeleteModerationWord admin remove word from the word list
+func PostDeleteModerationWord(c *gin.Context) {
+	var word ModerationWord
+	c.Bind(&word)
+
+	result, err := db.Exec(`DELETE FROM moderationword WHERE id=$1`, word.Id)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "delete failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(400, gin.H{"error": "Kata tidak ditemukan"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
+
+// GetModerationWords admin word list
+func GetModerationWords(c *gin.Context) {
+	var words []ModerationWord
+	_, err := dbmap.Select(&words, `SELECT * FROM moderationword ORDER BY word ASC`)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": words, "count": len(words)})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= TRACKING
+
+/**
+Order vendor tracking point, breadcrumb of provider location
+Id
+OrderId
+ProviderId
+Latitude
+Longitude
+Distance	meter from previous point
+Speed		meter per second from previous point
+RecordedDate
+*/
+type OrderVendorTrackingPoint struct {
+	Id           int64   `db:"id" json:"id"`
+	OrderId      int64   `db:"order_id" json:"order_id"`
+	ProviderId   int64   `db:"provider_id" json:"provider_id"`
+	Latitude     float64 `db:"latitude" json:"latitude"`
+	Longitude    float64 `db:"longitude" json:"longitude"`
+	Distance     float64 `db:"distance" json:"distance"`
+	Speed        float64 `db:"speed" json:"speed"`
+	RecordedDate int64   `db:"recorded_date" json:"recorded_date"`
+}
+
+const earthRadius = 6371000.0
+
+// distanceInMeter great circle distance between two coordinates
+func distanceInMeter(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLng := (lng2 - lng1) * toRad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// getOrderStatus latest journey status of order
+func getOrderStatus(orderId int64) (int64, error) {
+	return dbmap.SelectInt(`SELECT COALESCE(MAX(status), 0) FROM ordervendorjourney
+		WHERE order_id=$1`, orderId)
+}
+
+// isOrderActive order is confirmed and not finished yet
+func isOrderActive(orderId int64) bool {
+	status, err := getOrderStatus(orderId)
+
+	return err == nil && status >= 1 && status <= 5
+}
+
+func getLastTrackingPoint(orderId int64) (OrderVendorTrackingPoint, error) {
+	var point OrderVendorTrackingPoint
+	err := dbmap.SelectOne(&point, `SELECT * FROM ordervendortrackingpoint
+		WHERE order_id=$1 ORDER BY recorded_date DESC, id DESC LIMIT 1`, orderId)
+
+	return point, err
+}
+
+// filterTrackingPoint fill distance and speed of point, false when point is jitter or anomaly
+func filterTrackingPoint(point *OrderVendorTrackingPoint) (bool, string) {
+	if point.Latitude == 0 && point.Longitude == 0 {
+		return false, "Lokasi tidak valid"
+	}
+
+	lastPoint, err := getLastTrackingPoint(point.OrderId)
+	if err != nil {
+		return true, ""
+	}
+
+	return filterTrackingPointAfter(point, lastPoint)
+}
+
+// filterTrackingPointAfter fill distance and speed of point moved from last point
+func filterTrackingPointAfter(point *OrderVendorTrackingPoint, lastPoint OrderVendorTrackingPoint) (bool, string) {
+	point.Distance = distanceInMeter(lastPoint.Latitude, lastPoint.Longitude,
+		point.Latitude, point.Longitude)
+
+	if point.Distance < float64(getEnvInt64("TRACKING_MIN_DISTANCE", 10)) {
+		return false, "Perubahan lokasi terlalu kecil"
+	}
+
+	elapsed := point.RecordedDate - lastPoint.RecordedDate
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+
+	point.Speed = point.Distance / float64(elapsed)
+
+	if point.Speed > float64(getEnvInt64("TRACKING_MAX_SPEED", 55)) {
+		return false, "Kecepatan tidak wajar"
+	}
+
+	return true, ""
+}
+
+// saveTrackingPoint store breadcrumb and move latest order location
+func saveTrackingPoint(point OrderVendorTrackingPoint) error {
+	_, err := db.Exec(`INSERT INTO ordervendortrackingpoint(order_id, provider_id, latitude,
+		longitude, distance, speed, recorded_date)
+		VALUES($1, $2, $3, $4, $5, $6, $7)`, point.OrderId, point.ProviderId, point.Latitude,
+		point.Longitude, point.Distance, point.Speed, point.RecordedDate)
+
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(`UPDATE ordervendortracking SET latitude=$1, longitude=$2
+		WHERE order_id=$3`, point.Latitude, point.Longitude, point.OrderId)
+
+	if err == nil {
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			_, err = db.Exec(`INSERT INTO ordervendortracking(order_id, latitude, longitude)
+				VALUES($1, $2, $3)`, point.OrderId, point.Latitude, point.Longitude)
+		}
+	}
+
+	return err
+}
+
+// GetOrderRoute route replay of customer order
+func GetOrderRoute(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+	orderId := c.Params.ByName("order_id")
+
+	var orderVendor OrderVendor
+	err := dbmap.SelectOne(&orderVendor, `SELECT id FROM ordervendor WHERE id=$1 AND user_id=$2`,
+		orderId, userId)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	responseOrderRoute(c, orderVendor.Id)
+}
+
+// GetProviderOrderRoute route replay of provider order
+func GetProviderOrderRoute(c *gin.Context) {
+	providerId := getProviderIdFromToken(c)
+	orderId := c.Params.ByName("order_id")
+
+	var orderVendor OrderVendor
+	err := dbmap.SelectOne(&orderVendor, `SELECT id FROM ordervendor WHERE id=$1 AND provider_id=$2`,
+		orderId, providerId)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Pesanan tidak ditemukan"})
+		return
+	}
+
+	responseOrderRoute(c, orderVendor.Id)
+}
+
+func responseOrderRoute(c *gin.Context, orderId int64) {
+	var points []OrderVendorTrackingPoint
+	_, err := dbmap.Select(&points, `SELECT * FROM ordervendortrackingpoint
+		WHERE order_id=$1 ORDER BY recorded_date ASC, id ASC`, orderId)
+
+	if err != nil {
+		c.JSON(400, gin.H{"error": "select failed"})
+		return
+	}
+
+	var totalDistance float64
+	for _, point := range points {
+		totalDistance += point.Distance
+	}
+
+	c.JSON(200, gin.H{
+		"order_id":       orderId,
+		"points":         points,
+		"total_distance": totalDistance,
+	})
+}
+
+// runTrackingRetentionWorker purge breadcrumbs older than retention days
+func runTrackingRetentionWorker() {
+	for range time.Tick(time.Hour) {
+		runLocked(workerLockTrackingRetention, purgeTrackingPoints)
+	}
+}
+
+func purgeTrackingPoints() {
+	retention := getEnvInt64("TRACKING_RETENTION_DAYS", 30) * 24 * 60 * 60
+
+	result, err := db.Exec(`DELETE FROM ordervendortrackingpoint WHERE recorded_date < $1`,
+		time.Now().Unix()-retention)
+
+	if err == nil {
+		affected, _ := result.RowsAffected()
+		log.Println("Purged tracking points", affected)
+	} else {
+		log.Println("Purge tracking points failed", err)
+	}
+
+	// tracking events carry the same coordinates, replay only loses the purged breadcrumbs
+	result, err = db.Exec(`DELETE FROM orderevent WHERE event_type=$1 AND created_date < $2`,
+		orderEventTracking, time.Now().Unix()-retention)
+
+	if err == nil {
+		affected, _ := result.RowsAffected()
+		log.Println("Purged tracking events", affected)
+	} else {
+		log.Println("Purge tracking events failed", err)
+	}
+}
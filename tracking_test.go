@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFilterTrackingPointInvalidLocation(t *testing.T) {
+	point := OrderVendorTrackingPoint{OrderId: 1}
+
+	if accepted, reason := filterTrackingPoint(&point); accepted || reason != "Lokasi tidak valid" {
+		t.Errorf("filterTrackingPoint(0, 0) = %v, %q", accepted, reason)
+	}
+}
+
+func TestFilterTrackingPointAfter(t *testing.T) {
+	last := OrderVendorTrackingPoint{Latitude: -6.2, Longitude: 106.8, RecordedDate: 1000}
+
+	tests := []struct {
+		name     string
+		latitude float64
+		date     int64
+		accepted bool
+		reason   string
+		minSpeed float64
+		maxSpeed float64
+	}{
+		// 0.0001 degree of latitude is about 11 meters
+		{"jitter", -6.20005, 1010, false, "Perubahan lokasi terlalu kecil", 0, 0},
+		{"walking", -6.2001, 1010, true, "", 1, 1.2},
+		{"driving", -6.201, 1010, true, "", 11, 11.2},
+		{"same second", -6.2001, 1000, true, "", 11, 11.2},
+		{"teleport", -6.21, 1010, false, "Kecepatan tidak wajar", 111, 111.2},
+	}
+
+	for _, test := range tests {
+		point := OrderVendorTrackingPoint{Latitude: test.latitude, Longitude: 106.8, RecordedDate: test.date}
+		accepted, reason := filterTrackingPointAfter(&point, last)
+
+		if accepted != test.accepted || reason != test.reason {
+			t.Errorf("%s: got %v, %q, want %v, %q", test.name, accepted, reason, test.accepted, test.reason)
+		}
+
+		if test.maxSpeed > 0 && (point.Speed < test.minSpeed || point.Speed > test.maxSpeed) {
+			t.Errorf("%s: speed %f, want between %f and %f", test.name, point.Speed, test.minSpeed,
+				test.maxSpeed)
+		}
+	}
+}
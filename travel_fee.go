@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= TRAVEL FEE
+
+/**
+Travel fee band, fee of providers up to MaxDistance away from the customer
+Id
+MaxDistance	meter, upper bound of the band
+Fee
+
+Distance beyond the widest band pays the fee of the widest band, no band means no travel fee
+*/
+type TravelFeeBand struct {
+	Id          int64 `db:"id" json:"id"`
+	MaxDistance int64 `db:"max_distance" json:"max_distance"`
+	Fee         int64 `db:"fee" json:"fee"`
+}
+
+func getTravelFeeBands() []TravelFeeBand {
+	bands := []TravelFeeBand{}
+	dbmap.Select(&bands, `SELECT * FROM travelfeeband ORDER BY max_distance ASC`)
+	return bands
+}
+
+// travelFee fee of the narrowest band containing distance, bands ordered by max distance
+func travelFee(bands []TravelFeeBand, distance float64) int64 {
+	if len(bands) == 0 {
+		return 0
+	}
+
+	for _, band := range bands {
+		if distance <= float64(band.MaxDistance) {
+			return band.Fee
+		}
+	}
+
+	return bands[len(bands)-1].Fee
+}
+
+// PostTravelFeeBand create or update fee of a distance band
+func PostTravelFeeBand(c *gin.Context) {
+	var band TravelFeeBand
+	c.Bind(&band)
+
+	if band.MaxDistance <= 0 || band.Fee < 0 {
+		c.JSON(400, gin.H{"error": "Band biaya perjalanan tidak valid"})
+		return
+	}
+
+	if err := db.QueryRow(`INSERT INTO travelfeeband(max_distance, fee) VALUES($1, $2)
+		ON CONFLICT (max_distance) DO UPDATE SET fee=$2
+		RETURNING id`, band.MaxDistance, band.Fee).Scan(&band.Id); err == nil {
+		c.JSON(200, band)
+	} else {
+		c.JSON(400, gin.H{"error": "insert failed"})
+	}
+}
+
+// PostDeleteTravelFeeBand remove a distance band
+func PostDeleteTravelFeeBand(c *gin.Context) {
+	var band TravelFeeBand
+	c.Bind(&band)
+
+	result, err := db.Exec(`DELETE FROM travelfeeband WHERE id=$1`, band.Id)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "delete failed"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(400, gin.H{"error": "Band tidak ditemukan"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "Success"})
+}
+
+// GetTravelFeeBands list distance bands, narrowest first
+func GetTravelFeeBands(c *gin.Context) {
+	c.JSON(200, gin.H{"data": getTravelFeeBands()})
+}
+
+// setProviderTravelFee travel fee of provider search results by their distance
+func setProviderTravelFee(providers []ProviderByCat) {
+	bands := getTravelFeeBands()
+	for i := range providers {
+		providers[i].TravelFee = travelFee(bands, providers[i].Distance)
+	}
+}
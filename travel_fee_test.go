@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTravelFee(t *testing.T) {
+	bands := []TravelFeeBand{
+		{MaxDistance: 2000, Fee: 0},
+		{MaxDistance: 5000, Fee: 5000},
+		{MaxDistance: 10000, Fee: 12000},
+	}
+
+	tests := []struct {
+		name     string
+		bands    []TravelFeeBand
+		distance float64
+		fee      int64
+	}{
+		{"no band", nil, 3000, 0},
+		{"nearest band", bands, 500, 0},
+		{"band bound is inclusive", bands, 2000, 0},
+		{"just past bound", bands, 2000.5, 5000},
+		{"widest band", bands, 9999, 12000},
+		{"beyond widest band", bands, 25000, 12000},
+	}
+
+	for _, test := range tests {
+		if fee := travelFee(test.bands, test.distance); fee != test.fee {
+			t.Errorf("%s: travelFee(%.1f) = %d, want %d", test.name, test.distance, fee, test.fee)
+		}
+	}
+}
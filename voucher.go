@@ -0,0 +1,443 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========================= VOUCHER
+
+/**
+Voucher code applied at checkout
+Id
+Code		unique, stored upper case
+Title
+DiscountType	1 = percentage, 2 = fixed amount
+DiscountValue	percent for percentage, rupiah for fixed amount
+MaxDiscount	cap of percentage discount, 0 = no cap
+MinOrder	minimum order total
+FirstOrderOnly	1 = only for customer without previous order
+PerUserLimit	0 = unlimited
+UsageLimit	global limit, 0 = unlimited
+UsedCount	reserved and redeemed usages
+StartDate
+EndDate		0 = no end
+Active
+CreatedDate
+*/
+type Voucher struct {
+	Id             int64  `db:"id" json:"id"`
+	Code           string `db:"code" json:"code"`
+	Title          string `db:"title" json:"title"`
+	DiscountType   int64  `db:"discount_type" json:"discount_type"`
+	DiscountValue  int64  `db:"discount_value" json:"discount_value"`
+	MaxDiscount    int64  `db:"max_discount" json:"max_discount"`
+	MinOrder       int64  `db:"min_order" json:"min_order"`
+	FirstOrderOnly int64  `db:"first_order_only" json:"first_order_only"`
+	PerUserLimit   int64  `db:"per_user_limit" json:"per_user_limit"`
+	UsageLimit     int64  `db:"usage_limit" json:"usage_limit"`
+	UsedCount      int64  `db:"used_count" json:"used_count"`
+	StartDate      int64  `db:"start_date" json:"start_date"`
+	EndDate        int64  `db:"end_date" json:"end_date"`
+	Active         int64  `db:"active" json:"active"`
+	CreatedDate    int64  `db:"created_date" json:"created_date"`
+}
+
+/**
+Voucher eligibility, voucher with rows of a kind is limited to them
+Id
+VoucherId
+Kind		1 = kategori jasa, 2 = provider
+RefId		jasa_id or provider_id
+*/
+type VoucherEligibility struct {
+	Id        int64 `db:"id" json:"id"`
+	VoucherId int64 `db:"voucher_id" json:"voucher_id"`
+	Kind      int64 `db:"kind" json:"kind"`
+	RefId     int64 `db:"ref_id" json:"ref_id"`
+}
+
+/**
+Voucher usage, one per order
+Id
+VoucherId
+UserId
+OrderId		0 while order is being created
+Discount
+Status		0 = reserved, 1 = redeemed, 2 = released
+CreatedDate
+UpdatedDate
+*/
+type VoucherUsage struct {
+	Id          int64 `db:"id" json:"id"`
+	VoucherId   int64 `db:"voucher_id" json:"voucher_id"`
+	UserId      int64 `db:"user_id" json:"user_id"`
+	OrderId     int64 `db:"order_id" json:"order_id"`
+	Discount    int64 `db:"discount" json:"discount"`
+	Status      int64 `db:"status" json:"status"`
+	CreatedDate int64 `db:"created_date" json:"created_date"`
+	UpdatedDate int64 `db:"updated_date" json:"updated_date"`
+}
+
+type PostVoucherData struct {
+	Voucher
+	JasaIds     []int64 `json:"jasa_ids"`
+	ProviderIds []int64 `json:"provider_ids"`
+}
+
+type PostVoucherCheck struct {
+	Code       string                  `json:"code"`
+	ProviderId int64                   `json:"provider_id"`
+	JasaId     int64                   `json:"jasa_id"`
+	Data       []PostTransactionDetail `json:"data"`
+}
+
+/* Order the voucher is checked against */
+type VoucherOrder struct {
+	UserId     int64
+	JasaId     int64
+	ProviderId int64
+	Total      int64
+}
+
+const (
+	voucherPercentage = 1
+	voucherFixed      = 2
+)
+
+const (
+	voucherForJasa     = 1
+	voucherForProvider = 2
+)
+
+const (
+	voucherReserved = 0
+	voucherRedeemed = 1
+	voucherReleased = 2
+)
+
+// voucherQueryer is *sql.DB or *sql.Tx, rules are checked inside reservation transaction too
+type voucherQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func normalizeVoucherCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func getTransactionTotal(details []PostTransactionDetail) int64 {
+	var total int64
+	for _, detail := range details {
+		total += detail.ServicePrice * detail.Qty
+	}
+	return total
+}
+
+func isVoucherEligible(q voucherQueryer, voucherId int64, kind int64, refId int64) bool {
+	var rules, matches int64
+	q.QueryRow(`SELECT COUNT(*), COUNT(*) FILTER (WHERE ref_id=$3) FROM vouchereligibility
+		WHERE voucher_id=$1 AND kind=$2`, voucherId, kind, refId).Scan(&rules, &matches)
+	return rules == 0 || matches > 0
+}
+
+// checkVoucher validate voucher rules for the order and return its discount
+func checkVoucher(q voucherQueryer, voucher Voucher, order VoucherOrder) (int64, error) {
+	now := time.Now().Unix()
+
+	if voucher.Active != 1 || now < voucher.StartDate || (voucher.EndDate != 0 && now > voucher.EndDate) {
+		return 0, errors.New("Voucher tidak berlaku")
+	}
+
+	if voucher.UsageLimit > 0 && voucher.UsedCount >= voucher.UsageLimit {
+		return 0, errors.New("Kuota voucher sudah habis")
+	}
+
+	if order.Total < voucher.MinOrder {
+		return 0, errors.New("Total pesanan belum mencapai minimum voucher")
+	}
+
+	if !isVoucherEligible(q, voucher.Id, voucherForJasa, order.JasaId) ||
+		!isVoucherEligible(q, voucher.Id, voucherForProvider, order.ProviderId) {
+		return 0, errors.New("Voucher tidak berlaku untuk layanan ini")
+	}
+
+	if voucher.FirstOrderOnly == 1 {
+		var previous int64
+		q.QueryRow(`SELECT COUNT(*) FROM ordervendor ov
+			WHERE ov.user_id=$1 AND NOT EXISTS (SELECT 1 FROM ordervendorjourney ovj
+				WHERE ovj.order_id = ov.id AND ovj.status >= $2)`, order.UserId,
+			orderStatusRejected).Scan(&previous)
+
+		if previous > 0 {
+			return 0, errors.New("Voucher hanya untuk pesanan pertama")
+		}
+	}
+
+	if voucher.PerUserLimit > 0 {
+		var used int64
+		q.QueryRow(`SELECT COUNT(*) FROM voucherusage WHERE voucher_id=$1 AND user_id=$2 AND status<>$3`,
+			voucher.Id, order.UserId, voucherReleased).Scan(&used)
+
+		if used >= voucher.PerUserLimit {
+			return 0, errors.New("Batas pemakaian voucher sudah tercapai")
+		}
+	}
+
+	return voucherDiscount(voucher, order.Total), nil
+}
+
+// voucherDiscount percentage capped by max discount, never more than the order total
+func voucherDiscount(voucher Voucher, total int64) int64 {
+	discount := voucher.DiscountValue
+	if voucher.DiscountType == voucherPercentage {
+		discount = total * voucher.DiscountValue / 100
+		if voucher.MaxDiscount > 0 && discount > voucher.MaxDiscount {
+			discount = voucher.MaxDiscount
+		}
+	}
+
+	if discount > total {
+		discount = total
+	}
+
+	return discount
+}
+
+// reserveVoucher hold one usage of the voucher, the voucher row lock serializes concurrent orders
+func reserveVoucher(code string, order VoucherOrder) (VoucherUsage, error) {
+	var usage VoucherUsage
+
+	tx, err := db.Begin()
+	if err != nil {
+		return usage, err
+	}
+	defer tx.Rollback()
+
+	var voucher Voucher
+	err = tx.QueryRow(`SELECT id, discount_type, discount_value, max_discount, min_order,
+			first_order_only, per_user_limit, usage_limit, used_count, start_date, end_date, active
+		FROM voucher WHERE code=$1 FOR UPDATE`, normalizeVoucherCode(code)).Scan(&voucher.Id,
+		&voucher.DiscountType, &voucher.DiscountValue, &voucher.MaxDiscount, &voucher.MinOrder,
+		&voucher.FirstOrderOnly, &voucher.PerUserLimit, &voucher.UsageLimit, &voucher.UsedCount,
+		&voucher.StartDate, &voucher.EndDate, &voucher.Active)
+	if err != nil {
+		return usage, errors.New("Voucher tidak ditemukan")
+	}
+
+	discount, err := checkVoucher(tx, voucher, order)
+	if err != nil {
+		return usage, err
+	}
+
+	if _, err := tx.Exec(`UPDATE voucher SET used_count=used_count + 1 WHERE id=$1`,
+		voucher.Id); err != nil {
+		return usage, err
+	}
+
+	now := time.Now().Unix()
+	usage = VoucherUsage{
+		VoucherId:   voucher.Id,
+		UserId:      order.UserId,
+		Discount:    discount,
+		Status:      voucherReserved,
+		CreatedDate: now,
+		UpdatedDate: now,
+	}
+
+	if err := tx.QueryRow(`INSERT INTO voucherusage(voucher_id, user_id, order_id, discount, status,
+			created_date, updated_date)
+		VALUES($1, $2, 0, $3, $4, $5, $6) RETURNING id`, usage.VoucherId, usage.UserId, usage.Discount,
+		usage.Status, usage.CreatedDate, usage.UpdatedDate).Scan(&usage.Id); err != nil {
+		return usage, err
+	}
+
+	return usage, tx.Commit()
+}
+
+// attachVoucherUsage link reservation to the created order
+func attachVoucherUsage(usage VoucherUsage, orderId int64) {
+	db.Exec(`UPDATE voucherusage SET order_id=$1, updated_date=$2 WHERE id=$3`, orderId,
+		time.Now().Unix(), usage.Id)
+}
+
+// releaseVoucherUsage give reserved usage back to the voucher quota
+func releaseVoucherUsage(usageId int64) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var voucherId int64
+	if err := tx.QueryRow(`UPDATE voucherusage SET status=$1, updated_date=$2
+		WHERE id=$3 AND status=$4 RETURNING voucher_id`, voucherReleased, time.Now().Unix(), usageId,
+		voucherReserved).Scan(&voucherId); err != nil {
+		return
+	}
+
+	tx.Exec(`UPDATE voucher SET used_count=used_count - 1 WHERE id=$1 AND used_count > 0`, voucherId)
+	tx.Commit()
+}
+
+// releaseOrderVoucher release voucher of canceled order
+func releaseOrderVoucher(orderId int64) {
+	var usageIds []int64
+	dbmap.Select(&usageIds, `SELECT id FROM voucherusage WHERE order_id=$1 AND status=$2`, orderId,
+		voucherReserved)
+
+	for _, usageId := range usageIds {
+		releaseVoucherUsage(usageId)
+	}
+}
+
+// redeemOrderVoucher voucher usage of complete order is final
+func redeemOrderVoucher(orderId int64) {
+	db.Exec(`UPDATE voucherusage SET status=$1, updated_date=$2 WHERE order_id=$3 AND status=$4`,
+		voucherRedeemed, time.Now().Unix(), orderId, voucherReserved)
+}
+
+// getOrderCharge line items total and discount of voucher and points,
+// discount never exceeds total after amendments
+func getOrderCharge(orderId int64) (int64, int64, error) {
+	total, err := getOrderTotal(orderId)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	discount, err := dbmap.SelectInt(`SELECT discount + points_discount FROM ordervendor WHERE id=$1`,
+		orderId)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if discount > total {
+		discount = total
+	}
+
+	return total, discount, nil
+}
+
+// getOrderAmountDue amount customer pays for the order
+func getOrderAmountDue(orderId int64) (int64, error) {
+	total, discount, err := getOrderCharge(orderId)
+	return total - discount, err
+}
+
+// PostValidateVoucher check voucher for an order about to be created, nothing is reserved
+func PostValidateVoucher(c *gin.Context) {
+	userId := getUserIdFromToken(c)
+
+	var postValidate PostVoucherCheck
+	c.Bind(&postValidate)
+
+	order := VoucherOrder{
+		UserId:     userId,
+		JasaId:     postValidate.JasaId,
+		ProviderId: postValidate.ProviderId,
+		Total:      getTransactionTotal(postValidate.Data),
+	}
+
+	if order.ProviderId != 0 {
+		jasaId, err := dbmap.SelectInt(`SELECT jasa_id FROM providerdata WHERE id=$1`, order.ProviderId)
+		if err != nil || jasaId == 0 {
+			c.JSON(400, gin.H{"error": "Penyedia Jasa tidak terdaftar atau tidak aktif"})
+			return
+		}
+		order.JasaId = jasaId
+	}
+
+	var voucher Voucher
+	if err := dbmap.SelectOne(&voucher, `SELECT * FROM voucher WHERE code=$1`,
+		normalizeVoucherCode(postValidate.Code)); err != nil {
+		c.JSON(400, gin.H{"error": "Voucher tidak ditemukan"})
+		return
+	}
+
+	discount, err := checkVoucher(db, voucher, order)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"code": voucher.Code, "title": voucher.Title, "discount": discount,
+		"total": order.Total - discount})
+}
+
+// PostVoucher admin create or update voucher by code
+func PostVoucher(c *gin.Context) {
+	var postVoucher PostVoucherData
+	c.Bind(&postVoucher)
+
+	voucher := postVoucher.Voucher
+	voucher.Code = normalizeVoucherCode(voucher.Code)
+
+	if voucher.Code == "" || voucher.DiscountValue <= 0 ||
+		(voucher.DiscountType != voucherPercentage && voucher.DiscountType != voucherFixed) ||
+		(voucher.DiscountType == voucherPercentage && voucher.DiscountValue > 100) ||
+		voucher.MaxDiscount < 0 || voucher.MinOrder < 0 || voucher.PerUserLimit < 0 ||
+		voucher.UsageLimit < 0 {
+		c.JSON(400, gin.H{"error": "Voucher tidak valid"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(`INSERT INTO voucher(code, title, discount_type, discount_value,
+			max_discount, min_order, first_order_only, per_user_limit, usage_limit, used_count,
+			start_date, end_date, active, created_date)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, 0, $10, $11, $12, $13)
+		ON CONFLICT (code) DO UPDATE SET title=$2, discount_type=$3, discount_value=$4,
+			max_discount=$5, min_order=$6, first_order_only=$7, per_user_limit=$8, usage_limit=$9,
+			start_date=$10, end_date=$11, active=$12
+		RETURNING id, used_count`, voucher.Code, voucher.Title, voucher.DiscountType,
+		voucher.DiscountValue, voucher.MaxDiscount, voucher.MinOrder, voucher.FirstOrderOnly,
+		voucher.PerUserLimit, voucher.UsageLimit, voucher.StartDate, voucher.EndDate, voucher.Active,
+		time.Now().Unix()).Scan(&voucher.Id, &voucher.UsedCount); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	tx.Exec(`DELETE FROM vouchereligibility WHERE voucher_id=$1`, voucher.Id)
+
+	for kind, refIds := range map[int64][]int64{
+		voucherForJasa:     postVoucher.JasaIds,
+		voucherForProvider: postVoucher.ProviderIds,
+	} {
+		for _, refId := range refIds {
+			if _, err := tx.Exec(`INSERT INTO vouchereligibility(voucher_id, kind, ref_id)
+				VALUES($1, $2, $3)`, voucher.Id, kind, refId); err != nil {
+				c.JSON(400, gin.H{"error": "insert failed"})
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(400, gin.H{"error": "insert failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": voucher, "jasa_ids": postVoucher.JasaIds,
+		"provider_ids": postVoucher.ProviderIds})
+}
+
+// GetAdminVouchers list vouchers with their usage
+func GetAdminVouchers(c *gin.Context) {
+	var vouchers []Voucher
+	_, err := dbmap.Select(&vouchers, `SELECT * FROM voucher ORDER BY id DESC`)
+
+	if err == nil {
+		c.JSON(200, gin.H{"data": vouchers})
+	} else {
+		c.JSON(400, gin.H{"error": "select failed"})
+	}
+}
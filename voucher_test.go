@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVoucherDiscount(t *testing.T) {
+	tests := []struct {
+		name     string
+		voucher  Voucher
+		total    int64
+		discount int64
+	}{
+		{"fixed", Voucher{DiscountType: voucherFixed, DiscountValue: 20000}, 100000, 20000},
+		{"fixed above total", Voucher{DiscountType: voucherFixed, DiscountValue: 20000}, 15000, 15000},
+		{"percentage", Voucher{DiscountType: voucherPercentage, DiscountValue: 10}, 150000, 15000},
+		{"percentage rounds down", Voucher{DiscountType: voucherPercentage, DiscountValue: 15}, 9999, 1499},
+		{"percentage under cap", Voucher{DiscountType: voucherPercentage, DiscountValue: 10,
+			MaxDiscount: 25000}, 200000, 20000},
+		{"percentage capped", Voucher{DiscountType: voucherPercentage, DiscountValue: 50,
+			MaxDiscount: 25000}, 200000, 25000},
+		{"full percentage", Voucher{DiscountType: voucherPercentage, DiscountValue: 100}, 80000, 80000},
+	}
+
+	for _, test := range tests {
+		if discount := voucherDiscount(test.voucher, test.total); discount != test.discount {
+			t.Errorf("%s: discount %d, want %d", test.name, discount, test.discount)
+		}
+	}
+}
+
+// TestCheckVoucherRejects rules checked before eligibility, they never query the database
+func TestCheckVoucherRejects(t *testing.T) {
+	now := time.Now().Unix()
+	valid := Voucher{Active: 1, StartDate: now - 3600, DiscountType: voucherFixed, DiscountValue: 10000}
+
+	inactive := valid
+	inactive.Active = 0
+
+	notStarted := valid
+	notStarted.StartDate = now + 3600
+
+	ended := valid
+	ended.EndDate = now - 60
+
+	usedUp := valid
+	usedUp.UsageLimit = 100
+	usedUp.UsedCount = 100
+
+	minOrder := valid
+	minOrder.MinOrder = 50000
+
+	tests := []struct {
+		name    string
+		voucher Voucher
+		message string
+	}{
+		{"inactive", inactive, "Voucher tidak berlaku"},
+		{"not started", notStarted, "Voucher tidak berlaku"},
+		{"ended", ended, "Voucher tidak berlaku"},
+		{"used up", usedUp, "Kuota voucher sudah habis"},
+		{"below minimum", minOrder, "Total pesanan belum mencapai minimum voucher"},
+	}
+
+	for _, test := range tests {
+		_, err := checkVoucher(nil, test.voucher, VoucherOrder{Total: 40000})
+		if err == nil || err.Error() != test.message {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.message)
+		}
+	}
+}
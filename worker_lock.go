@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+)
+
+// ========================= WORKER LOCK
+
+// advisory lock keys of background workers
+const (
+	workerLockOrderExpiry int64 = iota + 1
+	workerLockDispatch
+	workerLockTrackingRetention
+	workerLockRefund
+	workerLockLoyaltyExpiry
+)
+
+// runLocked run one tick of a worker on a single instance, other instances skip the tick,
+// transaction level advisory lock is released when the transaction ends or the instance dies
+func runLocked(lockKey int64, job func()) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Begin worker lock failed", lockKey, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1)`, lockKey).Scan(&locked); err != nil {
+		log.Println("Worker lock failed", lockKey, err)
+		return
+	}
+
+	if locked {
+		job()
+	}
+}